@@ -0,0 +1,570 @@
+package naming
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	commandLogFileName = "commands.log"
+	// compactionThreshold - the command log is compacted once it holds this many records
+	// more than twice the commands it describes
+	compactionThreshold = 1000
+	// idempotencyHeader - header carrying the id of a command, so that a storage server
+	// applies a retried command only once
+	idempotencyHeader = "Idempotency-Key"
+	// commandTimeout - a command not answered for this long is retried
+	commandTimeout = time.Minute
+	// maxDeadLetters - number of abandoned commands kept for operators
+	maxDeadLetters = 1000
+	// copyAttempts - attempts of a copy before the caller gives up on it
+	copyAttempts = 3
+)
+
+// commandURL - the URL of a command on the command interface of the storage server
+func (k storageKey) commandURL(command string) string {
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(k.IP, strconv.Itoa(k.CommandPort)), command)
+}
+
+// String - the client address of the storage server, used in logs
+func (k storageKey) String() string {
+	return net.JoinHostPort(k.IP, strconv.Itoa(k.ClientPort))
+}
+
+// storageCommand - a command sent from the naming server to a storage server
+type storageCommand struct {
+	ID        string          `json:"id"` // idempotency key, the same for every attempt
+	Server    storageKey      `json:"server"`
+	Command   string          `json:"command"`
+	Body      json.RawMessage `json:"body"`
+	Created   int64           `json:"created"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	next      time.Time       // earliest time of the next attempt
+}
+
+// operations recorded in the command log
+const (
+	cmdQueued    = "queued"    // a command was queued
+	cmdDelivered = "delivered" // a queued command was delivered
+	cmdAbandoned = "abandoned" // a queued command became a dead letter
+)
+
+// commandLogRecord - one change of the queue in the command log
+type commandLogRecord struct {
+	Op      string          `json:"op"`
+	Command *storageCommand `json:"command,omitempty"` // for cmdQueued and cmdAbandoned
+	ID      string          `json:"id,omitempty"`      // for cmdDelivered
+}
+
+// commandQueue - outbound commands to storage servers, delivered in order
+// At most one command is sent to a storage server at a time, and a command is only sent
+// once every earlier command to the same server has been delivered or abandoned. A command
+// that cannot be delivered, because the storage server cannot be reached or failed with 5xx,
+// is queued, and later commands to the same server are queued behind it. Queued commands are
+// retried with exponential backoff; a command failing maxAttempts times is abandoned and
+// kept as a dead letter. Every attempt carries the id of the command, so a storage server
+// that received a command whose response got lost does not apply it twice.
+// If dir is not empty, changes of the queue are appended to a log in it, which is compacted
+// when it opens and whenever it has grown large.
+type commandQueue struct {
+	dir         string
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+	client      *http.Client
+	// fields guarded by mtx
+	mtx     sync.Mutex
+	pending map[storageKey][]*storageCommand
+	// a command is being sent to the server, or a goroutine is delivering its queue
+	running map[storageKey]bool
+	// signalled whenever a server stops running
+	idle        *sync.Cond
+	deadLetters []*storageCommand
+	log         *os.File
+	nRecords    int // records in the log since it was compacted
+}
+
+// openCommandQueue - creates the command queue, recovering the commands logged in config.DataDir
+func openCommandQueue(config Config) (*commandQueue, error) {
+	q := &commandQueue{
+		dir:         config.DataDir,
+		backoff:     config.CommandBackoff,
+		maxBackoff:  config.CommandMaxBackoff,
+		maxAttempts: config.CommandAttempts,
+		client:      &http.Client{Timeout: commandTimeout},
+		pending:     make(map[storageKey][]*storageCommand),
+		running:     make(map[storageKey]bool),
+		deadLetters: make([]*storageCommand, 0),
+	}
+	q.idle = sync.NewCond(&q.mtx)
+	if q.dir == "" {
+		return q, nil
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	recovered := 0
+	for _, cmds := range q.pending {
+		recovered += len(cmds)
+	}
+	if recovered > 0 {
+		fmt.Printf("recovered %d queued storage commands\n", recovered)
+	}
+	return q, nil
+}
+
+func (q *commandQueue) logPath() string {
+	return filepath.Join(q.dir, commandLogFileName)
+}
+
+// load - replays the command log
+// A torn record at the end of the log (crash during append) is ignored.
+// A record that cannot be parsed anywhere else, or that misses its command,
+// means the log is corrupted, and loading fails.
+func (q *commandQueue) load() error {
+	file, err := os.Open(q.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	torn := 0 // line of a record that cannot be parsed
+	for scanner.Scan() {
+		line++
+		if torn > 0 {
+			// only the last record may be torn, anything before it was flushed
+			return fmt.Errorf("corrupted command log %s: cannot parse record %d", q.logPath(), torn)
+		}
+		var record commandLogRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			torn = line
+			continue
+		}
+		switch record.Op {
+		case cmdQueued:
+			if record.Command == nil {
+				return fmt.Errorf("corrupted command log %s: record %d has no command", q.logPath(), line)
+			}
+			q.pending[record.Command.Server] = append(q.pending[record.Command.Server], record.Command)
+		case cmdDelivered:
+			q.remove(record.ID)
+		case cmdAbandoned:
+			if record.Command == nil {
+				return fmt.Errorf("corrupted command log %s: record %d has no command", q.logPath(), line)
+			}
+			q.remove(record.Command.ID)
+			q.addDeadLetter(record.Command)
+		default:
+			return fmt.Errorf("corrupted command log %s: record %d has unknown op %q", q.logPath(), line, record.Op)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if torn > 0 {
+		fmt.Printf("ignoring torn command log record %d\n", torn)
+	}
+	return nil
+}
+
+// remove - removes a command from the queue of its server
+// The caller must hold q.mtx, or be the only user of q.
+func (q *commandQueue) remove(id string) {
+	for server, cmds := range q.pending {
+		for i, cmd := range cmds {
+			if cmd.ID == id {
+				q.pending[server] = append(cmds[:i:i], cmds[i+1:]...)
+				if len(q.pending[server]) == 0 {
+					delete(q.pending, server)
+				}
+				return
+			}
+		}
+	}
+}
+
+// compact - atomically replaces the log with the records of the current queue, and opens it for appending
+// The caller must hold q.mtx, or be the only user of q.
+func (q *commandQueue) compact() error {
+	buffer := make([]byte, 0)
+	appendRecord := func(record commandLogRecord) error {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buffer = append(append(buffer, data...), '\n')
+		return nil
+	}
+	nRecords := 0
+	for _, cmds := range q.pending {
+		for _, cmd := range cmds {
+			if err := appendRecord(commandLogRecord{Op: cmdQueued, Command: cmd}); err != nil {
+				return err
+			}
+			nRecords++
+		}
+	}
+	for _, cmd := range q.deadLetters {
+		if err := appendRecord(commandLogRecord{Op: cmdAbandoned, Command: cmd}); err != nil {
+			return err
+		}
+		nRecords++
+	}
+	tmpPath := q.logPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, buffer, 0666); err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = os.Rename(tmpPath, q.logPath()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if q.log != nil {
+		q.log.Close()
+	}
+	q.log = tmp
+	q.nRecords = nRecords
+	return nil
+}
+
+// record - appends a change of the queue to the log
+// Only queued and abandoned commands are flushed to disk: losing the record of a delivered
+// command only makes it delivered again, which the storage server recognizes by its id.
+// The caller must hold q.mtx.
+func (q *commandQueue) record(record commandLogRecord) {
+	if q.log == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if _, err = q.log.Write(append(data, '\n')); err == nil && record.Op != cmdDelivered {
+		err = q.log.Sync()
+	}
+	if err != nil {
+		fmt.Printf("cannot log the command queue: %s\n", err.Error())
+		return
+	}
+	q.nRecords++
+	live := len(q.deadLetters)
+	for _, cmds := range q.pending {
+		live += len(cmds)
+	}
+	if q.nRecords > compactionThreshold+2*live {
+		if err = q.compact(); err != nil {
+			fmt.Printf("command log compaction failed: %s\n", err.Error())
+		}
+	}
+}
+
+// start - starts delivering the recovered commands
+func (q *commandQueue) start() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for server := range q.pending {
+		if !q.running[server] {
+			q.running[server] = true
+			go q.deliverQueue(server)
+		}
+	}
+}
+
+// newCommand - creates a command with a fresh id
+func newCommand(server storageKey, command string, body any) (*storageCommand, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &storageCommand{
+		ID:      newSessionID(), // random, like session ids
+		Server:  server,
+		Command: command,
+		Body:    data,
+		Created: time.Now().UnixNano(),
+	}, nil
+}
+
+// deliver - sends a command once
+// returns the response if the storage server answered, or an error if the command should
+// be retried because it could not be sent, timed out or failed with 5xx
+func (q *commandQueue) deliver(cmd *storageCommand) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodPost, cmd.Server.commandURL(cmd.Command), bytes.NewReader(cmd.Body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(idempotencyHeader, cmd.ID)
+	resp, err := q.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("%s failed with status code %d", cmd.Command, resp.StatusCode)
+	}
+	return data, nil
+}
+
+// delay - time to wait before the next attempt of a command that failed attempts times
+func (q *commandQueue) delay(attempts int) time.Duration {
+	delay := q.backoff
+	for i := 1; i < attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if q.maxBackoff > 0 && delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	return delay
+}
+
+// addDeadLetter - keeps an abandoned command for operators
+func (q *commandQueue) addDeadLetter(cmd *storageCommand) {
+	q.deadLetters = append(q.deadLetters, cmd)
+	if len(q.deadLetters) > maxDeadLetters {
+		q.deadLetters = q.deadLetters[len(q.deadLetters)-maxDeadLetters:]
+	}
+}
+
+// abandon - moves a command that failed too often to the dead letters
+// The caller must hold q.mtx.
+func (q *commandQueue) abandon(cmd *storageCommand) {
+	fmt.Printf("giving up %s %s for storage server %v after %d attempts: %s\n", cmd.Command, cmd.Body, cmd.Server, cmd.Attempts, cmd.LastError)
+	q.addDeadLetter(cmd)
+	q.record(commandLogRecord{Op: cmdAbandoned, Command: cmd})
+}
+
+// acquire - waits until no command is being sent to server
+// returns false, without waiting, if commands to server are queued
+// The caller must hold q.mtx. If true is returned, the caller sends to server until it calls release.
+func (q *commandQueue) acquire(server storageKey) bool {
+	for len(q.pending[server]) == 0 && q.running[server] {
+		q.idle.Wait()
+	}
+	if len(q.pending[server]) > 0 {
+		return false
+	}
+	q.running[server] = true
+	return true
+}
+
+// release - lets other commands be sent to server
+// The caller must hold q.mtx.
+func (q *commandQueue) release(server storageKey) {
+	delete(q.running, server)
+	q.idle.Broadcast()
+}
+
+// enqueue - queues a command behind the other queued commands of its server
+// The caller must hold q.mtx.
+func (q *commandQueue) enqueue(cmd *storageCommand) {
+	q.pending[cmd.Server] = append(q.pending[cmd.Server], cmd)
+	q.record(commandLogRecord{Op: cmdQueued, Command: cmd})
+	fmt.Printf("%s %s for storage server %v is queued\n", cmd.Command, cmd.Body, cmd.Server)
+}
+
+// submit - sends a command to a storage server, or queues it for retries
+// The command waits for a command being sent to the same server, and is queued without
+// being sent if earlier commands to the server are queued.
+// returns the response and true if the command was delivered immediately
+func (q *commandQueue) submit(server storageKey, command string, body any) ([]byte, bool) {
+	cmd, err := newCommand(server, command, body)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, false
+	}
+	q.mtx.Lock()
+	if !q.acquire(server) {
+		q.enqueue(cmd)
+		q.mtx.Unlock()
+		return nil, false
+	}
+	q.mtx.Unlock()
+
+	data, err := q.deliver(cmd)
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if err == nil {
+		q.release(server)
+		return data, true
+	}
+	cmd.Attempts = 1
+	cmd.LastError = err.Error()
+	if q.maxAttempts > 0 && cmd.Attempts >= q.maxAttempts {
+		q.abandon(cmd)
+		q.release(server)
+		return nil, false
+	}
+	cmd.next = time.Now().Add(q.delay(cmd.Attempts))
+	q.enqueue(cmd)
+	// commands waiting for this one are queued behind it now
+	q.idle.Broadcast()
+	go q.deliverQueue(server)
+	return nil, false
+}
+
+// call - sends a command to a storage server and waits for its response
+// The command is retried a few times, but never queued, because the caller decides
+// what to do if it fails. It is not sent at all if earlier commands to the server are
+// still queued, as they could undo it. A command that fails is kept as a dead letter.
+// returns the response and whether the command was delivered
+func (q *commandQueue) call(server storageKey, command string, body any) ([]byte, bool) {
+	cmd, err := newCommand(server, command, body)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, false
+	}
+	q.mtx.Lock()
+	if !q.acquire(server) {
+		fmt.Printf("%s %s is not sent, storage server %v has %d queued commands\n", cmd.Command, cmd.Body, server, len(q.pending[server]))
+		q.mtx.Unlock()
+		return nil, false
+	}
+	q.mtx.Unlock()
+
+	attempts := copyAttempts
+	if q.maxAttempts > 0 && q.maxAttempts < attempts {
+		attempts = q.maxAttempts
+	}
+	var data []byte
+	for cmd.Attempts < attempts {
+		if cmd.Attempts > 0 {
+			time.Sleep(q.delay(cmd.Attempts))
+		}
+		if data, err = q.deliver(cmd); err == nil {
+			break
+		}
+		cmd.Attempts++
+		cmd.LastError = err.Error()
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.release(server)
+	if err != nil {
+		q.abandon(cmd)
+		return nil, false
+	}
+	return data, true
+}
+
+// deliverQueue - delivers the queued commands of a storage server in order, until none is left
+// The server is running until deliverQueue returns.
+func (q *commandQueue) deliverQueue(server storageKey) {
+	for {
+		q.mtx.Lock()
+		if len(q.pending[server]) == 0 {
+			delete(q.pending, server)
+			q.release(server)
+			q.mtx.Unlock()
+			return
+		}
+		cmd := q.pending[server][0]
+		wait := time.Until(cmd.next)
+		q.mtx.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+
+		data, err := q.deliver(cmd)
+		q.mtx.Lock()
+		if err == nil {
+			q.pending[server] = q.pending[server][1:]
+			q.record(commandLogRecord{Op: cmdDelivered, ID: cmd.ID})
+			var success SuccessResponse
+			if json.Unmarshal(data, &success) != nil || !success.Success {
+				fmt.Printf("queued %s %s failed on storage server %v: %s\n", cmd.Command, cmd.Body, server, data)
+			}
+		} else {
+			cmd.Attempts++
+			cmd.LastError = err.Error()
+			if q.maxAttempts > 0 && cmd.Attempts >= q.maxAttempts {
+				q.pending[server] = q.pending[server][1:]
+				q.abandon(cmd)
+			} else {
+				cmd.next = time.Now().Add(q.delay(cmd.Attempts))
+			}
+		}
+		q.mtx.Unlock()
+	}
+}
+
+// commandResponse - a queued or abandoned command as reported to operators
+func commandResponse(cmd *storageCommand, now time.Time) QueuedCommandResponse {
+	response := QueuedCommandResponse{
+		ID:          cmd.ID,
+		StorageIP:   cmd.Server.IP,
+		ClientPort:  cmd.Server.ClientPort,
+		CommandPort: cmd.Server.CommandPort,
+		Command:     cmd.Command,
+		Body:        cmd.Body,
+		Attempts:    cmd.Attempts,
+		LastError:   cmd.LastError,
+		AgeMs:       now.Sub(time.Unix(0, cmd.Created)).Milliseconds(),
+	}
+	if !cmd.next.IsZero() && cmd.next.After(now) {
+		response.NextAttemptMs = cmd.next.Sub(now).Milliseconds()
+	}
+	return response
+}
+
+// report - the queued commands of every storage server in order of delivery, and the dead letters
+func (q *commandQueue) report() CommandQueueResponse {
+	now := time.Now()
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	response := CommandQueueResponse{
+		Pending:     make([]QueuedCommandResponse, 0),
+		DeadLetters: make([]QueuedCommandResponse, 0, len(q.deadLetters)),
+	}
+	servers := make([]storageKey, 0, len(q.pending))
+	for server := range q.pending {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].IP != servers[j].IP {
+			return servers[i].IP < servers[j].IP
+		}
+		return servers[i].ClientPort < servers[j].ClientPort
+	})
+	for _, server := range servers {
+		for _, cmd := range q.pending[server] {
+			response.Pending = append(response.Pending, commandResponse(cmd, now))
+		}
+	}
+	for _, cmd := range q.deadLetters {
+		response.DeadLetters = append(response.DeadLetters, commandResponse(cmd, now))
+	}
+	return response
+}
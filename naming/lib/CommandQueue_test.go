@@ -0,0 +1,257 @@
+package naming
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStorage - a command interface recording the commands it receives
+type fakeStorage struct {
+	server   *httptest.Server
+	mtx      sync.Mutex
+	received []string // paths of the commands, in order of arrival
+	inFlight int
+	overlaps int
+	// handle - called for every command, returns the status code
+	handle func(pth string, attempt int) int
+	tries  map[string]int
+	// files - answer to /storage_list
+	files []ListedFile
+}
+
+func newFakeStorage(t *testing.T, handle func(pth string, attempt int) int) *fakeStorage {
+	storage := &fakeStorage{handle: handle, tries: make(map[string]int)}
+	storage.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/storage_list" {
+			storage.mtx.Lock()
+			defer storage.mtx.Unlock()
+			json.NewEncoder(w).Encode(StorageListResponse{storage.files})
+			return
+		}
+		var body PathRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("cannot decode command: %s", err.Error())
+		}
+		storage.mtx.Lock()
+		storage.received = append(storage.received, body.Path)
+		storage.inFlight++
+		if storage.inFlight > 1 {
+			storage.overlaps++
+		}
+		storage.tries[body.Path]++
+		attempt := storage.tries[body.Path]
+		storage.mtx.Unlock()
+
+		status := storage.handle(body.Path, attempt)
+
+		storage.mtx.Lock()
+		storage.inFlight--
+		storage.mtx.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(`{"success":true}`))
+	}))
+	t.Cleanup(storage.server.Close)
+	return storage
+}
+
+func (f *fakeStorage) key(t *testing.T) storageKey {
+	host, port, err := net.SplitHostPort(f.server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandPort, _ := strconv.Atoi(port)
+	return storageKey{IP: host, ClientPort: commandPort, CommandPort: commandPort}
+}
+
+func (f *fakeStorage) commands() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string(nil), f.received...)
+}
+
+func testCommandQueue(t *testing.T, dir string, attempts int) *commandQueue {
+	q, err := openCommandQueue(Config{
+		DataDir:           dir,
+		CommandBackoff:    10 * time.Millisecond,
+		CommandMaxBackoff: 50 * time.Millisecond,
+		CommandAttempts:   attempts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// waitDrained - waits until no command to server is queued or being sent
+func waitDrained(t *testing.T, q *commandQueue, server storageKey) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		q.mtx.Lock()
+		drained := len(q.pending[server]) == 0 && !q.running[server]
+		q.mtx.Unlock()
+		if drained {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("queue not drained")
+}
+
+func TestCommandQueueFailedFirstDelivery(t *testing.T) {
+	release := make(chan empty)
+	storage := newFakeStorage(t, func(pth string, attempt int) int {
+		if pth == "/a" && attempt == 1 {
+			<-release
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	q := testCommandQueue(t, "", 10)
+	server := storage.key(t)
+
+	first := make(chan bool)
+	go func() {
+		_, delivered := q.submit(server, "/storage_delete", PathRequest{"/a"})
+		first <- delivered
+	}()
+	for len(storage.commands()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan bool)
+	go func() {
+		_, delivered := q.submit(server, "/storage_delete", PathRequest{"/b"})
+		second <- delivered
+	}()
+	// /b must not overtake /a while /a is in flight
+	time.Sleep(50 * time.Millisecond)
+	if received := storage.commands(); len(received) != 1 {
+		t.Fatalf("commands sent while the first is in flight: %v", received)
+	}
+	close(release)
+	if <-first {
+		t.Error("failed command reported as delivered")
+	}
+	if <-second {
+		t.Error("command queued behind a failed command reported as delivered")
+	}
+	waitDrained(t, q, server)
+
+	received := storage.commands()
+	expected := []string{"/a", "/a", "/b"}
+	if len(received) != len(expected) {
+		t.Fatalf("received %v, expected %v", received, expected)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Fatalf("received %v, expected %v", received, expected)
+		}
+	}
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	if storage.overlaps > 0 {
+		t.Errorf("%d commands sent while another was in flight", storage.overlaps)
+	}
+}
+
+func TestCommandQueueConcurrentSubmits(t *testing.T) {
+	storage := newFakeStorage(t, func(pth string, attempt int) int {
+		time.Sleep(time.Millisecond)
+		if attempt == 1 && pth[len(pth)-1] == '0' {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	q := testCommandQueue(t, "", 0)
+	server := storage.key(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q.submit(server, "/storage_delete", PathRequest{"/" + strconv.Itoa(i)})
+		}(i)
+	}
+	wg.Wait()
+	waitDrained(t, q, server)
+
+	delivered := make(map[string]bool)
+	for _, pth := range storage.commands() {
+		delivered[pth] = true
+	}
+	if len(delivered) != 50 {
+		t.Errorf("%d of 50 commands delivered", len(delivered))
+	}
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	if storage.overlaps > 0 {
+		t.Errorf("%d commands sent while another was in flight", storage.overlaps)
+	}
+}
+
+func TestCommandQueueRecovery(t *testing.T) {
+	dir := t.TempDir()
+	storage := newFakeStorage(t, func(pth string, attempt int) int {
+		return http.StatusOK
+	})
+	server := storage.key(t)
+	// nothing listens on the command port of this server
+	unreachable := storageKey{IP: "127.0.0.1", ClientPort: 1, CommandPort: 1}
+
+	q := testCommandQueue(t, dir, 2)
+	q.mtx.Lock()
+	q.enqueue(&storageCommand{ID: "delivered", Server: server, Command: "/storage_delete", Body: json.RawMessage(`{"path":"/x"}`)})
+	q.enqueue(&storageCommand{ID: "pending", Server: server, Command: "/storage_delete", Body: json.RawMessage(`{"path":"/y"}`)})
+	q.remove("delivered")
+	q.record(commandLogRecord{Op: cmdDelivered, ID: "delivered"})
+	q.mtx.Unlock()
+	q.submit(unreachable, "/storage_delete", PathRequest{"/z"})
+	waitDrained(t, q, unreachable)
+	// a torn record at the end of the log is ignored
+	q.log.Write([]byte(`{"op":"queued","comm`))
+
+	recovered := testCommandQueue(t, dir, 2)
+	if n := len(recovered.pending[server]); n != 1 || recovered.pending[server][0].ID != "pending" {
+		t.Fatalf("recovered %d commands, expected only the pending one", n)
+	}
+	if len(recovered.deadLetters) != 1 || recovered.deadLetters[0].Server != unreachable {
+		t.Fatalf("recovered %d dead letters, expected 1", len(recovered.deadLetters))
+	}
+	recovered.start()
+	waitDrained(t, recovered, server)
+	if received := storage.commands(); len(received) != 1 || received[0] != "/y" {
+		t.Errorf("received %v after recovery, expected [/y]", received)
+	}
+}
+
+func TestCommandQueueCorruptedLog(t *testing.T) {
+	queued := `{"op":"queued","command":{"id":"a","server":{"ip":"127.0.0.1","client_port":1,"command_port":1},"command":"/storage_delete","body":{"path":"/x"}}}`
+	tests := []struct {
+		name string
+		log  string
+	}{
+		{"corrupted record before the end", queued + "\n" + `{"op":"que` + "\n" + `{"op":"delivered","id":"a"}` + "\n"},
+		{"queued record without command", `{"op":"queued"}` + "\n" + queued + "\n"},
+		{"abandoned record without command", queued + "\n" + `{"op":"abandoned"}` + "\n"},
+		{"unknown op", queued + "\n" + `{"op":"sent","id":"a"}` + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, commandLogFileName), []byte(test.log), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := openCommandQueue(Config{DataDir: dir, CommandAttempts: 1}); err == nil {
+				t.Fatal("corrupted command log is loaded")
+			}
+		})
+	}
+}
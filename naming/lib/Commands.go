@@ -4,37 +4,30 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"sync"
 )
 
 // commands sent from the naming server to storage servers
+// Commands changing the files of a storage server go through s.commands, which retries
+// them if the storage server cannot be reached, see CommandQueue.go.
 
-// storageCreateCommand - create a new file on a storage server
-// Storage server is specified in file.storageServers
-func (s *NamingServer) storageCreateCommand(file *FileInfo) {
-	url := fmt.Sprintf("http://localhost:%d/storage_create", file.storageServers[0].commandPort)
-	body := bytes.NewReader([]byte(fmt.Sprintf(`{"path":"%s"}`, file.path)))
-	resp, err := http.Post(url, "application/json", body)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
+// commandSucceeded - whether the response to a command reports success
+func commandSucceeded(data []byte) bool {
 	var success SuccessResponse
-	err = json.Unmarshal(data, &success)
-	if err != nil {
+	if err := json.Unmarshal(data, &success); err != nil {
 		fmt.Println(err.Error())
-		return
+		return false
 	}
-	if !success.Success {
-		fmt.Printf("storage_create failed for file %s (storage server %v)\n", file.path, file.storageServers[0])
-		return
+	return success.Success
+}
+
+// storageCreateCommand - create a new file on a storage server
+// Storage server is specified in file.storageServers
+func (s *NamingServer) storageCreateCommand(file *FileInfo) {
+	data, delivered := s.commands.submit(file.storageServers[0].key(), "/storage_create", PathRequest{file.getPath()})
+	if delivered && !commandSucceeded(data) {
+		fmt.Printf("storage_create failed for file %s (storage server %v)\n", file.getPath(), file.storageServers[0])
 	}
 }
 
@@ -42,53 +35,94 @@ func (s *NamingServer) storageCreateCommand(file *FileInfo) {
 // This method is called asynchronously in a goroutine and use wg to synchronize with caller
 func (s *NamingServer) storageDeleteCommand(path string, storageServer *StorageServerInfo, wg *sync.WaitGroup) {
 	defer wg.Done()
-	url := fmt.Sprintf("http://localhost:%d/storage_delete", storageServer.commandPort)
-	body := bytes.NewReader([]byte(fmt.Sprintf(`{"path":"%s"}`, path)))
-	resp, err := http.Post(url, "application/json", body)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
-	var success SuccessResponse
-	err = json.Unmarshal(data, &success)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
-	if !success.Success {
+	data, delivered := s.commands.submit(storageServer.key(), "/storage_delete", PathRequest{path})
+	if delivered && !commandSucceeded(data) {
 		fmt.Printf("storage_delete failed for file %s (storage server %v)\n", path, storageServer)
-		return
 	}
 }
 
 // storageCopyCommand - send copy command to dst, asking it to copy from src
+// returns whether dst holds the file now
 func (s *NamingServer) storageCopyCommand(file *FileInfo, dst *StorageServerInfo, src *StorageServerInfo) bool {
-	url := fmt.Sprintf("http://localhost:%d/storage_copy", dst.commandPort)
-	body := bytes.NewReader([]byte(fmt.Sprintf(`{"path":"%s", "server_ip": "127.0.0.1", "server_port": %d}`, file.path, src.clientPort)))
-	resp, err := http.Post(url, "application/json", body)
-	if err != nil {
-		fmt.Println(err.Error())
+	data, delivered := s.commands.call(dst.key(), "/storage_copy", CopyRequest{file.getPath(), src.ip, src.clientPort})
+	if !delivered {
 		return false
 	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println(err.Error())
+	if !commandSucceeded(data) {
+		fmt.Printf("storeage_copy failed for file %s (dst %v, src %v)\n", file.getPath(), dst, src)
 		return false
 	}
-	var success SuccessResponse
-	err = json.Unmarshal(data, &success)
-	if err != nil {
-		fmt.Println(err.Error())
+	return true
+}
+
+// copyReplica - copies file from src to dst, without holding file.rCountMtx during the copy
+// Assumes the caller holds file.rCountMtx, which is held again when it returns. The copy
+// is only kept if dst is not a replica yet and the file has not been moved, deleted or
+// written meanwhile, otherwise it is an orphan, which reconciliation deletes.
+// returns whether dst holds a copy of the file, which the caller adds to its replicas
+func (s *NamingServer) copyReplica(file *FileInfo, dst *StorageServerInfo, src *StorageServerInfo) bool {
+	pth, version := file.getPath(), file.getVersion()
+	file.beginCommand(dst)
+	file.rCountMtx.Unlock()
+	copied := s.storageCopyCommand(file, dst, src)
+	file.rCountMtx.Lock()
+	file.endCommand(dst)
+	if !copied || file.hasReplica(dst) {
 		return false
 	}
-	if !success.Success {
-		fmt.Printf("storeage_copy failed for file %s (dst %v, src %v)\n", file.path, dst, src)
+	if current, ok := s.root.findItem(pth).(*FileInfo); !ok || current != file || file.getVersion() != version {
+		fmt.Printf("file %s changed while it was copied to storage server %v\n", pth, dst)
 		return false
 	}
 	return true
 }
+
+// deleteReplicas - deletes file from servers, which are no longer its replicas, without
+// holding file.rCountMtx while the commands are sent
+// Assumes the caller holds file.rCountMtx, which is held again when it returns. Until the
+// commands have returned, the file cannot be copied to servers.
+func (s *NamingServer) deleteReplicas(file *FileInfo, servers []*StorageServerInfo) {
+	pth := file.getPath()
+	for _, server := range servers {
+		file.beginCommand(server)
+	}
+	file.rCountMtx.Unlock()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go s.storageDeleteCommand(pth, server, &wg)
+	}
+	wg.Wait()
+	file.rCountMtx.Lock()
+	for _, server := range servers {
+		file.endCommand(server)
+	}
+}
+
+// storageRenameCommand - send rename command to storageServer, moving oldPath to newPath
+// This method is called asynchronously in a goroutine and use wg to synchronize with caller
+func (s *NamingServer) storageRenameCommand(oldPath string, newPath string, storageServer *StorageServerInfo, wg *sync.WaitGroup) {
+	defer wg.Done()
+	data, delivered := s.commands.submit(storageServer.key(), "/storage_rename", RenameRequest{oldPath, newPath})
+	if delivered && !commandSucceeded(data) {
+		fmt.Printf("storage_rename failed for %s -> %s (storage server %v)\n", oldPath, newPath, storageServer)
+	}
+}
+
+// storageListCommand - ask storageServer for every file it stores
+func (s *NamingServer) storageListCommand(storageServer *StorageServerInfo) ([]ListedFile, error) {
+	url := storageServer.commandURL("/storage_list")
+	resp, err := http.Post(url, "application/json", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("storage_list failed with status code %d (storage server %v)", resp.StatusCode, storageServer)
+	}
+	var list StorageListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
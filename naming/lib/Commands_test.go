@@ -0,0 +1,88 @@
+package naming
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestCopyReplicaUnlocked - the replicas of a file can be read and changed while a copy is
+// sent, and the copy is only kept if the file has not changed meanwhile
+func TestCopyReplicaUnlocked(t *testing.T) {
+	tests := []struct {
+		name   string
+		during func(t *testing.T, root *Directory, file *FileInfo)
+		kept   bool
+	}{
+		{"unchanged", func(t *testing.T, root *Directory, file *FileInfo) {}, true},
+		{"written", func(t *testing.T, root *Directory, file *FileInfo) {
+			file.recordWrite(5, time.Now(), func(version int64) *DFSException { return nil })
+		}, false},
+		{"moved", func(t *testing.T, root *Directory, file *FileInfo) {
+			if moved, err := root.MovePath("/f", "/g", nil, func(FSItem, string) {}); !moved || err != nil {
+				t.Fatalf("cannot move file: %v", err)
+			}
+		}, false},
+		{"deleted", func(t *testing.T, root *Directory, file *FileInfo) {
+			if _, err := root.DeletePath("/f", nil); err != nil {
+				t.Fatal(err.Msg)
+			}
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := make(chan empty, 1)
+			release := make(chan empty)
+			storage := newFakeStorage(t, func(pth string, attempt int) int {
+				started <- empty{}
+				<-release
+				return http.StatusOK
+			})
+			key := storage.key(t)
+			dst := &StorageServerInfo{ip: key.IP, clientPort: key.ClientPort, commandPort: key.CommandPort}
+			src := &StorageServerInfo{ip: "127.0.0.1", clientPort: 1, commandPort: 1}
+			s := &NamingServer{root: newTestRoot(), commands: testCommandQueue(t, "", 1)}
+			file, err := s.root.CreateFile("/f", src, nil)
+			if err != nil {
+				t.Fatal(err.Msg)
+			}
+
+			copied := make(chan bool, 1)
+			go func() {
+				file.rCountMtx.Lock()
+				defer file.rCountMtx.Unlock()
+				copied <- s.copyReplica(file, dst, src)
+			}()
+			<-started
+			replicas := make(chan []*StorageServerInfo, 1)
+			go func() {
+				replicas <- file.replicaServers()
+			}()
+			select {
+			case servers := <-replicas:
+				if len(servers) != 1 || servers[0] != src {
+					t.Fatalf("replicas %v during the copy, expected only the source", servers)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("replicas cannot be read during the copy")
+			}
+			file.rCountMtx.Lock()
+			involved := file.involves(dst)
+			file.rCountMtx.Unlock()
+			if !involved {
+				t.Fatal("the destination of the copy can receive another replica")
+			}
+
+			test.during(t, s.root, file)
+			close(release)
+			if kept := <-copied; kept != test.kept {
+				t.Fatalf("copy kept: %v, expected %v", kept, test.kept)
+			}
+			file.rCountMtx.Lock()
+			defer file.rCountMtx.Unlock()
+			if file.involves(dst) {
+				t.Fatal("the copy is still in flight after it returned")
+			}
+		})
+	}
+}
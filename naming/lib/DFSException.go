@@ -4,6 +4,11 @@ const (
 	IllegalArgumentException = "IllegalArgumentException"
 	FileNotFoundException    = "FileNotFoundException"
 	IllegalStateException    = "IllegalStateException"
+	LockOwnershipException   = "LockOwnershipException"
+	LockUnavailableException = "LockUnavailableException"
+	DeadlockException        = "DeadlockException"
+	QuotaExceededException   = "QuotaExceededException"
+	IOException              = "IOException"
 )
 
 // DFSException - exceptions sent from naming server to a client
@@ -0,0 +1,227 @@
+package naming
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// waitEdge - owner from waits for owner to, because of a lock request of waiter
+type waitEdge struct {
+	from   string
+	to     string
+	waiter *lockWaiter
+}
+
+// ancestors - strict ancestors of a clean path, from the parent up to "/"
+func ancestors(pth string) []string {
+	dirs := make([]string, 0)
+	for pth != "/" {
+		pth = path.Dir(pth)
+		dirs = append(dirs, pth)
+	}
+	return dirs
+}
+
+// waitForGraph - builds the wait-for graph between lock owners
+// Only named owners take part: anonymous clients cannot be told apart.
+// A client holding a lock, or waiting for one, also holds r-locks on the ancestors of its path.
+func (d *Directory) waitForGraph() map[string][]waitEdge {
+	sharedHolders := make(map[string]map[string]empty)
+	// owners r-locking a directory as the ancestor of a lock below it
+	ancestorHolders := make(map[string]map[string]empty)
+	exclusiveHolders := make(map[string]string)
+	add := func(holders map[string]map[string]empty, pth string, owner string) {
+		if owner == "" {
+			return
+		}
+		if _, exists := holders[pth]; !exists {
+			holders[pth] = make(map[string]empty)
+		}
+		holders[pth][owner] = empty{}
+	}
+	addAncestors := func(pth string, owner string) {
+		for _, dir := range ancestors(pth) {
+			add(sharedHolders, dir, owner)
+			add(ancestorHolders, dir, owner)
+		}
+	}
+
+	d.rLockedItemsMtx.Lock()
+	for pth, entry := range d.rLockedItems {
+		for owner := range entry.owners {
+			add(sharedHolders, pth, owner)
+			addAncestors(pth, owner)
+		}
+	}
+	d.rLockedItemsMtx.Unlock()
+	d.wLockedItemsMtx.Lock()
+	for pth, entry := range d.wLockedItems {
+		if entry.owner != "" {
+			exclusiveHolders[pth] = entry.owner
+		}
+		addAncestors(pth, entry.owner)
+	}
+	d.wLockedItemsMtx.Unlock()
+
+	d.waitersMtx.Lock()
+	waiters := make([]*lockWaiter, 0, len(d.waiters))
+	for waiter := range d.waiters {
+		waiters = append(waiters, waiter)
+	}
+	d.waitersMtx.Unlock()
+	type blockedWaiter struct {
+		waiter    *lockWaiter
+		blockedOn string
+		lock      *FIFORWMutex
+		request   *lockRequest
+	}
+	blocked := make([]blockedWaiter, 0, len(waiters))
+	owners := make(map[*lockRequest]string)
+	for _, waiter := range waiters {
+		waiter.mtx.Lock()
+		entry := blockedWaiter{waiter, waiter.blockedOn, waiter.lock, waiter.request}
+		waiter.mtx.Unlock()
+		if entry.lock == nil || waiter.owner == "" {
+			continue
+		}
+		blocked = append(blocked, entry)
+		owners[entry.request] = waiter.owner
+		addAncestors(entry.blockedOn, waiter.owner)
+	}
+
+	graph := make(map[string][]waitEdge)
+	for _, entry := range blocked {
+		from := entry.waiter.owner
+		addEdge := func(to string) {
+			graph[from] = append(graph[from], waitEdge{from, to, entry.waiter})
+		}
+		// requests queued ahead of it
+		queued := entry.lock.state().queued
+		position := -1
+		for i, request := range queued {
+			if request == entry.request {
+				position = i
+				break
+			}
+		}
+		if position < 0 {
+			// granted in the meantime
+			continue
+		}
+		exclusive := !entry.request.readonly
+		for _, request := range queued[:position] {
+			if owner, exists := owners[request]; exists && (exclusive || !request.readonly) {
+				addEdge(owner)
+			}
+		}
+		// holders of the requested lock
+		if owner, exists := exclusiveHolders[entry.blockedOn]; exists {
+			addEdge(owner)
+		}
+		if exclusive {
+			for owner := range sharedHolders[entry.blockedOn] {
+				_, below := ancestorHolders[entry.blockedOn][owner]
+				if entry.request.upgrade && owner == from && !below {
+					// the r-lock being upgraded
+					continue
+				}
+				addEdge(owner)
+			}
+		}
+	}
+	return graph
+}
+
+// findCycle - returns the edges of a cycle in the wait-for graph, or nil if there is none
+func findCycle(graph map[string][]waitEdge) []waitEdge {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make(map[string]int)
+	stack := make([]waitEdge, 0)
+	var visit func(owner string) []waitEdge
+	visit = func(owner string) []waitEdge {
+		states[owner] = visiting
+		for _, edge := range graph[owner] {
+			switch states[edge.to] {
+			case visiting:
+				// the edges on the stack since edge.to, plus edge, form a cycle
+				cycle := []waitEdge{edge}
+				for i := len(stack) - 1; i >= 0 && edge.to != owner; i-- {
+					cycle = append(cycle, stack[i])
+					if stack[i].from == edge.to {
+						break
+					}
+				}
+				return cycle
+			case unvisited:
+				stack = append(stack, edge)
+				if cycle := visit(edge.to); cycle != nil {
+					return cycle
+				}
+				stack = stack[:len(stack)-1]
+			}
+		}
+		states[owner] = visited
+		return nil
+	}
+	for owner := range graph {
+		if states[owner] == unvisited {
+			if cycle := visit(owner); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// deadlockVictims - chooses lock requests to abort so that the wait-for graph has no cycles
+// The youngest request in each cycle is chosen.
+func (d *Directory) deadlockVictims() []*lockWaiter {
+	graph := d.waitForGraph()
+	victims := make([]*lockWaiter, 0)
+	for cycle := findCycle(graph); cycle != nil; cycle = findCycle(graph) {
+		victim := cycle[0].waiter
+		for _, edge := range cycle {
+			if edge.waiter.since.After(victim.since) {
+				victim = edge.waiter
+			}
+		}
+		victims = append(victims, victim)
+		// remove every edge of the victim
+		for owner, edges := range graph {
+			kept := make([]waitEdge, 0, len(edges))
+			for _, edge := range edges {
+				if edge.waiter != victim {
+					kept = append(kept, edge)
+				}
+			}
+			graph[owner] = kept
+		}
+	}
+	return victims
+}
+
+// detectDeadlocks - periodically looks for cycles in the wait-for graph of client lock requests
+// A victim is aborted only if it is chosen in two consecutive scans, since every scan
+// sees the lock tables and queues at slightly different times.
+func (s *NamingServer) detectDeadlocks() {
+	ticker := time.NewTicker(s.config.DeadlockInterval)
+	defer ticker.Stop()
+	suspects := make(map[*lockWaiter]empty)
+	for range ticker.C {
+		nextSuspects := make(map[*lockWaiter]empty)
+		for _, victim := range s.root.deadlockVictims() {
+			if _, exists := suspects[victim]; !exists {
+				nextSuspects[victim] = empty{}
+				continue
+			}
+			fmt.Printf("aborting lock request on %s of %q to break a deadlock\n", victim.path, victim.owner)
+			victim.abortDeadlock()
+		}
+		suspects = nextSuspects
+	}
+}
@@ -0,0 +1,329 @@
+package naming
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// states of the decommissioning of a storage server
+const (
+	drainRunning   = "draining"
+	drainStalled   = "stalled"
+	drainCancelled = "cancelled"
+	drainDone      = "done"
+)
+
+// drainProgress - progress of the decommissioning of a storage server
+type drainProgress struct {
+	mtx     sync.Mutex
+	state   string
+	files   int // files held by the server when draining started, or found since
+	moved   int // files no longer held by the server
+	failed  int // files that could not be moved away in the last pass
+	started time.Time
+	ended   time.Time
+	// set when draining is cancelled, the draining goroutine stops at the next file
+	cancelled bool
+}
+
+func (p *drainProgress) response(server *StorageServerInfo) DrainResponse {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	ended := p.ended
+	if ended.IsZero() {
+		ended = time.Now()
+	}
+	return DrainResponse{
+		StorageIP:   server.ip,
+		ClientPort:  server.clientPort,
+		CommandPort: server.commandPort,
+		State:       p.state,
+		Files:       p.files,
+		Moved:       p.moved,
+		Failed:      p.failed,
+		ElapsedMs:   ended.Sub(p.started).Milliseconds(),
+	}
+}
+
+func (p *drainProgress) update(fn func(p *drainProgress)) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	fn(p)
+}
+
+// running - whether the files of the server are still being moved away
+func (p *drainProgress) running() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.state == drainRunning
+}
+
+// cancel - stops draining, unless the server is decommissioned already
+func (p *drainProgress) cancel() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.state != drainDone {
+		p.state = drainCancelled
+		p.cancelled = true
+		p.ended = time.Now()
+	}
+}
+
+// finish - records the final state of draining, unless it was cancelled
+func (p *drainProgress) finish(state string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !p.cancelled {
+		p.state = state
+		p.ended = time.Now()
+	}
+}
+
+func (p *drainProgress) isCancelled() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.cancelled
+}
+
+// decommission - starts or cancels draining a storage server
+// A draining server is not chosen for new files or replicas. Its files are copied to
+// other storage servers in the background, after which it is removed from the registry
+// and may not register again, which is journaled so that it survives restarts.
+func (s *NamingServer) decommission(body DecommissionRequest) (DrainResponse, *DFSException) {
+	key := storageKey{body.StorageIP, body.ClientPort, body.CommandPort}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if retired, exists := s.decommissioned[key]; exists {
+		if body.Cancel {
+			// the server may register again
+			if err := s.journal.commit(journalRecord{Op: opReadmit, Server: &key}); err != nil {
+				return DrainResponse{}, err
+			}
+			delete(s.decommissioned, key)
+			fmt.Printf("storage server %v may register again\n", retired)
+		}
+		return retired.drain.response(retired), nil
+	}
+	var server *StorageServerInfo
+	for _, registered := range s.storageServers {
+		if registered.is(body.StorageIP, body.ClientPort, body.CommandPort) {
+			server = registered
+			break
+		}
+	}
+	if server == nil {
+		return DrainResponse{}, &DFSException{IllegalStateException, "This storage server is not registered."}
+	}
+
+	if body.Cancel {
+		if server.draining.Swap(false) {
+			server.drain.cancel()
+			fmt.Printf("decommissioning of storage server %v is cancelled\n", server)
+		}
+	} else if server.drain == nil || !server.drain.running() {
+		// start draining, or retry a stalled or cancelled drain
+		server.draining.Store(true)
+		server.drain = &drainProgress{state: drainRunning, started: time.Now()}
+		fmt.Printf("decommissioning storage server %v\n", server)
+		go s.drainStorageServer(server, server.drain)
+	}
+	if server.drain == nil {
+		return DrainResponse{}, &DFSException{IllegalStateException, "This storage server is not being decommissioned."}
+	}
+	return server.drain.response(server), nil
+}
+
+// filesHeldBy - returns the paths of the files of which server holds a replica
+func (s *NamingServer) filesHeldBy(server *StorageServerInfo) []string {
+	held := make([]string, 0)
+	s.root.forEachFileLocked(func(file *FileInfo) {
+		for _, replica := range file.replicaServers() {
+			if replica == server {
+				held = append(held, file.getPath())
+				break
+			}
+		}
+	})
+	return held
+}
+
+// drainStorageServer - moves every file away from a draining storage server, then retires it
+// Every pass handles the files held by the server at its start. Draining stalls if a
+// pass moves nothing, e.g. because there is no other healthy storage server.
+func (s *NamingServer) drainStorageServer(server *StorageServerInfo, progress *drainProgress) {
+	first := true
+	for {
+		held := s.filesHeldBy(server)
+		if len(held) == 0 {
+			break
+		}
+		progress.update(func(p *drainProgress) {
+			if first {
+				p.files = len(held)
+			} else if p.moved+len(held) > p.files {
+				// placed on the server before it started draining, but registered since
+				p.files = p.moved + len(held)
+			}
+			p.failed = 0
+		})
+		first = false
+
+		moved := 0
+		for _, pth := range held {
+			if progress.isCancelled() {
+				return
+			}
+			if server.state.Load() == serverDead {
+				// removed by failure detection, its files are repaired instead
+				progress.finish(drainCancelled)
+				return
+			}
+			if s.moveReplicaAway(pth, server) {
+				moved++
+				progress.update(func(p *drainProgress) {
+					p.moved++
+				})
+			} else {
+				progress.update(func(p *drainProgress) {
+					p.failed++
+				})
+			}
+		}
+		if moved == 0 {
+			fmt.Printf("decommissioning of storage server %v stalled, %d files cannot be moved\n", server, len(held))
+			progress.finish(drainStalled)
+			return
+		}
+	}
+
+	// nothing depends on the server anymore
+	s.lock.Lock()
+	if progress.isCancelled() {
+		s.lock.Unlock()
+		return
+	}
+	key := server.key()
+	if err := s.journal.Append(journalRecord{Op: opDecommission, Server: &key}); err != nil {
+		// the server stays registered, sending the command again retries
+		fmt.Printf("cannot decommission storage server %v: %s\n", server, err.Error())
+		progress.finish(drainStalled)
+		s.lock.Unlock()
+		return
+	}
+	kept := make([]*StorageServerInfo, 0, len(s.storageServers))
+	for _, registered := range s.storageServers {
+		if registered != server {
+			kept = append(kept, registered)
+		}
+	}
+	s.storageServers = kept
+	s.decommissioned[server.key()] = server
+	server.state.Store(serverDead)
+	progress.finish(drainDone)
+	s.lock.Unlock()
+	fmt.Printf("storage server %v is decommissioned\n", server)
+}
+
+// moveReplicaAway - copies a file to other storage servers until it has enough replicas
+// without server, then removes server from its replicas
+// The file keeps its target replica count, or as many replicas as there are healthy
+// storage servers. It is r-locked during copying, so no client can modify it concurrently.
+// returns whether server no longer holds the file
+func (s *NamingServer) moveReplicaAway(pth string, server *StorageServerInfo) bool {
+	file := s.root.lockFile(pth)
+	if file == nil {
+		// deleted in the meantime
+		return true
+	}
+	defer s.root.unlockFile(file)
+	file.rCountMtx.Lock()
+	defer file.rCountMtx.Unlock()
+
+	others := make([]*StorageServerInfo, 0, len(file.storageServers))
+	for _, replica := range file.storageServers {
+		if replica != server {
+			others = append(others, replica)
+		}
+	}
+	if len(others) == len(file.storageServers) {
+		// removed in the meantime
+		return true
+	}
+	target := file.targetReplicas(s.config.DefaultReplicas)
+	if target < 1 {
+		target = 1
+	}
+	candidates := make([]*StorageServerInfo, 0)
+	for _, storageServer := range s.aliveStorageServers() {
+		if !file.involves(storageServer) {
+			candidates = append(candidates, storageServer)
+		}
+	}
+	// copy from the draining server, unless it is suspected
+	src := server
+	if server.state.Load() != serverAlive {
+		for _, replica := range others {
+			if replica.state.Load() == serverAlive {
+				src = replica
+				break
+			}
+		}
+	}
+
+	// file.rCountMtx is released during each copy
+	copies := make([]*StorageServerInfo, 0)
+	for len(others)+len(copies) < target && len(candidates) > 0 {
+		dst := s.placeReplica(append(others[:len(others):len(others)], copies...), candidates)
+		for idx, candidate := range candidates {
+			if candidate == dst {
+				candidates = append(candidates[:idx], candidates[idx+1:]...)
+				break
+			}
+		}
+		if file.involves(dst) {
+			// replicated while an earlier copy was sent
+			continue
+		}
+		if s.copyReplica(file, dst, src) {
+			copies = append(copies, dst)
+		}
+	}
+
+	// the replicas may have changed during the copies: the copies and the removal of
+	// server are journaled together, so that a replay never removes server without the
+	// copies replacing it
+	kept := make([]*StorageServerInfo, 0, len(file.storageServers)+len(copies))
+	for _, replica := range file.storageServers {
+		if replica != server {
+			kept = append(kept, replica)
+		}
+	}
+	removed := len(kept) < len(file.storageServers)
+	records := make([]journalRecord, 0)
+	for _, dst := range copies {
+		if !file.hasReplica(dst) {
+			key := dst.key()
+			records = append(records, journalRecord{Op: opAddReplica, Path: file.getPath(), Server: &key})
+			kept = append(kept, dst)
+		}
+	}
+	if removed && len(kept) == 0 {
+		// server still holds the only replica
+		return false
+	}
+	if len(kept) < target {
+		fmt.Printf("file %s has %d of %d replicas, not enough healthy storage servers\n", file.getPath(), len(kept), target)
+	}
+	if removed {
+		key := server.key()
+		records = append(records, journalRecord{Op: opRemoveReplica, Path: file.getPath(), Server: &key})
+	}
+	if err := s.journal.Append(records...); err != nil {
+		// the copies are orphans, which reconciliation deletes
+		fmt.Printf("cannot move replica of %s: %s\n", file.getPath(), err.Error())
+		return false
+	}
+	file.storageServers = kept
+	return true
+}
@@ -0,0 +1,239 @@
+package naming
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testNamingServer - a naming server keeping its journal in dir, without background loops
+func testNamingServer(t *testing.T, dir string) *NamingServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s, err := NewNamingServer(0, 0, Config{
+		DataDir:           dir,
+		DefaultReplicas:   1,
+		CommandBackoff:    10 * time.Millisecond,
+		CommandMaxBackoff: 50 * time.Millisecond,
+		CommandAttempts:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.journal.file.Close()
+		s.commands.log.Close()
+	})
+	return s
+}
+
+// registerFake - registers storage as a storage server holding files
+func registerFake(t *testing.T, s *NamingServer, storage *fakeStorage, files ...string) *StorageServerInfo {
+	t.Helper()
+	return registerFakeWith(t, s, storage, RegisterRequest{Files: files})
+}
+
+// registerFakeWith - registers storage as a storage server, with the files and capacity of body
+func registerFakeWith(t *testing.T, s *NamingServer, storage *fakeStorage, body RegisterRequest) *StorageServerInfo {
+	t.Helper()
+	key := storage.key(t)
+	body.StorageIP, body.ClientPort, body.CommandPort = key.IP, key.ClientPort, key.CommandPort
+	status, response := s.registerStorageHandler(body)
+	if status != http.StatusOK {
+		t.Fatalf("cannot register storage server: %v", response)
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, server := range s.storageServers {
+		if server.key() == key {
+			return server
+		}
+	}
+	t.Fatal("registered storage server not found")
+	return nil
+}
+
+// waitDrain - waits until draining server is no longer running
+func waitDrain(t *testing.T, s *NamingServer, server *StorageServerInfo) DrainResponse {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.lock.RLock()
+		progress := server.drain
+		s.lock.RUnlock()
+		if !progress.running() {
+			return progress.response(server)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("draining does not end")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// replicasOf - the replicas of the file at pth
+func replicasOf(t *testing.T, s *NamingServer, pth string) []*StorageServerInfo {
+	t.Helper()
+	file, ok := s.root.findItem(pth).(*FileInfo)
+	if !ok {
+		t.Fatalf("file %s does not exist", pth)
+	}
+	return file.replicaServers()
+}
+
+func decommissionRequest(server *StorageServerInfo, cancel bool) DecommissionRequest {
+	return DecommissionRequest{server.ip, server.clientPort, server.commandPort, cancel}
+}
+
+func TestDecommission(t *testing.T) {
+	ok := func(pth string, attempt int) int { return http.StatusOK }
+	tests := []struct {
+		name       string
+		others     int // other storage servers
+		state      string
+		moved      int
+		registered int // storage servers registered after draining
+	}{
+		{"files are moved to other servers", 2, drainDone, 3, 2},
+		{"stalls without other servers", 0, drainStalled, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testNamingServer(t, t.TempDir())
+			draining := registerFake(t, s, newFakeStorage(t, ok), "/a", "/d/b", "/d/c")
+			for i := 0; i < test.others; i++ {
+				registerFake(t, s, newFakeStorage(t, ok))
+			}
+			if _, err := s.decommission(decommissionRequest(draining, false)); err != nil {
+				t.Fatal(err.Msg)
+			}
+			progress := waitDrain(t, s, draining)
+			if progress.State != test.state || progress.Files != 3 || progress.Moved != test.moved {
+				t.Fatalf("unexpected progress %+v", progress)
+			}
+			for _, pth := range []string{"/a", "/d/b", "/d/c"} {
+				replicas := replicasOf(t, s, pth)
+				held := false
+				for _, replica := range replicas {
+					held = held || replica == draining
+				}
+				if len(replicas) != 1 || held != (test.state != drainDone) {
+					t.Fatalf("file %s has replicas %v after draining", pth, replicas)
+				}
+			}
+			s.lock.RLock()
+			_, retired := s.decommissioned[draining.key()]
+			registered := len(s.storageServers)
+			s.lock.RUnlock()
+			if retired != (test.state == drainDone) || registered != test.registered {
+				t.Fatalf("decommissioned %v, %d registered storage servers", retired, registered)
+			}
+		})
+	}
+}
+
+func TestDecommissionCancel(t *testing.T) {
+	started := make(chan empty, 1)
+	release := make(chan empty)
+	s := testNamingServer(t, t.TempDir())
+	draining := registerFake(t, s, newFakeStorage(t, func(pth string, attempt int) int { return http.StatusOK }), "/a", "/b")
+	registerFake(t, s, newFakeStorage(t, func(pth string, attempt int) int {
+		started <- empty{}
+		<-release
+		return http.StatusOK
+	}))
+	if _, err := s.decommission(decommissionRequest(draining, false)); err != nil {
+		t.Fatal(err.Msg)
+	}
+	<-started
+	if progress, err := s.decommission(decommissionRequest(draining, true)); err != nil || progress.State != drainCancelled {
+		t.Fatalf("cancel: %+v, %v", progress, err)
+	}
+	close(release)
+	// the file being copied is moved, the next one is not
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.filesHeldBy(draining)) == 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the file being copied is not moved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if held := s.filesHeldBy(draining); len(held) != 1 {
+		t.Fatalf("the storage server holds %v after cancelling", held)
+	}
+	if response := draining.drain.response(draining); response.State != drainCancelled {
+		t.Fatalf("unexpected progress %+v", response)
+	}
+}
+
+// TestDecommissionRestart - decommissioned storage servers and the moved replicas are
+// recovered from the journal, and a readmitted server may register again after a restart
+func TestDecommissionRestart(t *testing.T) {
+	dir := t.TempDir()
+	ok := func(pth string, attempt int) int { return http.StatusOK }
+	drainedStorage, otherStorage := newFakeStorage(t, ok), newFakeStorage(t, ok)
+	s := testNamingServer(t, dir)
+	draining := registerFake(t, s, drainedStorage, "/a", "/d/b")
+	other := registerFake(t, s, otherStorage)
+	if _, err := s.decommission(decommissionRequest(draining, false)); err != nil {
+		t.Fatal(err.Msg)
+	}
+	if progress := waitDrain(t, s, draining); progress.State != drainDone {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+	s.journal.file.Close()
+	s.commands.log.Close()
+
+	restarted := testNamingServer(t, dir)
+	retired, exists := restarted.decommissioned[draining.key()]
+	if !exists || retired.drain.response(retired).State != drainDone {
+		t.Fatal("the decommissioned storage server is not restored")
+	}
+	for _, pth := range []string{"/a", "/d/b"} {
+		replicas := replicasOf(t, restarted, pth)
+		if len(replicas) != 1 || replicas[0].key() != other.key() {
+			t.Fatalf("file %s is restored on %v", pth, replicas)
+		}
+	}
+	key := drainedStorage.key(t)
+	register := RegisterRequest{StorageIP: key.IP, ClientPort: key.ClientPort, CommandPort: key.CommandPort}
+	if status, _ := restarted.registerStorageHandler(register); status != http.StatusGone {
+		t.Fatalf("decommissioned storage server registers with status %d", status)
+	}
+
+	// readmitting survives another restart
+	if _, err := restarted.decommission(decommissionRequest(draining, true)); err != nil {
+		t.Fatal(err.Msg)
+	}
+	restarted.journal.file.Close()
+	restarted.commands.log.Close()
+	readmitted := testNamingServer(t, dir)
+	if len(readmitted.decommissioned) != 0 {
+		t.Fatalf("%d decommissioned storage servers after readmitting", len(readmitted.decommissioned))
+	}
+	if status, response := readmitted.registerStorageHandler(register); status != http.StatusOK {
+		t.Fatalf("readmitted storage server cannot register: %v", response)
+	}
+	if files := strings.Join(replicaPaths(readmitted, other), " "); files != "/a /d/b" {
+		t.Fatalf("files %q on the other storage server", files)
+	}
+}
+
+// replicaPaths - the sorted paths of the files held by a storage server with the key of server
+func replicaPaths(s *NamingServer, server *StorageServerInfo) []string {
+	paths := make([]string, 0)
+	s.root.forEachFileLocked(func(file *FileInfo) {
+		for _, replica := range file.replicaServers() {
+			if replica.key() == server.key() {
+				paths = append(paths, file.getPath())
+			}
+		}
+	})
+	sort.Strings(paths)
+	return paths
+}
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"math/rand"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // pathToNames - decompose a path to a series of directory or file names
@@ -22,76 +25,592 @@ func pathToNames(pth string) []string {
 	return strings.Split(pth, "/")
 }
 
+// commitFunc - journals a validated mutation that is about to be applied at time now
+// The mutation is abandoned if it returns an error. A nil commitFunc journals nothing.
+type commitFunc func(now time.Time) *DFSException
+
+func (commit commitFunc) run(now time.Time) *DFSException {
+	if commit == nil {
+		return nil
+	}
+	return commit(now)
+}
+
 // FSItem - Either a *Directory or a *FileInfo
 // Designed to make accessing lock tables easier
 type FSItem interface {
 	GetParentDir() *Directory
 	GetLock() *FIFORWMutex
+	DiskUsage() (bytes int64, files int64, dirs int64)
 }
 
 // RLockedItem - One entry in the r-lock table
 type RLockedItem struct {
 	item  FSItem
 	count int
+	// r-locks held by each owner, "" for anonymous clients
+	owners map[string]*lockHolder
+}
+
+// lockHolder - r-locks of one path held by one owner
+type lockHolder struct {
+	count int
+	since time.Time // time of the first r-lock that is still held
+	// the pending upgrade of the r-lock, nil if there is none
+	upgrade *pendingUpgrade
+}
+
+// pendingUpgrade - an upgrade of a r-lock that has not been granted or refused yet
+// The r-lock cannot be released while it waits: the upgrade counts on its reader slot.
+type pendingUpgrade struct {
+	waiter *lockWaiter
+	done   chan struct{} // closed once the upgrade is granted or refused
+}
+
+// WLockedItem - One entry in the w-lock table
+type WLockedItem struct {
+	item  FSItem
+	owner string // "" for anonymous clients
+	since time.Time
+}
+
+// lockWaiter - a client lock request waiting in LockFileOrDirectory
+type lockWaiter struct {
+	path     string
+	readonly bool
+	owner    string
+	since    time.Time
+	// the lock currently requested, along the path or of the path itself
+	blockedOn string
+	lock      *FIFORWMutex
+	request   *lockRequest
+	// closed when the request is aborted, to break a deadlock or because
+	// the r-lock it upgrades is released
+	victim     chan struct{}
+	deadlocked bool
+	released   bool
+	mtx        sync.Mutex
+}
+
+// blockOn - records the path whose lock the waiter requests next
+// it does nothing for a nil waiter
+func (w *lockWaiter) blockOn(pth string) {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	w.blockedOn = pth
+	w.mtx.Unlock()
+}
+
+// aborted - returns a channel closed when the request is aborted
+// it returns nil for a nil waiter
+func (w *lockWaiter) aborted() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.victim
+}
+
+// abortDeadlock - aborts the request to break a deadlock
+func (w *lockWaiter) abortDeadlock() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if !w.deadlocked && !w.released {
+		w.deadlocked = true
+		close(w.victim)
+	}
+}
+
+// abortRelease - aborts an upgrade because the r-lock it upgrades is being released
+func (w *lockWaiter) abortRelease() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if !w.deadlocked && !w.released {
+		w.released = true
+		close(w.victim)
+	}
+}
+
+// unavailable - the error returned when the request gives up
+func (w *lockWaiter) unavailable() *DFSException {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.deadlocked {
+		return &DFSException{DeadlockException, fmt.Sprintf("the lock request on path %s is aborted to break a deadlock.", w.path)}
+	}
+	if w.released {
+		return &DFSException{LockUnavailableException, fmt.Sprintf("the upgrade of path %s is aborted, as its r-lock is released.", w.path)}
+	}
+	return &DFSException{LockUnavailableException, fmt.Sprintf("the lock of path %s is not available.", w.path)}
+}
+
+// queue - records the request the waiter has queued on lock
+// it does nothing for a nil waiter
+func (w *lockWaiter) queue(lock *FIFORWMutex, request *lockRequest) {
+	if w == nil {
+		return
+	}
+	w.mtx.Lock()
+	w.lock = lock
+	w.request = request
+	w.mtx.Unlock()
 }
 
 // Directory - represents a directory in the DFS
 // The root Directory is responsible for keeping track of all files and directories
 // in the file system, and managing their locks.
 type Directory struct {
-	name           string
-	parent         *Directory
-	subDirectories []*Directory
-	subFiles       []*FileInfo
-	lock           *FIFORWMutex
+	// moving the directory changes name and parent, any access must acquire placeMtx,
+	// as they are read without path locks on behalf of storage servers and admins
+	name     string
+	parent   *Directory
+	placeMtx sync.RWMutex
+	// entries indexed by name, allocated when the first one is added
+	// any access must acquire entriesMtx, as lookups made on behalf of storage servers
+	// and admins are not covered by client locks
+	subDirectories map[string]*Directory
+	subFiles       map[string]*FileInfo
+	entriesMtx     sync.RWMutex
+	lock           FIFORWMutex
+	// target replica count of files below, 0 means inherited from the parent
+	replicas atomic.Int32
+	// metadata
+	ctime time.Time
+	mtime atomic.Int64 // unix nanoseconds of the last change of the entries
+	// totals of the files and directories below, updated as the file system changes
+	bytes atomic.Int64
+	files atomic.Int64
+	dirs  atomic.Int64
+	// quotas on the totals, 0 means unlimited
+	maxBytes   atomic.Int64
+	maxEntries atomic.Int64
+	// held from a quota check to the change it allows, see reserveQuota
+	quotaMtx sync.Mutex
 	// list of r-locked files or directories
 	rLockedItems    map[string]*RLockedItem
 	rLockedItemsMtx sync.Mutex
 	// list of w-locked files or directories
-	wLockedItems    map[string]FSItem
+	wLockedItems    map[string]*WLockedItem
 	wLockedItemsMtx sync.Mutex
+	// client lock requests that have not been granted yet
+	waiters    map[*lockWaiter]empty
+	waitersMtx sync.Mutex
+}
+
+// newDirectory - creates an empty directory
+func newDirectory(name string, parent *Directory, ctime time.Time) *Directory {
+	dir := &Directory{
+		name:   name,
+		parent: parent,
+		ctime:  ctime,
+	}
+	dir.mtime.Store(ctime.UnixNano())
+	return dir
+}
+
+// touch - updates the modification time of the directory
+func (d *Directory) touch(mtime time.Time) {
+	d.mtime.Store(mtime.UnixNano())
+}
+
+// entry - returns the file or directory called name in d, or nil if there is none
+func (d *Directory) entry(name string) FSItem {
+	d.entriesMtx.RLock()
+	defer d.entriesMtx.RUnlock()
+	if dir, exists := d.subDirectories[name]; exists {
+		return dir
+	}
+	if file, exists := d.subFiles[name]; exists {
+		return file
+	}
+	return nil
+}
+
+// subDirectory - returns the directory called name in d
+func (d *Directory) subDirectory(name string) (*Directory, bool) {
+	d.entriesMtx.RLock()
+	defer d.entriesMtx.RUnlock()
+	dir, exists := d.subDirectories[name]
+	return dir, exists
+}
+
+// subFile - returns the file called name in d
+func (d *Directory) subFile(name string) (*FileInfo, bool) {
+	d.entriesMtx.RLock()
+	defer d.entriesMtx.RUnlock()
+	file, exists := d.subFiles[name]
+	return file, exists
+}
+
+// children - returns the directories and the files in d
+func (d *Directory) children() ([]*Directory, []*FileInfo) {
+	d.entriesMtx.RLock()
+	defer d.entriesMtx.RUnlock()
+	dirs := make([]*Directory, 0, len(d.subDirectories))
+	for _, dir := range d.subDirectories {
+		dirs = append(dirs, dir)
+	}
+	files := make([]*FileInfo, 0, len(d.subFiles))
+	for _, file := range d.subFiles {
+		files = append(files, file)
+	}
+	return dirs, files
+}
+
+// nameOf - returns the name of a file or directory
+func nameOf(item FSItem) string {
+	if dir, ok := item.(*Directory); ok {
+		return dir.getName()
+	}
+	return item.(*FileInfo).getName()
+}
+
+// addSubDirectory - links dir as an entry of d
+func (d *Directory) addSubDirectory(dir *Directory) {
+	d.entriesMtx.Lock()
+	if d.subDirectories == nil {
+		d.subDirectories = make(map[string]*Directory)
+	}
+	d.subDirectories[dir.getName()] = dir
+	d.entriesMtx.Unlock()
+	bytes, files, dirs := dir.DiskUsage()
+	d.addUsage(bytes, files, dirs)
+}
+
+// addSubFile - links file as an entry of d
+func (d *Directory) addSubFile(file *FileInfo) {
+	d.entriesMtx.Lock()
+	if d.subFiles == nil {
+		d.subFiles = make(map[string]*FileInfo)
+	}
+	d.subFiles[file.getName()] = file
+	d.entriesMtx.Unlock()
+	bytes, files, dirs := file.DiskUsage()
+	d.addUsage(bytes, files, dirs)
+}
+
+// removeEntry - unlinks the file or directory called name from d
+func (d *Directory) removeEntry(name string) {
+	item := d.entry(name)
+	if item == nil {
+		return
+	}
+	d.entriesMtx.Lock()
+	delete(d.subDirectories, name)
+	delete(d.subFiles, name)
+	d.entriesMtx.Unlock()
+	bytes, files, dirs := item.DiskUsage()
+	d.addUsage(-bytes, -files, -dirs)
+}
+
+// addUsage - adds to the totals of d and of every directory above it
+func (d *Directory) addUsage(bytes int64, files int64, dirs int64) {
+	for dir := d; dir != nil; dir = dir.GetParentDir() {
+		dir.bytes.Add(bytes)
+		dir.files.Add(files)
+		dir.dirs.Add(dirs)
+	}
+}
+
+// DiskUsage - implements FSItem interface
+// returns the total size and the numbers of files and directories
+// of d and everything below it, in constant time
+func (d *Directory) DiskUsage() (bytes int64, files int64, dirs int64) {
+	return d.bytes.Load(), d.files.Load(), d.dirs.Load() + 1
+}
+
+// sortedEntries - returns the names of the files and directories in d, sorted
+func (d *Directory) sortedEntries() []string {
+	d.entriesMtx.RLock()
+	defer d.entriesMtx.RUnlock()
+	names := make([]string, 0, len(d.subFiles)+len(d.subDirectories))
+	for name := range d.subFiles {
+		names = append(names, name)
+	}
+	for name := range d.subDirectories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // GetParentDir - implements FSItem interface
 func (d *Directory) GetParentDir() *Directory {
+	d.placeMtx.RLock()
+	defer d.placeMtx.RUnlock()
 	return d.parent
 }
 
+// getName - returns the name of the directory in its parent
+func (d *Directory) getName() string {
+	d.placeMtx.RLock()
+	defer d.placeMtx.RUnlock()
+	return d.name
+}
+
+// place - records the new name and parent of the directory after it is moved
+func (d *Directory) place(name string, parent *Directory) {
+	d.placeMtx.Lock()
+	d.name = name
+	d.parent = parent
+	d.placeMtx.Unlock()
+}
+
 // GetLock - implements FSItem interface
 func (d *Directory) GetLock() *FIFORWMutex {
-	return d.lock
+	return &d.lock
 }
 
 // FileInfo - represents a file in one or multiple storage servers
 type FileInfo struct {
-	name   string
-	path   string
-	parent *Directory
-	lock   *FIFORWMutex
+	// moving the file changes name, path and parent, any access must acquire placeMtx
+	name     string
+	path     string
+	parent   *Directory
+	placeMtx sync.RWMutex
+	lock     FIFORWMutex
+	// target replica count, 0 means inherited from the parent directory
+	replicas atomic.Int32
+	// metadata, updated by write notifications of storage servers
+	// any access to size, mtime and version must acquire metaMtx
+	ctime   time.Time
+	size    int64
+	mtime   time.Time
+	version int64
+	metaMtx sync.Mutex
 	// fields used for replication
 	// any access to these fields must acquire rCountMtx
 	rCount         int
 	rCountMtx      sync.Mutex
 	storageServers []*StorageServerInfo
+	// storage servers the file is being copied to or deleted from, while rCountMtx
+	// is released for the command
+	inFlight []*StorageServerInfo
+}
+
+// newFileInfo - creates an empty file that is not stored on any storage server yet
+func newFileInfo(name string, pth string, parent *Directory, ctime time.Time) *FileInfo {
+	return &FileInfo{
+		name:   name,
+		path:   path.Clean(pth),
+		parent: parent,
+		ctime:  ctime,
+		mtime:  ctime,
+	}
+}
+
+// recordWrite - updates the metadata after the file has been written
+// commit is called with the new version before the metadata is updated
+// returns the new version of the file
+func (f *FileInfo) recordWrite(size int64, mtime time.Time, commit func(version int64) *DFSException) (int64, *DFSException) {
+	f.metaMtx.Lock()
+	version := f.version + 1
+	if err := commit(version); err != nil {
+		f.metaMtx.Unlock()
+		return 0, err
+	}
+	delta := size - f.size
+	f.size = size
+	f.mtime = mtime
+	f.version = version
+	f.metaMtx.Unlock()
+	f.GetParentDir().addUsage(delta, 0, 0)
+	return version, nil
+}
+
+// correctSize - sets the size of the file without changing its version or modification
+// time, unless it has been written since version
+// commit is called with the modification time before the size is set
+// returns the previous size, and whether the size has been set
+func (f *FileInfo) correctSize(size int64, version int64, commit func(mtime time.Time) *DFSException) (int64, bool, *DFSException) {
+	f.metaMtx.Lock()
+	previous := f.size
+	if f.version != version || previous == size {
+		f.metaMtx.Unlock()
+		return previous, false, nil
+	}
+	if err := commit(f.mtime); err != nil {
+		f.metaMtx.Unlock()
+		return previous, false, err
+	}
+	f.size = size
+	f.metaMtx.Unlock()
+	f.GetParentDir().addUsage(size-previous, 0, 0)
+	return previous, true, nil
+}
+
+// getVersion - returns the number of writes of the file
+func (f *FileInfo) getVersion() int64 {
+	f.metaMtx.Lock()
+	defer f.metaMtx.Unlock()
+	return f.version
+}
+
+// DiskUsage - implements FSItem
+// returns the size of the file, and counts it as one file
+func (f *FileInfo) DiskUsage() (bytes int64, files int64, dirs int64) {
+	f.metaMtx.Lock()
+	defer f.metaMtx.Unlock()
+	return f.size, 1, 0
 }
 
 // GetParentDir - implements FSItem
 func (f *FileInfo) GetParentDir() *Directory {
+	f.placeMtx.RLock()
+	defer f.placeMtx.RUnlock()
 	return f.parent
 }
 
+// getName - returns the name of the file in its parent directory
+func (f *FileInfo) getName() string {
+	f.placeMtx.RLock()
+	defer f.placeMtx.RUnlock()
+	return f.name
+}
+
+// getPath - returns the absolute path of the file
+func (f *FileInfo) getPath() string {
+	f.placeMtx.RLock()
+	defer f.placeMtx.RUnlock()
+	return f.path
+}
+
+// place - records the new name, parent and path of the file after it is moved
+func (f *FileInfo) place(name string, parent *Directory, pth string) {
+	f.placeMtx.Lock()
+	f.name = name
+	f.parent = parent
+	f.path = pth
+	f.placeMtx.Unlock()
+}
+
+// setPath - records the new path of the file after a directory above it is moved
+func (f *FileInfo) setPath(pth string) {
+	f.placeMtx.Lock()
+	f.path = pth
+	f.placeMtx.Unlock()
+}
+
 // GetLock - implements FSItem
 func (f *FileInfo) GetLock() *FIFORWMutex {
-	return f.lock
+	return &f.lock
+}
+
+// claimReplica - accepts storageServer as a replica of the file if it is already
+// known to hold one, or if no other storage server holds the file anymore
+func (f *FileInfo) claimReplica(storageServer *StorageServerInfo) bool {
+	f.rCountMtx.Lock()
+	defer f.rCountMtx.Unlock()
+	if len(f.storageServers) == 0 {
+		f.storageServers = append(f.storageServers, storageServer)
+		return true
+	}
+	for _, server := range f.storageServers {
+		if server == storageServer {
+			return true
+		}
+	}
+	return false
+}
+
+// hasReplica - whether storageServer holds a replica of the file
+// Assumes the caller holds f.rCountMtx
+func (f *FileInfo) hasReplica(storageServer *StorageServerInfo) bool {
+	for _, server := range f.storageServers {
+		if server == storageServer {
+			return true
+		}
+	}
+	return false
+}
+
+// involves - whether storageServer holds a replica of the file, or the file is being
+// copied to it or deleted from it, so that it cannot receive a new replica
+// Assumes the caller holds f.rCountMtx
+func (f *FileInfo) involves(storageServer *StorageServerInfo) bool {
+	if f.hasReplica(storageServer) {
+		return true
+	}
+	for _, server := range f.inFlight {
+		if server == storageServer {
+			return true
+		}
+	}
+	return false
+}
+
+// beginCommand - records that the file is being copied to storageServer or deleted from it
+// Assumes the caller holds f.rCountMtx
+func (f *FileInfo) beginCommand(storageServer *StorageServerInfo) {
+	f.inFlight = append(f.inFlight, storageServer)
+}
+
+// endCommand - records that a command started by beginCommand has returned
+// Assumes the caller holds f.rCountMtx
+func (f *FileInfo) endCommand(storageServer *StorageServerInfo) {
+	for i, server := range f.inFlight {
+		if server == storageServer {
+			f.inFlight = append(f.inFlight[:i], f.inFlight[i+1:]...)
+			return
+		}
+	}
+}
+
+// targetReplicas - the number of replicas the file should have
+// It is the nearest target set on the file or its ancestors, or defaultTarget
+func (f *FileInfo) targetReplicas(defaultTarget int) int {
+	if target := f.replicas.Load(); target > 0 {
+		return int(target)
+	}
+	for dir := f.GetParentDir(); dir != nil; dir = dir.GetParentDir() {
+		if target := dir.replicas.Load(); target > 0 {
+			return int(target)
+		}
+	}
+	return defaultTarget
+}
+
+// replicaCount - the number of storage servers holding the file
+func (f *FileInfo) replicaCount() int {
+	f.rCountMtx.Lock()
+	defer f.rCountMtx.Unlock()
+	return len(f.storageServers)
+}
+
+// replicaServers - returns a copy of the storage servers holding the file
+func (f *FileInfo) replicaServers() []*StorageServerInfo {
+	f.rCountMtx.Lock()
+	defer f.rCountMtx.Unlock()
+	servers := make([]*StorageServerInfo, len(f.storageServers))
+	copy(servers, f.storageServers)
+	return servers
+}
+
+// removeReplica - removes storageServer from the replicas of the file
+// returns whether storageServer held a replica
+func (f *FileInfo) removeReplica(storageServer *StorageServerInfo) bool {
+	f.rCountMtx.Lock()
+	defer f.rCountMtx.Unlock()
+	for i, server := range f.storageServers {
+		if server == storageServer {
+			f.storageServers = append(f.storageServers[:i], f.storageServers[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 // GetPath - return the absolute path of a directory
 func (d *Directory) GetPath() string {
+	if d.GetParentDir() == nil {
+		return "/"
+	}
 	names := make([]string, 0)
 	curr := d
 	for curr != nil {
-		names = append(names, curr.name)
-		curr = curr.parent
+		names = append(names, curr.getName())
+		curr = curr.GetParentDir()
 	}
 	i := 0
 	j := len(names) - 1
@@ -115,18 +634,12 @@ func (d *Directory) walkPath(names []string) *Directory {
 	}
 	curr := d
 	for _, name := range names[1:] {
-		found := false
-		for _, dir := range curr.subDirectories {
-			if dir.name == name {
-				found = true
-				curr = dir
-				break
-			}
-		}
+		next, found := curr.subDirectory(name)
 		if !found {
 			// cannot find a directory in the path
 			return nil
 		}
+		curr = next
 	}
 	return curr
 }
@@ -135,31 +648,40 @@ func (d *Directory) walkPath(names []string) *Directory {
 // if it succeeds, returns the last directory along the path
 // if it fails, release every lock it has acquired and returns nil
 func (d *Directory) lockPath(names []string) *Directory {
+	dir, _ := d.tryLockPath(names, lockOptions{})
+	return dir
+}
+
+// tryLockPath - like lockPath, but every lock request gives up as specified in opts
+// the second return value is false if a lock cannot be granted in time
+func (d *Directory) tryLockPath(names []string, opts lockOptions) (*Directory, bool) {
 	if len(names) == 0 {
-		return nil
+		return nil, true
 	}
 	if names[0] != "" {
-		return nil
+		return nil, true
 	}
 	curr := d
 	for _, name := range names[1:] {
-		curr.lock.RLock()
-		found := false
-		for _, dir := range curr.subDirectories {
-			if dir.name == name {
-				found = true
-				curr = dir
-				break
-			}
+		opts.waiter.blockOn(curr.GetPath())
+		if !curr.lock.acquire(true, opts) {
+			d.unlockPath(curr.GetParentDir())
+			return nil, false
 		}
+		next, found := curr.subDirectory(name)
 		if !found {
 			// cannot find a directory in the path
 			d.unlockPath(curr)
-			return nil
+			return nil, true
 		}
+		curr = next
 	}
-	curr.lock.RLock()
-	return curr
+	opts.waiter.blockOn(curr.GetPath())
+	if !curr.lock.acquire(true, opts) {
+		d.unlockPath(curr.GetParentDir())
+		return nil, false
+	}
+	return curr, true
 }
 
 // unlockPath - unlocks rlocks from directory dir all the way to root
@@ -168,12 +690,176 @@ func (d *Directory) unlockPath(dir *Directory) {
 		return
 	}
 	for dir != nil {
-		parent := dir.parent
+		parent := dir.GetParentDir()
 		dir.lock.RUnlock()
 		dir = parent
 	}
 }
 
+// findItem - returns the file or directory specified in pth, or nil if it does not exist
+// Assumes the caller prevents concurrent modification of the path
+func (d *Directory) findItem(pth string) FSItem {
+	names := pathToNames(pth)
+	if len(names) == 0 {
+		return nil
+	}
+	if len(names) == 1 {
+		return d
+	}
+	parent := d.walkPath(names[:len(names)-1])
+	if parent == nil {
+		return nil
+	}
+	return parent.entry(names[len(names)-1])
+}
+
+// lockFile - r-locks a file and every directory on its path
+// It does not record the lock in the lock tables, so it must be released with unlockFile
+// returns nil if the file does not exist
+func (d *Directory) lockFile(pth string) *FileInfo {
+	names := pathToNames(pth)
+	if len(names) < 2 {
+		return nil
+	}
+	parent := d.lockPath(names[:len(names)-1])
+	if parent == nil {
+		return nil
+	}
+	if file, exists := parent.subFile(names[len(names)-1]); exists {
+		file.lock.RLock()
+		return file
+	}
+	d.unlockPath(parent)
+	return nil
+}
+
+// unlockFile - releases the locks acquired by lockFile
+func (d *Directory) unlockFile(file *FileInfo) {
+	file.lock.RUnlock()
+	d.unlockPath(file.GetParentDir())
+}
+
+// tryWLockFile - like lockFile, but w-locks the file, and gives up instead of
+// waiting if the file or a directory on its path is locked
+// returns nil if the file does not exist or is locked
+func (d *Directory) tryWLockFile(pth string) *FileInfo {
+	names := pathToNames(pth)
+	if len(names) < 2 {
+		return nil
+	}
+	parent, _ := d.tryLockPath(names[:len(names)-1], lockOptions{try: true})
+	if parent == nil {
+		return nil
+	}
+	if file, exists := parent.subFile(names[len(names)-1]); exists && file.lock.TryLock() {
+		return file
+	}
+	d.unlockPath(parent)
+	return nil
+}
+
+// wUnlockFile - releases the locks acquired by tryWLockFile
+func (d *Directory) wUnlockFile(file *FileInfo) {
+	file.lock.Unlock()
+	d.unlockPath(file.GetParentDir())
+}
+
+// SetReplicas - sets the target replica count of a file or of the files below a directory
+// A target of 0 makes the file or directory inherit the target of its parent
+func (d *Directory) SetReplicas(pth string, replicas int, commit commitFunc) *DFSException {
+	if len(pathToNames(pth)) == 0 {
+		return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+	}
+	if replicas < 0 {
+		return &DFSException{IllegalArgumentException, "the replica count cannot be negative."}
+	}
+	var target *atomic.Int32
+	switch item := d.findItem(pth).(type) {
+	case *Directory:
+		target = &item.replicas
+	case *FileInfo:
+		target = &item.replicas
+	default:
+		return &DFSException{FileNotFoundException, fmt.Sprintf("path %s does not exist.", pth)}
+	}
+	if err := commit.run(time.Now()); err != nil {
+		return err
+	}
+	target.Store(int32(replicas))
+	return nil
+}
+
+// SetQuota - limits the total size of the files below a directory, and the number
+// of files and directories below it; a limit of 0 means unlimited
+// A quota only restricts later growth, so it may be set below the current totals.
+func (d *Directory) SetQuota(pth string, maxBytes int64, maxEntries int64, commit commitFunc) *DFSException {
+	if len(pathToNames(pth)) == 0 {
+		return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+	}
+	if maxBytes < 0 || maxEntries < 0 {
+		return &DFSException{IllegalArgumentException, "a quota cannot be negative."}
+	}
+	dir, ok := d.findItem(pth).(*Directory)
+	if !ok {
+		return &DFSException{FileNotFoundException, fmt.Sprintf("directory %s does not exist.", pth)}
+	}
+	if err := commit.run(time.Now()); err != nil {
+		return err
+	}
+	dir.maxBytes.Store(maxBytes)
+	dir.maxEntries.Store(maxEntries)
+	return nil
+}
+
+// checkQuota - checks that bytes more bytes and entries more files or directories fit
+// in the quotas of d and of every directory above it, up to but excluding until
+func (d *Directory) checkQuota(bytes int64, entries int64, until *Directory) *DFSException {
+	for dir := d; dir != nil && dir != until; dir = dir.GetParentDir() {
+		if maxBytes := dir.maxBytes.Load(); maxBytes > 0 && bytes > 0 && dir.bytes.Load()+bytes > maxBytes {
+			return &DFSException{QuotaExceededException, fmt.Sprintf("the quota of %d bytes of directory %s is exceeded.", maxBytes, dir.GetPath())}
+		}
+		if maxEntries := dir.maxEntries.Load(); maxEntries > 0 && entries > 0 && dir.files.Load()+dir.dirs.Load()+entries > maxEntries {
+			return &DFSException{QuotaExceededException, fmt.Sprintf("the quota of %d entries of directory %s is exceeded.", maxEntries, dir.GetPath())}
+		}
+	}
+	return nil
+}
+
+// reserveQuota - like checkQuota, but also locks the quota of every directory that has one,
+// so that no other change is checked against it until the returned function is called
+// The caller applies the change before calling it. Quotas are locked from d upwards, so
+// that concurrent reservations always lock them in the same order.
+func (d *Directory) reserveQuota(bytes int64, entries int64, until *Directory) (func(), *DFSException) {
+	locked := make([]*Directory, 0)
+	release := func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].quotaMtx.Unlock()
+		}
+	}
+	for dir := d; dir != nil && dir != until; dir = dir.GetParentDir() {
+		if dir.maxBytes.Load() > 0 || dir.maxEntries.Load() > 0 {
+			dir.quotaMtx.Lock()
+			locked = append(locked, dir)
+		}
+	}
+	if err := d.checkQuota(bytes, entries, until); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// CheckWrite - checks that a file can grow to size bytes without exceeding any quota
+// Assumes the client writing the file holds its lock
+func (d *Directory) CheckWrite(pth string, size int64) *DFSException {
+	file, ok := d.findItem(pth).(*FileInfo)
+	if !ok {
+		return &DFSException{FileNotFoundException, fmt.Sprintf("file %s does not exist.", pth)}
+	}
+	bytes, _, _ := file.DiskUsage()
+	return file.GetParentDir().checkQuota(size-bytes, 0, nil)
+}
+
 // PathExists - check whether a path corresponds to a file, a directory,
 // or does not exist in the file system
 // The first return value means whether the path is a directory
@@ -193,73 +879,56 @@ func (d *Directory) PathExists(pth string) (bool, bool, *DFSException) {
 	}
 
 	itemName := names[len(names)-1]
-	foundDir := false
-	for _, dir := range parent.subDirectories {
-		if dir.name == itemName {
-			foundDir = true
-			break
-		}
-	}
-	foundFile := false
-	for _, file := range parent.subFiles {
-		if file.name == itemName {
-			foundFile = true
-			break
-		}
-	}
+	_, foundDir := parent.subDirectory(itemName)
+	_, foundFile := parent.subFile(itemName)
 	return foundDir, foundFile, nil
 }
 
 // MakeDirectory - creates a new directory specified in pth
 // Assumes the client holds the w-lock of its parent directory
-func (d *Directory) MakeDirectory(pth string) (bool, *DFSException) {
+// returns nil if the directory or a file with the same name already exists
+func (d *Directory) MakeDirectory(pth string, commit commitFunc) (*Directory, *DFSException) {
 	names := pathToNames(pth)
 	if len(names) == 0 {
-		return false, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
 	}
 	if len(names) == 1 {
-		return false, nil
+		return nil, nil
 	}
 
 	// find parent directory
 	parent := d.walkPath(names[:len(names)-1])
 	if parent == nil {
-		return false, &DFSException{FileNotFoundException, "the parent directory does not exist."}
+		return nil, &DFSException{FileNotFoundException, "the parent directory does not exist."}
 	}
 
 	newDirName := names[len(names)-1]
 	// check if newDirName conflicts with existing files or directories
-	existed := false
-	for _, dir := range parent.subDirectories {
-		if dir.name == newDirName {
-			existed = true
-			break
-		}
-	}
-	for _, file := range parent.subFiles {
-		if file.name == newDirName {
-			existed = true
-			break
-		}
-	}
-	if existed {
+	if parent.entry(newDirName) != nil {
 		// already existed, just ignore it
-		return false, nil
+		return nil, nil
 	}
+	release, err := parent.reserveQuota(0, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	// create new directory
-	newDir := &Directory{
-		name:   newDirName,
-		parent: parent,
-		lock:   NewFIFORWMutex(),
+	now := time.Now()
+	if err := commit.run(now); err != nil {
+		return nil, err
 	}
-	parent.subDirectories = append(parent.subDirectories, newDir)
-	return true, nil
+	newDir := newDirectory(newDirName, parent, now)
+	parent.addSubDirectory(newDir)
+	parent.touch(now)
+	return newDir, nil
 }
 
 // GetFileStorage - Get one of the storage servers that has a file
 // Assumes the client holds the r-lock of the file
-// If there are multiple possible storage servers, return a random one
+// If there are multiple possible storage servers, return a random one,
+// avoiding suspected storage servers if possible
 func (d *Directory) GetFileStorage(pth string) (*StorageServerInfo, *DFSException) {
 	names := pathToNames(pth)
 	if len(names) == 0 {
@@ -272,21 +941,33 @@ func (d *Directory) GetFileStorage(pth string) (*StorageServerInfo, *DFSExceptio
 		return nil, &DFSException{FileNotFoundException, fmt.Sprintf("cannot find file %s.", pth)}
 	}
 
-	for _, file := range parent.subFiles {
-		if file.name == fileName {
-			// choose a random storage server
-			file.rCountMtx.Lock()
-			storageServer := file.storageServers[rand.Intn(len(file.storageServers))]
-			file.rCountMtx.Unlock()
-			return storageServer, nil
+	file, exists := parent.subFile(fileName)
+	if !exists {
+		return nil, &DFSException{FileNotFoundException, fmt.Sprintf("cannot find file %s.", pth)}
+	}
+	// choose a random storage server
+	file.rCountMtx.Lock()
+	defer file.rCountMtx.Unlock()
+	if len(file.storageServers) == 0 {
+		return nil, &DFSException{FileNotFoundException, fmt.Sprintf("no storage server holds file %s.", pth)}
+	}
+	// prefer storage servers that are not suspected to have failed
+	candidates := make([]*StorageServerInfo, 0, len(file.storageServers))
+	for _, server := range file.storageServers {
+		if server.state.Load() == serverAlive {
+			candidates = append(candidates, server)
 		}
 	}
-	return nil, &DFSException{FileNotFoundException, fmt.Sprintf("cannot find file %s.", pth)}
+	if len(candidates) == 0 {
+		candidates = file.storageServers
+	}
+	storageServer := candidates[rand.Intn(len(candidates))]
+	return storageServer, nil
 }
 
 // CreateFile - creates a new file in pth, and it is stored in storageServer
 // Assumes the client has w-lock of its parent directory
-func (d *Directory) CreateFile(pth string, storageServer *StorageServerInfo) (*FileInfo, *DFSException) {
+func (d *Directory) CreateFile(pth string, storageServer *StorageServerInfo, commit commitFunc) (*FileInfo, *DFSException) {
 	names := pathToNames(pth)
 	if len(names) == 0 {
 		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
@@ -301,37 +982,29 @@ func (d *Directory) CreateFile(pth string, storageServer *StorageServerInfo) (*F
 		return nil, &DFSException{FileNotFoundException, "the parent directory does not exist."}
 	}
 
-	conflict := false
-	for _, dir := range parent.subDirectories {
-		if dir.name == newFileName {
-			conflict = true
-			break
-		}
-	}
-	for _, file := range parent.subFiles {
-		if file.name == newFileName {
-			conflict = true
-			break
-		}
-	}
-	if conflict {
+	if parent.entry(newFileName) != nil {
 		return nil, nil
 	}
+	release, err := parent.reserveQuota(0, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	newFile := &FileInfo{
-		name:   newFileName,
-		path:   path.Clean(pth),
-		parent: parent,
-		lock:   NewFIFORWMutex(),
+	now := time.Now()
+	if err := commit.run(now); err != nil {
+		return nil, err
 	}
+	newFile := newFileInfo(newFileName, pth, parent, now)
 	newFile.storageServers = append(newFile.storageServers, storageServer)
-	parent.subFiles = append(parent.subFiles, newFile)
+	parent.addSubFile(newFile)
+	parent.touch(now)
 	return newFile, nil
 }
 
 // DeletePath - deletes a file or directory
 // Assumes the client has w-lock of its parent directory
-func (d *Directory) DeletePath(pth string) (FSItem, *DFSException) {
+func (d *Directory) DeletePath(pth string, commit commitFunc) (FSItem, *DFSException) {
 	names := pathToNames(pth)
 	if len(names) == 0 {
 		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
@@ -347,35 +1020,140 @@ func (d *Directory) DeletePath(pth string) (FSItem, *DFSException) {
 	}
 
 	// find the directory or file to be deleted
-	var deletedDir *Directory = nil
-	var deletedFile *FileInfo = nil
-	var index int
-	for i, dir := range parent.subDirectories {
-		if dir.name == deleted {
-			deletedDir = dir
-			dir.lock.Destroy()
-			index = i
-			break
-		}
-	}
-	for i, file := range parent.subFiles {
-		if file.name == deleted {
-			deletedFile = file
-			file.lock.Destroy()
-			index = i
-			break
-		}
-	}
-	if deletedDir == nil && deletedFile == nil {
+	deletedItem := parent.entry(deleted)
+	if deletedItem == nil {
 		return nil, &DFSException{FileNotFoundException, fmt.Sprintf("path %s does not exist.", pth)}
 	}
 
-	if deletedDir != nil {
-		parent.subDirectories = append(parent.subDirectories[:index], parent.subDirectories[index+1:]...)
-		return deletedDir, nil
+	now := time.Now()
+	if err := commit.run(now); err != nil {
+		return nil, err
 	}
-	parent.subFiles = append(parent.subFiles[:index], parent.subFiles[index+1:]...)
-	return deletedFile, nil
+	parent.touch(now)
+	parent.removeEntry(deleted)
+	return deletedItem, nil
+}
+
+// MovePath - moves (renames) the file or directory at src to dst
+// The lowest common ancestor of both parent directories is w-locked while
+// the item is relinked, so the client must not hold any lock below it.
+// notify is called with the moved item and its old path before the lock is
+// released, so storage servers can be updated before any client sees the new path.
+// Returns false if dst already exists.
+func (d *Directory) MovePath(src string, dst string, commit commitFunc, notify func(item FSItem, oldPath string)) (bool, *DFSException) {
+	srcNames := pathToNames(src)
+	if len(srcNames) == 0 {
+		return false, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", src)}
+	}
+	dstNames := pathToNames(dst)
+	if len(dstNames) == 0 {
+		return false, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", dst)}
+	}
+	if len(srcNames) == 1 || len(dstNames) == 1 {
+		// cannot move root directory, or replace it
+		return false, nil
+	}
+	src = path.Clean(src)
+	dst = path.Clean(dst)
+	if src == dst {
+		return false, nil
+	}
+	if strings.HasPrefix(dst, src+"/") {
+		return false, &DFSException{IllegalArgumentException, fmt.Sprintf("cannot move %s into itself.", src)}
+	}
+
+	// find the lowest common ancestor of both parent directories
+	srcParentNames := srcNames[:len(srcNames)-1]
+	dstParentNames := dstNames[:len(dstNames)-1]
+	common := 0
+	for common < len(srcParentNames) && common < len(dstParentNames) && srcParentNames[common] == dstParentNames[common] {
+		common++
+	}
+	ancestorNames := srcParentNames[:common]
+
+	// w-lock the common ancestor, r-lock the directories above it
+	var ancestor *Directory
+	if len(ancestorNames) == 1 {
+		ancestor = d
+	} else {
+		above := d.lockPath(ancestorNames[:len(ancestorNames)-1])
+		if above == nil {
+			return false, &DFSException{FileNotFoundException, fmt.Sprintf("path %s does not exist.", src)}
+		}
+		ancestor, _ = above.subDirectory(ancestorNames[len(ancestorNames)-1])
+		if ancestor == nil {
+			d.unlockPath(above)
+			return false, &DFSException{FileNotFoundException, fmt.Sprintf("path %s does not exist.", src)}
+		}
+	}
+	ancestor.lock.Lock()
+	defer func() {
+		ancestor.lock.Unlock()
+		d.unlockPath(ancestor.GetParentDir())
+	}()
+
+	srcParent := ancestor.walkPath(append([]string{""}, srcParentNames[common:]...))
+	if srcParent == nil {
+		return false, &DFSException{FileNotFoundException, fmt.Sprintf("path %s does not exist.", src)}
+	}
+	dstParent := ancestor.walkPath(append([]string{""}, dstParentNames[common:]...))
+	if dstParent == nil {
+		return false, &DFSException{FileNotFoundException, "the destination parent directory does not exist."}
+	}
+
+	// check if the destination conflicts with existing files or directories
+	newName := dstNames[len(dstNames)-1]
+	if dstParent.entry(newName) != nil {
+		return false, nil
+	}
+
+	// unlink the item from its old parent and link it to the new one
+	oldName := srcNames[len(srcNames)-1]
+	moved := srcParent.entry(oldName)
+	if moved == nil {
+		return false, &DFSException{FileNotFoundException, fmt.Sprintf("path %s does not exist.", src)}
+	}
+	// the totals of the common ancestor and above do not change
+	bytes, files, dirs := moved.DiskUsage()
+	release, err := dstParent.reserveQuota(bytes, files+dirs, ancestor)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	now := time.Now()
+	if err := commit.run(now); err != nil {
+		return false, err
+	}
+	srcParent.removeEntry(oldName)
+	switch item := moved.(type) {
+	case *Directory:
+		item.place(newName, dstParent)
+		dstParent.addSubDirectory(item)
+		// update cached paths of every file below
+		item.forEachFile(func(file *FileInfo) {
+			file.setPath(dst + strings.TrimPrefix(file.getPath(), src))
+		})
+	case *FileInfo:
+		item.place(newName, dstParent, dst)
+		dstParent.addSubFile(item)
+	}
+	srcParent.touch(now)
+	dstParent.touch(now)
+	notify(moved, src)
+	return true, nil
+}
+
+// StatPath - returns the file or directory specified in pth
+// Assumes the client has r-lock of the file or directory
+func (d *Directory) StatPath(pth string) (FSItem, *DFSException) {
+	if len(pathToNames(pth)) == 0 {
+		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+	}
+	item := d.findItem(pth)
+	if item == nil {
+		return nil, &DFSException{FileNotFoundException, fmt.Sprintf("path %s does not exist.", pth)}
+	}
+	return item, nil
 }
 
 // ListDir - lists files in a directory
@@ -390,24 +1168,119 @@ func (d *Directory) ListDir(pth string) ([]string, *DFSException) {
 		return nil, &DFSException{FileNotFoundException, fmt.Sprintf("Cannot find directory %s.", pth)}
 	}
 
-	itemNames := make([]string, 0)
-	for _, file := range dir.subFiles {
-		itemNames = append(itemNames, file.name)
+	return dir.sortedEntries(), nil
+}
+
+// addWaiter - registers a client lock request in the root directory
+func (d *Directory) addWaiter(pth string, readonly bool, owner string) *lockWaiter {
+	waiter := &lockWaiter{
+		path:     pth,
+		readonly: readonly,
+		owner:    owner,
+		since:    time.Now(),
+		victim:   make(chan struct{}),
 	}
-	for _, subdir := range dir.subDirectories {
-		itemNames = append(itemNames, subdir.name)
+	d.waitersMtx.Lock()
+	d.waiters[waiter] = empty{}
+	d.waitersMtx.Unlock()
+	return waiter
+}
+
+// removeWaiter - unregisters a client lock request that has been granted or has given up
+func (d *Directory) removeWaiter(waiter *lockWaiter) {
+	d.waitersMtx.Lock()
+	delete(d.waiters, waiter)
+	d.waitersMtx.Unlock()
+}
+
+// LockTable - lists the locks held by clients and the client lock requests still waiting
+// Locks acquired internally, e.g. on the ancestors of a locked path, are not listed.
+func (d *Directory) LockTable() LockTableResponse {
+	now := time.Now()
+	table := LockTableResponse{
+		Held:    make([]HeldLockResponse, 0),
+		Waiting: make([]WaitingLockResponse, 0),
 	}
-	return itemNames, nil
+	d.rLockedItemsMtx.Lock()
+	for pth, entry := range d.rLockedItems {
+		for owner, holder := range entry.owners {
+			table.Held = append(table.Held, HeldLockResponse{
+				Path:   pth,
+				Holder: owner,
+				Count:  holder.count,
+				HeldMs: now.Sub(holder.since).Milliseconds(),
+			})
+		}
+	}
+	d.rLockedItemsMtx.Unlock()
+	d.wLockedItemsMtx.Lock()
+	for pth, entry := range d.wLockedItems {
+		table.Held = append(table.Held, HeldLockResponse{
+			Path:      pth,
+			Exclusive: true,
+			Holder:    entry.owner,
+			Count:     1,
+			HeldMs:    now.Sub(entry.since).Milliseconds(),
+		})
+	}
+	d.wLockedItemsMtx.Unlock()
+	sort.Slice(table.Held, func(i, j int) bool {
+		if table.Held[i].Path != table.Held[j].Path {
+			return table.Held[i].Path < table.Held[j].Path
+		}
+		return table.Held[i].Holder < table.Held[j].Holder
+	})
+
+	d.waitersMtx.Lock()
+	waiters := make([]*lockWaiter, 0, len(d.waiters))
+	for waiter := range d.waiters {
+		waiters = append(waiters, waiter)
+	}
+	d.waitersMtx.Unlock()
+	sort.Slice(waiters, func(i, j int) bool {
+		return waiters[i].since.Before(waiters[j].since)
+	})
+	for _, waiter := range waiters {
+		waiter.mtx.Lock()
+		blockedOn, lock, request := waiter.blockedOn, waiter.lock, waiter.request
+		waiter.mtx.Unlock()
+		waiting := WaitingLockResponse{
+			Path:          waiter.path,
+			Exclusive:     !waiter.readonly,
+			Owner:         waiter.owner,
+			BlockedOn:     blockedOn,
+			QueuePosition: -1,
+			WaitMs:        now.Sub(waiter.since).Milliseconds(),
+		}
+		if lock != nil {
+			state := lock.state()
+			waiting.Readers = state.nReading
+			waiting.Writing = state.writing
+			waiting.QueueLength = len(state.queued)
+			for i, queued := range state.queued {
+				if queued == request {
+					waiting.QueuePosition = i
+					break
+				}
+			}
+		}
+		table.Waiting = append(table.Waiting, waiting)
+	}
+	return table
 }
 
-// LockFileOrDirectory - locks a file or directory
+// LockFileOrDirectory - locks a file or directory on behalf of owner
 // The locked file or directory is added to root directory's lock tables
-func (d *Directory) LockFileOrDirectory(pth string, readonly bool) (FSItem, *DFSException) {
+// Every lock request along the path gives up as specified in opts
+func (d *Directory) LockFileOrDirectory(pth string, readonly bool, owner string, opts lockOptions) (FSItem, *DFSException) {
 	pth = path.Clean(pth)
 	names := pathToNames(pth)
 	if len(names) == 0 {
 		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
 	}
+	opts.waiter = d.addWaiter(pth, readonly, owner)
+	defer d.removeWaiter(opts.waiter)
+
 	var fsItem FSItem = nil // the file or directory to be locked
 	if len(names) == 1 {
 		// request to lock the root directory
@@ -415,52 +1288,191 @@ func (d *Directory) LockFileOrDirectory(pth string, readonly bool) (FSItem, *DFS
 	} else {
 		// try to find fsItem
 		itemName := names[len(names)-1]
-		parent := d.lockPath(names[:len(names)-1])
+		parent, acquired := d.tryLockPath(names[:len(names)-1], opts)
+		if !acquired {
+			return nil, opts.waiter.unavailable()
+		}
 		if parent == nil {
 			return nil, &DFSException{FileNotFoundException, "the file/directory cannot be found"}
 		}
-		for _, dir := range parent.subDirectories {
-			if dir.name == itemName {
-				fsItem = dir
-				break
-			}
-		}
-		for _, file := range parent.subFiles {
-			if file.name == itemName {
-				fsItem = file
-				break
-			}
-		}
+		fsItem = parent.entry(itemName)
 		if fsItem == nil {
 			d.unlockPath(parent)
 			return nil, &DFSException{FileNotFoundException, "the file/directory cannot be found"}
 		}
 	}
+	opts.waiter.blockOn(pth)
+	if !fsItem.GetLock().acquire(readonly, opts) {
+		d.unlockPath(fsItem.GetParentDir())
+		return nil, opts.waiter.unavailable()
+	}
 	if readonly {
-		fsItem.GetLock().RLock()
 		// add it to rLockedItems table
 		d.rLockedItemsMtx.Lock()
-		item, exists := d.rLockedItems[pth]
-		if exists {
-			item.count++
-		} else {
-			d.rLockedItems[pth] = &RLockedItem{fsItem, 1}
-		}
+		d.addRLock(pth, fsItem, owner)
 		d.rLockedItemsMtx.Unlock()
 	} else {
-		fsItem.GetLock().Lock()
 		// add it to wLockedItems table
 		d.wLockedItemsMtx.Lock()
-		d.wLockedItems[pth] = fsItem
+		d.wLockedItems[pth] = &WLockedItem{fsItem, owner, time.Now()}
 		d.wLockedItemsMtx.Unlock()
 	}
 	return fsItem, nil
 }
 
-// UnlockFileOrDirectory - unlocks a file or directory
+// addRLock - adds a r-lock of owner to the r-lock table
+// Assumes the caller holds d.rLockedItemsMtx
+func (d *Directory) addRLock(pth string, fsItem FSItem, owner string) {
+	item, exists := d.rLockedItems[pth]
+	if !exists {
+		item = &RLockedItem{fsItem, 0, make(map[string]*lockHolder)}
+		d.rLockedItems[pth] = item
+	}
+	holder, exists := item.owners[owner]
+	if !exists {
+		holder = &lockHolder{since: time.Now()}
+		item.owners[owner] = holder
+	}
+	item.count++
+	holder.count++
+}
+
+// removeRLock - removes a r-lock of owner from the r-lock table, if there is one
+// Assumes the caller holds d.rLockedItemsMtx
+func (d *Directory) removeRLock(pth string, owner string) {
+	item, exists := d.rLockedItems[pth]
+	if !exists {
+		return
+	}
+	holder, exists := item.owners[owner]
+	if !exists {
+		return
+	}
+	item.count--
+	holder.count--
+	if holder.count == 0 {
+		delete(item.owners, owner)
+	}
+	if item.count == 0 {
+		delete(d.rLockedItems, pth)
+	}
+}
+
+// holdsLockBelow - whether owner holds a r-lock or a w-lock of a path below pth
+// Assumes the caller holds d.wLockedItemsMtx and d.rLockedItemsMtx
+func (d *Directory) holdsLockBelow(pth string, owner string) bool {
+	prefix := strings.TrimSuffix(pth, "/") + "/"
+	for item, entry := range d.rLockedItems {
+		if _, held := entry.owners[owner]; held && item != pth && strings.HasPrefix(item, prefix) {
+			return true
+		}
+	}
+	for item, entry := range d.wLockedItems {
+		if entry.owner == owner && item != pth && strings.HasPrefix(item, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpgradeLock - turns a r-lock held by owner into a w-lock
+// The request gives up as specified in opts, owner still holds the r-lock then.
+// It is rejected if owner holds other locks that would block it forever: another
+// r-lock of the path, or any lock below it, which r-locks the path as an ancestor.
+// Releasing the r-lock while the upgrade waits aborts the upgrade first.
+func (d *Directory) UpgradeLock(pth string, owner string, opts lockOptions) (FSItem, *DFSException) {
+	if len(pathToNames(pth)) == 0 {
+		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+	}
+	pth = path.Clean(pth)
+	d.wLockedItemsMtx.Lock()
+	d.rLockedItemsMtx.Lock()
+	entry, exists := d.rLockedItems[pth]
+	if !exists {
+		d.rLockedItemsMtx.Unlock()
+		d.wLockedItemsMtx.Unlock()
+		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is not r-locked", pth)}
+	}
+	holder, exists := entry.owners[owner]
+	if !exists {
+		d.rLockedItemsMtx.Unlock()
+		d.wLockedItemsMtx.Unlock()
+		return nil, &DFSException{LockOwnershipException, fmt.Sprintf("path %s is not r-locked by this client", pth)}
+	}
+	if holder.count > 1 {
+		// the other r-locks of the client would block the upgrade forever
+		d.rLockedItemsMtx.Unlock()
+		d.wLockedItemsMtx.Unlock()
+		return nil, &DFSException{IllegalStateException, fmt.Sprintf("path %s is r-locked more than once by this client", pth)}
+	}
+	if d.holdsLockBelow(pth, owner) {
+		d.rLockedItemsMtx.Unlock()
+		d.wLockedItemsMtx.Unlock()
+		return nil, &DFSException{IllegalStateException, fmt.Sprintf("this client holds locks below path %s, which would block the upgrade forever", pth)}
+	}
+	if holder.upgrade != nil {
+		d.rLockedItemsMtx.Unlock()
+		d.wLockedItemsMtx.Unlock()
+		return nil, &DFSException{LockUnavailableException, fmt.Sprintf("an upgrade of path %s by this client is already waiting.", pth)}
+	}
+	fsItem := entry.item
+	opts.waiter = d.addWaiter(pth, false, owner)
+	defer d.removeWaiter(opts.waiter)
+	pending := &pendingUpgrade{opts.waiter, make(chan struct{})}
+	holder.upgrade = pending
+	d.rLockedItemsMtx.Unlock()
+	d.wLockedItemsMtx.Unlock()
+
+	opts.waiter.blockOn(pth)
+	granted, conflict := fsItem.GetLock().upgrade(opts)
+
+	// move the lock from the r-lock table to the w-lock table
+	d.wLockedItemsMtx.Lock()
+	defer d.wLockedItemsMtx.Unlock()
+	d.rLockedItemsMtx.Lock()
+	holder.upgrade = nil
+	close(pending.done)
+	if granted {
+		d.removeRLock(pth, owner)
+	}
+	d.rLockedItemsMtx.Unlock()
+	if conflict {
+		return nil, &DFSException{LockUnavailableException, fmt.Sprintf("another upgrade of path %s is already waiting.", pth)}
+	}
+	if !granted {
+		return nil, opts.waiter.unavailable()
+	}
+	d.wLockedItems[pth] = &WLockedItem{fsItem, owner, time.Now()}
+	return fsItem, nil
+}
+
+// DowngradeLock - atomically turns a w-lock held by owner into a r-lock
+func (d *Directory) DowngradeLock(pth string, owner string) *DFSException {
+	if len(pathToNames(pth)) == 0 {
+		return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+	}
+	pth = path.Clean(pth)
+	d.wLockedItemsMtx.Lock()
+	defer d.wLockedItemsMtx.Unlock()
+	entry, exists := d.wLockedItems[pth]
+	if !exists {
+		return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is not w-locked", pth)}
+	}
+	if entry.owner != owner {
+		return &DFSException{LockOwnershipException, fmt.Sprintf("path %s is not w-locked by this client", pth)}
+	}
+	delete(d.wLockedItems, pth)
+	d.rLockedItemsMtx.Lock()
+	d.addRLock(pth, entry.item, owner)
+	d.rLockedItemsMtx.Unlock()
+	entry.item.GetLock().Downgrade()
+	return nil
+}
+
+// UnlockFileOrDirectory - unlocks a file or directory on behalf of owner
 // It checks the root's lock tables to guarantee the file or directory
-// is locked before and has the right lock type
-func (d *Directory) UnlockFileOrDirectory(pth string, readonly bool) *DFSException {
+// is locked before by the same owner and has the right lock type
+func (d *Directory) UnlockFileOrDirectory(pth string, readonly bool, owner string) *DFSException {
 	if len(pathToNames(pth)) == 0 {
 		return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
 	}
@@ -468,25 +1480,41 @@ func (d *Directory) UnlockFileOrDirectory(pth string, readonly bool) *DFSExcepti
 	if readonly {
 		d.rLockedItemsMtx.Lock()
 		defer d.rLockedItemsMtx.Unlock()
-		entry, exists := d.rLockedItems[pth]
-		if !exists {
-			return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is not r-locked", pth)}
-		}
-		fsItem := entry.item
-		entry.count--
-		if entry.count == 0 {
-			delete(d.rLockedItems, pth)
+		for {
+			entry, exists := d.rLockedItems[pth]
+			if !exists {
+				return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is not r-locked", pth)}
+			}
+			holder, exists := entry.owners[owner]
+			if !exists {
+				return &DFSException{LockOwnershipException, fmt.Sprintf("path %s is not r-locked by this client", pth)}
+			}
+			if pending := holder.upgrade; pending != nil {
+				// the upgrade counts on this r-lock, it gives up first
+				d.rLockedItemsMtx.Unlock()
+				pending.waiter.abortRelease()
+				<-pending.done
+				d.rLockedItemsMtx.Lock()
+				continue
+			}
+			fsItem := entry.item
+			d.removeRLock(pth, owner)
+			parent := fsItem.GetParentDir()
+			fsItem.GetLock().RUnlock()
+			d.unlockPath(parent)
+			return nil
 		}
-		parent := fsItem.GetParentDir()
-		fsItem.GetLock().RUnlock()
-		d.unlockPath(parent)
 	} else {
 		d.wLockedItemsMtx.Lock()
 		defer d.wLockedItemsMtx.Unlock()
-		fsItem, exists := d.wLockedItems[pth]
+		entry, exists := d.wLockedItems[pth]
 		if !exists {
 			return &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is not w-locked", pth)}
 		}
+		if entry.owner != owner {
+			return &DFSException{LockOwnershipException, fmt.Sprintf("path %s is not w-locked by this client", pth)}
+		}
+		fsItem := entry.item
 		delete(d.wLockedItems, pth)
 		parent := fsItem.GetParentDir()
 		fsItem.GetLock().Unlock()
@@ -495,15 +1523,87 @@ func (d *Directory) UnlockFileOrDirectory(pth string, readonly bool) *DFSExcepti
 	return nil
 }
 
+// makeDirectories - walks the directories specified in names below d,
+// creating every directory that does not exist yet
+// names does not include the name of d itself
+// returns nil if a name conflicts with an existing file, and the directories it has created
+func (d *Directory) makeDirectories(names []string) (*Directory, []*Directory) {
+	curr := d
+	created := make([]*Directory, 0)
+	for _, name := range names {
+		if dir, found := curr.subDirectory(name); found {
+			curr = dir
+			continue
+		}
+		// try to create a new directory, if no conflicts
+		if _, exists := curr.subFile(name); exists {
+			// new directory's name conflicts with an existing file
+			return nil, created
+		}
+		// create a new directory
+		now := time.Now()
+		newDir := newDirectory(name, curr, now)
+		curr.addSubDirectory(newDir)
+		curr.touch(now)
+		created = append(created, newDir)
+		curr = newDir
+	}
+	return curr, created
+}
+
+// forEachFile - calls fn on every file below d
+// Assumes the caller prevents concurrent modification of the subtree
+func (d *Directory) forEachFile(fn func(file *FileInfo)) {
+	dirs, files := d.children()
+	for _, file := range files {
+		fn(file)
+	}
+	for _, dir := range dirs {
+		dir.forEachFile(fn)
+	}
+}
+
+// forEachFileLocked - calls fn on every file below d
+// Every directory is r-locked while its entries are visited, so it is safe
+// to call while clients are modifying the file system
+func (d *Directory) forEachFileLocked(fn func(file *FileInfo)) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	dirs, files := d.children()
+	for _, file := range files {
+		fn(file)
+	}
+	for _, dir := range dirs {
+		dir.forEachFileLocked(fn)
+	}
+}
+
 // RegisterFiles - registers files from a newly registered storage server
+// sizes are the sizes of the files in the order of pths; a file without a size is
+// registered as empty. The size of a file that is already known is left alone.
 // It may need to create many files and directories, so it w-locks the
 // entire file system to prevent any deadlocks
-func (d *Directory) RegisterFiles(pths []string, storageServer *StorageServerInfo) []bool {
+// A file that is already known to be stored on storageServer (recovered from the
+// journal), or whose replicas have all been lost, is accepted again. The second return value lists files that were known
+// to be stored on storageServer but are not reported anymore; storageServer is
+// removed from their replicas.
+// commit is called with the outcome before the file system is unlocked. If it fails,
+// every change is undone (except for the modification times of directories), so no
+// client ever sees a registration that has not been journaled.
+func (d *Directory) RegisterFiles(pths []string, sizes []int64, storageServer *StorageServerInfo, commit func(success []bool, dropped []*FileInfo) *DFSException) ([]bool, []*FileInfo, *DFSException) {
 	// lock the entire FS
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	// the inverse of every change, in the order of the changes
+	undo := make([]func(), 0)
+	unlink := func(parent *Directory, name string) func() {
+		return func() {
+			parent.removeEntry(name)
+		}
+	}
 	success := make([]bool, 0)
+	reported := make(map[*FileInfo]bool)
 	for i := range pths {
 		pth := pths[i]
 		names := pathToNames(pth)
@@ -519,71 +1619,66 @@ func (d *Directory) RegisterFiles(pths []string, storageServer *StorageServerInf
 		// ignore root directory
 		names = names[1:]
 		fileName := names[len(names)-1]
-		curr := d
-		failed := false
-		for _, name := range names[:len(names)-1] {
-			found := false
-			for _, dir := range curr.subDirectories {
-				if dir.name == name {
-					found = true
-					curr = dir
-					break
-				}
-			}
-			if !found {
-				// try to create a new directory, if no conflicts
-				for _, file := range curr.subFiles {
-					if file.name == name {
-						found = true
-						break
-					}
-				}
-				if found {
-					// new directory's name conflicts with an existing file
-					failed = true
-					break
-				}
-				// create a new directory
-				newDir := &Directory{
-					name:   name,
-					parent: curr,
-					lock:   NewFIFORWMutex(),
-				}
-				curr.subDirectories = append(curr.subDirectories, newDir)
-				curr = newDir
-			}
+		curr, created := d.makeDirectories(names[:len(names)-1])
+		for _, dir := range created {
+			undo = append(undo, unlink(dir.GetParentDir(), dir.getName()))
 		}
-		if failed {
+		if curr == nil {
 			success = append(success, false)
 			continue
 		}
 		// check if fileName conflicts with existing files or directories
-		for _, dir := range curr.subDirectories {
-			if dir.name == fileName {
-				failed = true
-				break
-			}
-		}
-		for _, file := range curr.subFiles {
-			if file.name == fileName {
-				failed = true
-				break
+		_, failed := curr.subDirectory(fileName)
+		existing, exists := curr.subFile(fileName)
+		if exists {
+			lost := existing.replicaCount() == 0
+			if existing.claimReplica(storageServer) {
+				// a replica we already know about, or the only one left
+				if lost {
+					undo = append(undo, func() {
+						existing.removeReplica(storageServer)
+					})
+				}
+				reported[existing] = true
+				success = append(success, true)
+				continue
 			}
 		}
-		if failed {
+		if failed || exists {
 			success = append(success, false)
 			continue
 		}
 		// register the file
-		file := &FileInfo{
-			name:   fileName,
-			path:   path.Clean(pth),
-			parent: curr,
-			lock:   NewFIFORWMutex(),
+		now := time.Now()
+		file := newFileInfo(fileName, pth, curr, now)
+		if i < len(sizes) && sizes[i] > 0 {
+			file.size = sizes[i]
 		}
 		file.storageServers = append(file.storageServers, storageServer)
-		curr.subFiles = append(curr.subFiles, file)
+		curr.addSubFile(file)
+		curr.touch(now)
+		undo = append(undo, unlink(curr, fileName))
+		reported[file] = true
 		success = append(success, true)
 	}
-	return success
+
+	// drop replicas that the storage server does not have anymore
+	dropped := make([]*FileInfo, 0)
+	d.forEachFile(func(file *FileInfo) {
+		if !reported[file] && file.removeReplica(storageServer) {
+			dropped = append(dropped, file)
+			undo = append(undo, func() {
+				file.rCountMtx.Lock()
+				file.storageServers = append(file.storageServers, storageServer)
+				file.rCountMtx.Unlock()
+			})
+		}
+	})
+	if err := commit(success, dropped); err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return nil, nil, err
+	}
+	return success, dropped, nil
 }
@@ -0,0 +1,390 @@
+package naming
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// linearDirectory - the former layout of Directory, kept for comparison
+// Its entries are kept in slices and looked up by linear search.
+type linearDirectory struct {
+	name           string
+	subDirectories []*linearDirectory
+	subFiles       []string
+}
+
+func (d *linearDirectory) walkPath(names []string) *linearDirectory {
+	curr := d
+	for _, name := range names[1:] {
+		found := false
+		for _, dir := range curr.subDirectories {
+			if dir.name == name {
+				found = true
+				curr = dir
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return curr
+}
+
+func (d *linearDirectory) exists(name string) bool {
+	for _, dir := range d.subDirectories {
+		if dir.name == name {
+			return true
+		}
+	}
+	for _, file := range d.subFiles {
+		if file == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *linearDirectory) createFile(pth string) bool {
+	names := pathToNames(pth)
+	parent := d.walkPath(names[:len(names)-1])
+	if parent == nil || parent.exists(names[len(names)-1]) {
+		return false
+	}
+	parent.subFiles = append(parent.subFiles, names[len(names)-1])
+	return true
+}
+
+func (d *linearDirectory) makeDirectory(pth string) bool {
+	names := pathToNames(pth)
+	parent := d.walkPath(names[:len(names)-1])
+	if parent == nil || parent.exists(names[len(names)-1]) {
+		return false
+	}
+	parent.subDirectories = append(parent.subDirectories, &linearDirectory{name: names[len(names)-1]})
+	return true
+}
+
+func (d *linearDirectory) pathExists(pth string) bool {
+	names := pathToNames(pth)
+	parent := d.walkPath(names[:len(names)-1])
+	return parent != nil && parent.exists(names[len(names)-1])
+}
+
+// namespace - the directory operations every benchmark runs against
+type namespace interface {
+	createFile(pth string) bool
+	makeDirectory(pth string) bool
+	pathExists(pth string) bool
+}
+
+type mapNamespace struct {
+	root   *Directory
+	server *StorageServerInfo
+}
+
+func (ns *mapNamespace) createFile(pth string) bool {
+	file, _ := ns.root.CreateFile(pth, ns.server, nil)
+	return file != nil
+}
+
+func (ns *mapNamespace) makeDirectory(pth string) bool {
+	dir, _ := ns.root.MakeDirectory(pth, nil)
+	return dir != nil
+}
+
+func (ns *mapNamespace) pathExists(pth string) bool {
+	isDir, isFile, _ := ns.root.PathExists(pth)
+	return isDir || isFile
+}
+
+var layouts = []struct {
+	name         string
+	newNamespace func() namespace
+}{
+	{"map", func() namespace {
+		return &mapNamespace{newDirectory("", nil, time.Now()), &StorageServerInfo{}}
+	}},
+	{"slice", func() namespace {
+		return &linearDirectory{}
+	}},
+}
+
+// BenchmarkDirectoryCreateWide - creating files in a directory that already has width entries
+func BenchmarkDirectoryCreateWide(b *testing.B) {
+	for _, layout := range layouts {
+		for _, width := range []int{100, 1000, 10000} {
+			b.Run(fmt.Sprintf("%s/width=%d", layout.name, width), func(b *testing.B) {
+				ns := layout.newNamespace()
+				for i := 0; i < width; i++ {
+					ns.createFile(fmt.Sprintf("/file%d", i))
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !ns.createFile(fmt.Sprintf("/new%d", i)) {
+						b.Fatal("cannot create file")
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkDirectoryLookupWide - looking up the last entry of a directory with width entries
+func BenchmarkDirectoryLookupWide(b *testing.B) {
+	for _, layout := range layouts {
+		for _, width := range []int{100, 1000, 10000} {
+			b.Run(fmt.Sprintf("%s/width=%d", layout.name, width), func(b *testing.B) {
+				ns := layout.newNamespace()
+				for i := 0; i < width; i++ {
+					ns.createFile(fmt.Sprintf("/file%d", i))
+				}
+				last := fmt.Sprintf("/file%d", width-1)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !ns.pathExists(last) {
+						b.Fatal("cannot find file")
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkDirectoryLookupDeep - looking up a file depth directories below the root,
+// where every directory on the path has fanout subdirectories
+func BenchmarkDirectoryLookupDeep(b *testing.B) {
+	const fanout = 100
+	for _, layout := range layouts {
+		for _, depth := range []int{4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/depth=%d", layout.name, depth), func(b *testing.B) {
+				ns := layout.newNamespace()
+				var pth strings.Builder
+				for level := 0; level < depth; level++ {
+					// the path always goes through the last subdirectory
+					for i := 0; i < fanout; i++ {
+						ns.makeDirectory(fmt.Sprintf("%s/dir%d", pth.String(), i))
+					}
+					fmt.Fprintf(&pth, "/dir%d", fanout-1)
+				}
+				pth.WriteString("/file")
+				ns.createFile(pth.String())
+				leaf := pth.String()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !ns.pathExists(leaf) {
+						b.Fatal("cannot find file")
+					}
+				}
+			})
+		}
+	}
+}
+
+// newTestRoot - an empty namespace with its lock tables
+func newTestRoot() *Directory {
+	root := newDirectory("", nil, time.Now())
+	root.rLockedItems = make(map[string]*RLockedItem)
+	root.wLockedItems = make(map[string]*WLockedItem)
+	root.waiters = make(map[*lockWaiter]empty)
+	return root
+}
+
+// TestUpgradeLockReleased - releasing a r-lock while its upgrade waits aborts the upgrade
+// The other reader keeps its r-lock and the upgrade is not granted on its reader slot.
+func TestUpgradeLockReleased(t *testing.T) {
+	tests := []struct {
+		name    string
+		release func(root *Directory) *DFSException
+	}{
+		{"unlock", func(root *Directory) *DFSException {
+			return root.UnlockFileOrDirectory("/a", true, "c1")
+		}},
+		{"session expiry", func(root *Directory) *DFSException {
+			s := &NamingServer{root: root}
+			s.releaseSessionLocks(&Session{id: "c1"}, []sessionLock{{"/a", true}})
+			return nil
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := newTestRoot()
+			if _, err := root.MakeDirectory("/a", nil); err != nil {
+				t.Fatal(err.Msg)
+			}
+			for _, owner := range []string{"c1", "c2"} {
+				if _, err := root.LockFileOrDirectory("/a", true, owner, lockOptions{}); err != nil {
+					t.Fatal(err.Msg)
+				}
+			}
+			lock := root.findItem("/a").GetLock()
+
+			upgraded := make(chan *DFSException, 1)
+			go func() {
+				_, err := root.UpgradeLock("/a", "c1", lockOptions{})
+				upgraded <- err
+			}()
+			waitQueued(t, lock, 1)
+
+			if err := test.release(root); err != nil {
+				t.Fatal(err.Msg)
+			}
+			select {
+			case err := <-upgraded:
+				if err == nil || err.Type != LockUnavailableException {
+					t.Fatalf("upgrade after release: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("upgrade still waits after its r-lock is released")
+			}
+			if state := lock.state(); state.nReading != 1 || state.writing || len(state.queued) != 0 {
+				t.Fatalf("unexpected state after release: %+v", state)
+			}
+			if err := root.UnlockFileOrDirectory("/a", true, "c1"); err == nil {
+				t.Fatal("released r-lock is released again")
+			}
+			if err := root.UnlockFileOrDirectory("/a", true, "c2"); err != nil {
+				t.Fatal(err.Msg)
+			}
+			if state := lock.state(); state.nReading != 0 || state.writing {
+				t.Fatalf("lock not released: %+v", state)
+			}
+		})
+	}
+}
+
+// newQuotaRoot - a namespace with /q, which may hold 3 entries and 100 bytes, holding
+// /q/s and /q/f of 60 bytes
+func newQuotaRoot(t *testing.T) *Directory {
+	t.Helper()
+	root := newTestRoot()
+	for _, pth := range []string{"/q", "/q/s", "/other"} {
+		if _, err := root.MakeDirectory(pth, nil); err != nil {
+			t.Fatal(err.Msg)
+		}
+	}
+	file, err := root.CreateFile("/q/f", nil, nil)
+	if err != nil {
+		t.Fatal(err.Msg)
+	}
+	file.recordWrite(60, time.Now(), func(version int64) *DFSException { return nil })
+	if err := root.SetQuota("/q", 100, 3, nil); err != nil {
+		t.Fatal(err.Msg)
+	}
+	return root
+}
+
+func TestQuota(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(root *Directory) *DFSException
+		err    string // expected error type, "" if the change fits
+	}{
+		{"directory within the entry quota", func(root *Directory) *DFSException {
+			_, err := root.MakeDirectory("/q/s/d", nil)
+			return err
+		}, ""},
+		{"file beyond the entry quota of an ancestor", func(root *Directory) *DFSException {
+			root.CreateFile("/q/g", nil, nil)
+			_, err := root.CreateFile("/q/s/h", nil, nil)
+			return err
+		}, QuotaExceededException},
+		{"directory beyond the entry quota", func(root *Directory) *DFSException {
+			root.MakeDirectory("/q/t", nil)
+			_, err := root.MakeDirectory("/q/u", nil)
+			return err
+		}, QuotaExceededException},
+		{"write within the byte quota", func(root *Directory) *DFSException {
+			return root.CheckWrite("/q/f", 100)
+		}, ""},
+		{"write beyond the byte quota", func(root *Directory) *DFSException {
+			return root.CheckWrite("/q/f", 101)
+		}, QuotaExceededException},
+		{"shrinking write beyond the byte quota", func(root *Directory) *DFSException {
+			root.SetQuota("/q", 10, 0, nil)
+			return root.CheckWrite("/q/f", 50)
+		}, ""},
+		{"move within the directory with the quota", func(root *Directory) *DFSException {
+			root.SetQuota("/q", 0, 2, nil)
+			_, err := root.MovePath("/q/f", "/q/s/f", nil, func(FSItem, string) {})
+			return err
+		}, ""},
+		{"move into the directory beyond its quota", func(root *Directory) *DFSException {
+			root.CreateFile("/other/g", nil, nil)
+			root.CreateFile("/other/h", nil, nil)
+			_, err := root.MovePath("/other", "/q/s/other", nil, func(FSItem, string) {})
+			return err
+		}, QuotaExceededException},
+		{"move out of the directory beyond its quota", func(root *Directory) *DFSException {
+			root.SetQuota("/q", 10, 1, nil)
+			_, err := root.MovePath("/q/f", "/other/f", nil, func(FSItem, string) {})
+			return err
+		}, ""},
+		{"unlimited quota", func(root *Directory) *DFSException {
+			root.SetQuota("/q", 0, 0, nil)
+			return root.CheckWrite("/q/f", 1<<40)
+		}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.change(newQuotaRoot(t))
+			if test.err == "" && err != nil {
+				t.Fatalf("rejected: %s", err.Msg)
+			}
+			if test.err != "" && (err == nil || err.Type != test.err) {
+				t.Fatalf("error %v, expected %s", err, test.err)
+			}
+		})
+	}
+}
+
+// TestQuotaReservation - concurrent changes in different directories below a quota
+// never exceed it together, although each one fits on its own
+func TestQuotaReservation(t *testing.T) {
+	root := newQuotaRoot(t)
+	if err := root.SetQuota("/q", 0, 12, nil); err != nil {
+		t.Fatal(err.Msg)
+	}
+	if _, err := root.MakeDirectory("/q/t", nil); err != nil {
+		t.Fatal(err.Msg)
+	}
+	// the journal append between the check and the change takes a while
+	slowCommit := func(now time.Time) *DFSException {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	var created atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err *DFSException
+			switch i % 3 {
+			case 0:
+				_, err = root.CreateFile(fmt.Sprintf("/q/s/f%d", i), nil, slowCommit)
+			case 1:
+				_, err = root.CreateFile(fmt.Sprintf("/q/t/f%d", i), nil, slowCommit)
+			case 2:
+				_, err = root.MakeDirectory(fmt.Sprintf("/q/d%d", i), slowCommit)
+			}
+			if err == nil {
+				created.Add(1)
+			} else if err.Type != QuotaExceededException {
+				t.Errorf("unexpected error: %s", err.Msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+	q := root.findItem("/q").(*Directory)
+	if n := created.Load(); n != 9 {
+		t.Errorf("%d entries created, expected 9", n)
+	}
+	if entries := q.files.Load() + q.dirs.Load(); entries != 12 {
+		t.Errorf("/q holds %d entries, expected 12", entries)
+	}
+}
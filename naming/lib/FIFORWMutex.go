@@ -1,193 +1,347 @@
 package naming
 
-// Queue - Simple FIFO queue implementation
-type Queue struct {
-	data []any
-	size int
-	cap  int
-	head int
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// empty - an empty struct
+// It is the smallest possible object in Golang and is
+// passed through channels to synchronize goroutines.
+type empty struct{}
+
+type lockRequest struct {
+	readonly bool
+	upgrade  bool // upgrade of a r-lock held by the requester to a w-lock
+	// receives exactly one value: true if the lock is granted, false if it is refused
+	granted chan bool
+	// links of the wait queue
+	prev   *lockRequest
+	next   *lockRequest
+	queued bool
+}
+
+// lockOptions - how a lock request waits for the lock
+type lockOptions struct {
+	try   bool            // give up immediately if the lock cannot be granted
+	abort <-chan struct{} // give up when closed, nil waits forever
+	// the client lock request the lock requests belong to, nil for internal ones
+	waiter *lockWaiter
 }
 
-func NewQueue() *Queue {
-	return &Queue{
-		data: make([]any, 16),
-		size: 0,
-		cap:  16,
-		head: 0,
+// contextOptions - lock options that give up when ctx is done
+func contextOptions(ctx context.Context) lockOptions {
+	return lockOptions{abort: ctx.Done()}
+}
+
+// lockState - snapshot of a FIFORWMutex
+type lockState struct {
+	nReading int
+	writing  bool
+	queued   []*lockRequest // a waiting upgrade comes first
+}
+
+// waitQueue - requests waiting for a FIFORWMutex
+// The queued requests form an intrusive doubly linked list, so a request
+// can be withdrawn from anywhere in the queue without searching for it.
+type waitQueue struct {
+	upgrader *lockRequest // waiting upgrade, it blocks every new request
+	head     *lockRequest
+	tail     *lockRequest
+}
+
+// push - appends a request to the end of the queue
+func (q *waitQueue) push(request *lockRequest) {
+	request.prev = q.tail
+	request.next = nil
+	if q.tail != nil {
+		q.tail.next = request
+	} else {
+		q.head = request
 	}
+	q.tail = request
+	request.queued = true
 }
 
-func (q *Queue) Enqueue(elem any) {
-	if q.size+1 > q.cap {
-		newData := make([]any, q.cap*2)
-		for i := 0; i < q.size; i++ {
-			newData[i] = q.data[(q.head+i)%q.cap]
-		}
-		q.cap *= 2
-		q.data = newData
-		q.head = 0
+// remove - removes a request from the queue
+// returns false if it is not queued
+func (q *waitQueue) remove(request *lockRequest) bool {
+	if !request.queued {
+		return false
+	}
+	if request.prev != nil {
+		request.prev.next = request.next
+	} else {
+		q.head = request.next
 	}
-	q.data[(q.head+q.size)%q.cap] = elem
-	q.size++
+	if request.next != nil {
+		request.next.prev = request.prev
+	} else {
+		q.tail = request.prev
+	}
+	request.prev = nil
+	request.next = nil
+	request.queued = false
+	return true
 }
 
-func (q *Queue) Peek() any {
-	if q.size == 0 {
-		return nil
+// FIFORWMutex - A RWMutex that guarantees FIFO queueing
+// It has mostly the same interface as sync.RWMutex, but
+// sync.RWMutex does not guarantee FIFO property
+// The zero value is an unlocked mutex. The wait queue is only allocated
+// while the lock is contended, so an idle lock costs a few words of memory.
+type FIFORWMutex struct {
+	mtx      sync.Mutex
+	nReading int        // number of readers
+	writing  bool       // true if anyone is writing
+	waiting  *waitQueue // nil if no request is waiting
+}
+
+// contended - returns the wait queue, allocating it if no request is waiting
+// Assumes the caller holds lock.mtx
+func (lock *FIFORWMutex) contended() *waitQueue {
+	if lock.waiting == nil {
+		lock.waiting = &waitQueue{}
 	}
-	return q.data[q.head]
+	return lock.waiting
 }
 
-func (q *Queue) Dequeue() any {
-	if q.size == 0 {
-		return nil
+// grantQueued - grants the lock to queued requests in FIFO order, as long as possible
+// Assumes the caller holds lock.mtx
+func (lock *FIFORWMutex) grantQueued() {
+	q := lock.waiting
+	if q == nil {
+		return
+	}
+	if q.upgrader != nil && lock.nReading == 1 {
+		// the upgrader is the only reader left
+		lock.nReading = 0
+		lock.writing = true
+		q.upgrader.granted <- true
+		q.upgrader = nil
+	}
+	for q.head != nil && !lock.writing && q.upgrader == nil {
+		request := q.head
+		if request.readonly {
+			lock.nReading++
+		} else if lock.nReading == 0 {
+			lock.writing = true
+		} else {
+			break
+		}
+		q.remove(request)
+		request.granted <- true
 	}
-	elem := q.data[q.head]
-	q.head++
-	q.size--
-	if q.head >= q.cap {
-		q.head -= q.cap
+	if q.head == nil && q.upgrader == nil {
+		lock.waiting = nil
 	}
-	return elem
 }
 
-func (q *Queue) Empty() bool {
-	return q.size == 0
+// acquire - requests the lock and waits as specified in opts
+// returns true if the lock is granted
+// A request that gives up is withdrawn from the queue, so it never holds the lock afterwards.
+func (lock *FIFORWMutex) acquire(readonly bool, opts lockOptions) bool {
+	lock.mtx.Lock()
+	if lock.waiting == nil && !lock.writing && (readonly || lock.nReading == 0) {
+		// can be granted immediately without queuing
+		if readonly {
+			lock.nReading++
+		} else {
+			lock.writing = true
+		}
+		lock.mtx.Unlock()
+		return true
+	}
+	if opts.try {
+		lock.mtx.Unlock()
+		return false
+	}
+	// otherwise queue the request
+	request := &lockRequest{
+		readonly: readonly,
+		granted:  make(chan bool, 1),
+	}
+	lock.contended().push(request)
+	lock.mtx.Unlock()
+	return lock.wait(request, opts)
 }
 
-// empty - an empty struct
-// It is the smallest possible object in Golang and is
-// passed through channels to synchronize goroutines.
-type empty struct{}
+// wait - waits for a queued request as specified in opts
+func (lock *FIFORWMutex) wait(request *lockRequest, opts lockOptions) bool {
+	opts.waiter.queue(lock, request)
+	defer opts.waiter.queue(nil, nil)
+	select {
+	case granted := <-request.granted:
+		return granted
+	case <-opts.abort:
+	case <-opts.waiter.aborted():
+	}
+	if lock.withdraw(request) {
+		return false
+	}
+	// granted before it could be withdrawn, nobody will use it
+	<-request.granted
+	lock.undo(request)
+	return false
+}
 
-type lockRequest struct {
-	readonly bool
-	granted  chan empty
+// withdraw - removes a request that has not been granted yet from the queue
+// returns false if it has already been granted
+func (lock *FIFORWMutex) withdraw(request *lockRequest) bool {
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
+	q := lock.waiting
+	if q == nil {
+		return false
+	}
+	if q.upgrader == request {
+		q.upgrader = nil
+	} else if !q.remove(request) {
+		return false
+	}
+	// requests behind a withdrawn request may be granted now
+	lock.grantQueued()
+	return true
 }
 
-// FIFORWMutex - A RWMutex that guarantees FIFO queueing
-// It has mostly the same interface as sync.RWMutex, but
-// sync.RWMutex does not guarantee FIFO property
-// All synchronization is done by a dedicated scheduler goroutine
-type FIFORWMutex struct {
-	rLock   chan chan empty
-	wLock   chan chan empty
-	rUnlock chan empty
-	wUnlock chan empty
-	quit    chan empty
+// undo - reverts a granted request
+func (lock *FIFORWMutex) undo(request *lockRequest) {
+	if request.upgrade {
+		lock.Downgrade()
+	} else if request.readonly {
+		lock.RUnlock()
+	} else {
+		lock.Unlock()
+	}
 }
 
-func NewFIFORWMutex() *FIFORWMutex {
-	lock := FIFORWMutex{
-		rLock:   make(chan chan empty),
-		wLock:   make(chan chan empty),
-		rUnlock: make(chan empty),
-		wUnlock: make(chan empty),
-		quit:    make(chan empty),
+// upgrade - turns a r-lock held by the caller into a w-lock, waiting as specified in opts
+// A waiting upgrade is granted before any queued request, as soon as the caller is the only reader.
+// If it is not granted, the caller still holds the r-lock; conflict is true if
+// it was refused because another upgrade is already waiting.
+func (lock *FIFORWMutex) upgrade(opts lockOptions) (granted bool, conflict bool) {
+	lock.mtx.Lock()
+	if lock.waiting != nil && lock.waiting.upgrader != nil {
+		lock.mtx.Unlock()
+		return false, true
+	}
+	if lock.nReading == 1 {
+		// the caller is the only reader
+		lock.nReading = 0
+		lock.writing = true
+		lock.mtx.Unlock()
+		return true, false
+	}
+	if opts.try {
+		lock.mtx.Unlock()
+		return false, false
 	}
-	go lock.scheduler()
-	return &lock
+	request := &lockRequest{
+		upgrade: true,
+		granted: make(chan bool, 1),
+	}
+	lock.contended().upgrader = request
+	lock.mtx.Unlock()
+	return lock.wait(request, opts), false
 }
 
 func (lock *FIFORWMutex) RLock() {
-	granted := make(chan empty)
-	lock.rLock <- granted
-	<-granted
+	lock.acquire(true, lockOptions{})
+}
+
+// TryRLock - rlocks only if it can be granted immediately
+func (lock *FIFORWMutex) TryRLock() bool {
+	return lock.acquire(true, lockOptions{try: true})
+}
+
+// RLockContext - rlocks, giving up when ctx is done
+// returns ctx.Err() if the lock is not granted
+func (lock *FIFORWMutex) RLockContext(ctx context.Context) error {
+	if lock.acquire(true, contextOptions(ctx)) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// RLockTimeout - rlocks, giving up after timeout
+func (lock *FIFORWMutex) RLockTimeout(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return lock.RLockContext(ctx) == nil
 }
 
 func (lock *FIFORWMutex) RUnlock() {
-	lock.rUnlock <- empty{}
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
+	lock.nReading--
+	lock.grantQueued()
 }
 
 func (lock *FIFORWMutex) Lock() {
-	granted := make(chan empty)
-	lock.wLock <- granted
-	<-granted
+	lock.acquire(false, lockOptions{})
+}
+
+// TryLock - locks only if it can be granted immediately
+func (lock *FIFORWMutex) TryLock() bool {
+	return lock.acquire(false, lockOptions{try: true})
+}
+
+// LockContext - locks, giving up when ctx is done
+// returns ctx.Err() if the lock is not granted
+func (lock *FIFORWMutex) LockContext(ctx context.Context) error {
+	if lock.acquire(false, contextOptions(ctx)) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// LockTimeout - locks, giving up after timeout
+func (lock *FIFORWMutex) LockTimeout(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return lock.LockContext(ctx) == nil
 }
 
 func (lock *FIFORWMutex) Unlock() {
-	lock.wUnlock <- empty{}
-}
-
-// Destroy - terminate the scheduler goroutine
-func (lock *FIFORWMutex) Destroy() {
-	lock.quit <- empty{}
-}
-
-func (lock *FIFORWMutex) scheduler() {
-	queue := NewQueue() // request queue
-	nReading := 0       // number of readers
-	writing := false    // true if anyone is writing
-
-loop:
-	for {
-		select {
-		case granted := <-lock.rLock:
-			if queue.Empty() && !writing {
-				// can read immediately without queuing
-				nReading++
-				granted <- empty{}
-				continue loop
-			}
-			// otherwise queue the request
-			request := lockRequest{
-				readonly: true,
-				granted:  granted,
-			}
-			queue.Enqueue(request)
-
-		case granted := <-lock.wLock:
-			if queue.Empty() && nReading == 0 && !writing {
-				// can write immediately without queuing
-				writing = true
-				granted <- empty{}
-				continue loop
-			}
-			// otherwise queue the request
-			request := lockRequest{
-				readonly: false,
-				granted:  granted,
-			}
-			queue.Enqueue(request)
-
-		case <-lock.rUnlock:
-			nReading--
-			if nReading == 0 && !queue.Empty() {
-				// grant lock to the next request
-				// it must be a write request
-				request := queue.Dequeue().(lockRequest)
-				writing = true
-				request.granted <- empty{}
-			}
-
-		case <-lock.wUnlock:
-			writing = false
-			if !queue.Empty() {
-				// grant lock to the next request
-				request := queue.Dequeue().(lockRequest)
-				if request.readonly {
-					nReading++
-				} else {
-					writing = true
-				}
-				request.granted <- empty{}
-			}
-			if nReading > 0 {
-				// granted to a reader already
-				// try to grant as many rlocks as possible
-				for !queue.Empty() {
-					request := queue.Peek().(lockRequest)
-					if request.readonly {
-						queue.Dequeue()
-						nReading++
-						request.granted <- empty{}
-					} else {
-						break
-					}
-				}
-			}
-		case <-lock.quit:
-			break loop
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
+	lock.writing = false
+	lock.grantQueued()
+}
+
+// Upgrade - turns a r-lock held by the caller into a w-lock
+// returns false immediately if another upgrade is already waiting, the r-lock is still held then
+func (lock *FIFORWMutex) Upgrade() bool {
+	granted, _ := lock.upgrade(lockOptions{})
+	return granted
+}
+
+// Downgrade - atomically turns a w-lock held by the caller into a r-lock
+func (lock *FIFORWMutex) Downgrade() {
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
+	lock.writing = false
+	lock.nReading++
+	lock.grantQueued()
+}
+
+// state - returns a snapshot of the lock
+func (lock *FIFORWMutex) state() lockState {
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
+	state := lockState{
+		nReading: lock.nReading,
+		writing:  lock.writing,
+		queued:   make([]*lockRequest, 0),
+	}
+	if q := lock.waiting; q != nil {
+		if q.upgrader != nil {
+			state.queued = append(state.queued, q.upgrader)
+		}
+		for request := q.head; request != nil; request = request.next {
+			state.queued = append(state.queued, request)
 		}
 	}
+	return state
 }
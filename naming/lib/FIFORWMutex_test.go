@@ -0,0 +1,534 @@
+package naming
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chanRWMutex - the former FIFORWMutex, kept for comparison
+// All synchronization is done by a dedicated scheduler goroutine.
+type chanRWMutex struct {
+	requests chan *chanLockRequest
+	rUnlock  chan empty
+	wUnlock  chan empty
+	quit     chan empty
+}
+
+type chanLockRequest struct {
+	readonly bool
+	granted  chan bool
+}
+
+func newChanRWMutex() *chanRWMutex {
+	lock := chanRWMutex{
+		requests: make(chan *chanLockRequest),
+		rUnlock:  make(chan empty),
+		wUnlock:  make(chan empty),
+		quit:     make(chan empty),
+	}
+	go lock.scheduler()
+	return &lock
+}
+
+func (lock *chanRWMutex) acquire(readonly bool) {
+	request := &chanLockRequest{
+		readonly: readonly,
+		granted:  make(chan bool, 1),
+	}
+	lock.requests <- request
+	<-request.granted
+}
+
+func (lock *chanRWMutex) RLock() {
+	lock.acquire(true)
+}
+
+func (lock *chanRWMutex) RUnlock() {
+	lock.rUnlock <- empty{}
+}
+
+func (lock *chanRWMutex) Lock() {
+	lock.acquire(false)
+}
+
+func (lock *chanRWMutex) Unlock() {
+	lock.wUnlock <- empty{}
+}
+
+func (lock *chanRWMutex) Destroy() {
+	lock.quit <- empty{}
+}
+
+func (lock *chanRWMutex) scheduler() {
+	queue := make([]*chanLockRequest, 0)
+	nReading := 0
+	writing := false
+
+	grantQueued := func() {
+		for len(queue) > 0 && !writing {
+			request := queue[0]
+			if request.readonly {
+				nReading++
+			} else if nReading == 0 {
+				writing = true
+			} else {
+				break
+			}
+			queue = queue[1:]
+			request.granted <- true
+		}
+	}
+
+loop:
+	for {
+		select {
+		case request := <-lock.requests:
+			if len(queue) == 0 && !writing && (request.readonly || nReading == 0) {
+				if request.readonly {
+					nReading++
+				} else {
+					writing = true
+				}
+				request.granted <- true
+				continue loop
+			}
+			queue = append(queue, request)
+
+		case <-lock.rUnlock:
+			nReading--
+			grantQueued()
+
+		case <-lock.wUnlock:
+			writing = false
+			grantQueued()
+
+		case <-lock.quit:
+			break loop
+		}
+	}
+}
+
+type rwLocker interface {
+	RLock()
+	RUnlock()
+	Lock()
+	Unlock()
+}
+
+// implementations - the lock implementations every benchmark runs against
+var implementations = []struct {
+	name    string
+	newLock func() (rwLocker, func())
+}{
+	{"mutex", func() (rwLocker, func()) {
+		return &FIFORWMutex{}, func() {}
+	}},
+	{"goroutine", func() (rwLocker, func()) {
+		lock := newChanRWMutex()
+		return lock, lock.Destroy
+	}},
+}
+
+// BenchmarkFIFORWMutexNew - cost of the lock of one more file or directory
+func BenchmarkFIFORWMutexNew(b *testing.B) {
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			b.ReportAllocs()
+			destroys := make([]func(), 0, b.N)
+			for i := 0; i < b.N; i++ {
+				_, destroy := impl.newLock()
+				destroys = append(destroys, destroy)
+			}
+			b.StopTimer()
+			for _, destroy := range destroys {
+				destroy()
+			}
+		})
+	}
+}
+
+// BenchmarkFIFORWMutexUncontended - a single goroutine locking and unlocking
+func BenchmarkFIFORWMutexUncontended(b *testing.B) {
+	for _, impl := range implementations {
+		b.Run(impl.name+"/read", func(b *testing.B) {
+			lock, destroy := impl.newLock()
+			defer destroy()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				lock.RLock()
+				lock.RUnlock()
+			}
+		})
+		b.Run(impl.name+"/write", func(b *testing.B) {
+			lock, destroy := impl.newLock()
+			defer destroy()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				lock.Lock()
+				lock.Unlock()
+			}
+		})
+	}
+}
+
+// BenchmarkFIFORWMutexContended - parallel goroutines sharing one lock,
+// one in every writeRatio acquisitions is exclusive
+func BenchmarkFIFORWMutexContended(b *testing.B) {
+	for _, impl := range implementations {
+		for _, bench := range []struct {
+			name       string
+			writeRatio int
+		}{
+			{"read", 0},
+			{"mixed", 10},
+			{"write", 1},
+		} {
+			writeRatio := bench.writeRatio
+			b.Run(impl.name+"/"+bench.name, func(b *testing.B) {
+				lock, destroy := impl.newLock()
+				defer destroy()
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 1; pb.Next(); i++ {
+						if writeRatio > 0 && i%writeRatio == 0 {
+							lock.Lock()
+							lock.Unlock()
+						} else {
+							lock.RLock()
+							lock.RUnlock()
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkFIFORWMutexTree - many goroutines locking paths of a directory tree,
+// r-locking the ancestors and w-locking the leaf, as the naming server does
+func BenchmarkFIFORWMutexTree(b *testing.B) {
+	const depth, fanout = 3, 8
+	for _, impl := range implementations {
+		b.Run(impl.name, func(b *testing.B) {
+			// locks[0] is the root, the children of locks[i] are locks[i*fanout+1...(i+1)*fanout]
+			n := 0
+			for level, width := 0, 1; level <= depth; level, width = level+1, width*fanout {
+				n += width
+			}
+			locks := make([]rwLocker, n)
+			destroys := make([]func(), n)
+			for i := range locks {
+				locks[i], destroys[i] = impl.newLock()
+			}
+			defer func() {
+				for _, destroy := range destroys {
+					destroy()
+				}
+			}()
+			leaves := n - n/fanout
+			var next sync.Mutex
+			seed := 0
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				next.Lock()
+				seed++
+				leaf := seed * 7919
+				next.Unlock()
+				path := make([]int, 0, depth+1)
+				for pb.Next() {
+					leaf = (leaf + 1) % leaves
+					path = path[:0]
+					for i := n/fanout + leaf; i > 0; i = (i - 1) / fanout {
+						path = append(path, i)
+					}
+					path = append(path, 0)
+					for i := len(path) - 1; i > 0; i-- {
+						locks[path[i]].RLock()
+					}
+					locks[path[0]].Lock()
+					locks[path[0]].Unlock()
+					for i := 1; i < len(path); i++ {
+						locks[path[i]].RUnlock()
+					}
+				}
+			})
+		})
+	}
+}
+
+// queueRequest - requests lock from a new goroutine, and waits until the request is queued
+// returns a channel receiving whether the lock was granted
+func queueRequest(t *testing.T, lock *FIFORWMutex, readonly bool, opts lockOptions) <-chan bool {
+	t.Helper()
+	queued := len(lock.state().queued)
+	granted := make(chan bool, 1)
+	go func() {
+		granted <- lock.acquire(readonly, opts)
+	}()
+	waitQueued(t, lock, queued+1)
+	return granted
+}
+
+// waitQueued - waits until n requests are queued on lock
+func waitQueued(t *testing.T, lock *FIFORWMutex, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(lock.state().queued) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, expected %d", len(lock.state().queued), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expectGranted - fails unless the request is granted
+func expectGranted(t *testing.T, name string, granted <-chan bool) {
+	t.Helper()
+	select {
+	case ok := <-granted:
+		if !ok {
+			t.Fatalf("%s is refused", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s is not granted", name)
+	}
+}
+
+// expectWaiting - fails if the request has been granted or refused
+func expectWaiting(t *testing.T, name string, granted <-chan bool) {
+	t.Helper()
+	select {
+	case <-granted:
+		t.Fatalf("%s is not waiting", name)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFIFORWMutexGrantOrder(t *testing.T) {
+	var lock FIFORWMutex
+	lock.Lock()
+	r1 := queueRequest(t, &lock, true, lockOptions{})
+	w2 := queueRequest(t, &lock, false, lockOptions{})
+	r3 := queueRequest(t, &lock, true, lockOptions{})
+	r4 := queueRequest(t, &lock, true, lockOptions{})
+	w5 := queueRequest(t, &lock, false, lockOptions{})
+
+	lock.Unlock()
+	expectGranted(t, "r1", r1)
+	// r3 must not overtake w2, although it could share the lock with r1
+	expectWaiting(t, "w2", w2)
+	expectWaiting(t, "r3", r3)
+	if lock.TryRLock() {
+		t.Fatal("a new reader overtakes queued requests")
+	}
+
+	lock.RUnlock()
+	expectGranted(t, "w2", w2)
+	expectWaiting(t, "r3", r3)
+
+	lock.Unlock()
+	// consecutive readers are granted together
+	expectGranted(t, "r3", r3)
+	expectGranted(t, "r4", r4)
+	expectWaiting(t, "w5", w5)
+
+	lock.RUnlock()
+	expectWaiting(t, "w5", w5)
+	lock.RUnlock()
+	expectGranted(t, "w5", w5)
+	lock.Unlock()
+
+	if state := lock.state(); state.nReading != 0 || state.writing || len(state.queued) != 0 || lock.waiting != nil {
+		t.Fatalf("lock not released: %+v", state)
+	}
+}
+
+func TestFIFORWMutexWithdraw(t *testing.T) {
+	var lock FIFORWMutex
+	lock.RLock()
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	w1 := queueRequest(t, &lock, false, contextOptions(ctx1))
+	r2 := queueRequest(t, &lock, true, lockOptions{})
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	defer cancel3()
+	w3 := queueRequest(t, &lock, false, contextOptions(ctx3))
+	r4 := queueRequest(t, &lock, true, lockOptions{})
+	expectWaiting(t, "r2", r2)
+
+	// withdrawing w1 lets r2 share the lock with the reader holding it
+	cancel1()
+	if <-w1 {
+		t.Fatal("withdrawn w1 is granted")
+	}
+	expectGranted(t, "r2", r2)
+	// r4 still waits behind w3
+	expectWaiting(t, "r4", r4)
+
+	// withdrawing r5 from the middle of the queue
+	ctx5, cancel5 := context.WithCancel(context.Background())
+	defer cancel5()
+	r5 := queueRequest(t, &lock, true, contextOptions(ctx5))
+	w6 := queueRequest(t, &lock, false, lockOptions{})
+	r7 := queueRequest(t, &lock, true, lockOptions{})
+	cancel5()
+	if <-r5 {
+		t.Fatal("withdrawn r5 is granted")
+	}
+	waitQueued(t, &lock, 4)
+
+	// withdrawing w3 from the head of the queue grants r4, but not r7 behind w6
+	cancel3()
+	if <-w3 {
+		t.Fatal("withdrawn w3 is granted")
+	}
+	expectGranted(t, "r4", r4)
+	expectWaiting(t, "w6", w6)
+	expectWaiting(t, "r7", r7)
+	if state := lock.state(); state.nReading != 3 || state.writing || len(state.queued) != 2 {
+		t.Fatalf("unexpected state after withdrawals: %+v", state)
+	}
+	for i := 0; i < 3; i++ {
+		lock.RUnlock()
+	}
+	expectGranted(t, "w6", w6)
+	lock.Unlock()
+	expectGranted(t, "r7", r7)
+	lock.RUnlock()
+}
+
+func TestFIFORWMutexUpgradeConflict(t *testing.T) {
+	var lock FIFORWMutex
+	lock.RLock() // a
+	lock.RLock() // b
+
+	upgraded := make(chan bool, 1)
+	go func() {
+		granted, _ := lock.upgrade(lockOptions{})
+		upgraded <- granted
+	}()
+	waitQueued(t, &lock, 1)
+	expectWaiting(t, "upgrade of a", upgraded)
+
+	// a second upgrade would wait for the first one forever
+	granted, conflict := lock.upgrade(lockOptions{})
+	if granted || !conflict {
+		t.Fatalf("second upgrade: granted %v, conflict %v", granted, conflict)
+	}
+	// a waiting upgrade blocks new readers
+	r := queueRequest(t, &lock, true, lockOptions{})
+
+	// b still holds its r-lock, releasing it grants the upgrade before r
+	lock.RUnlock()
+	expectGranted(t, "upgrade of a", upgraded)
+	expectWaiting(t, "r", r)
+	if state := lock.state(); state.nReading != 0 || !state.writing {
+		t.Fatalf("unexpected state after upgrade: %+v", state)
+	}
+	lock.Unlock()
+	expectGranted(t, "r", r)
+	lock.RUnlock()
+}
+
+func TestFIFORWMutexDowngrade(t *testing.T) {
+	var lock FIFORWMutex
+	lock.Lock()
+	r1 := queueRequest(t, &lock, true, lockOptions{})
+	r2 := queueRequest(t, &lock, true, lockOptions{})
+	w3 := queueRequest(t, &lock, false, lockOptions{})
+	r4 := queueRequest(t, &lock, true, lockOptions{})
+
+	lock.Downgrade()
+	expectGranted(t, "r1", r1)
+	expectGranted(t, "r2", r2)
+	expectWaiting(t, "w3", w3)
+	expectWaiting(t, "r4", r4)
+	if state := lock.state(); state.nReading != 3 || state.writing || len(state.queued) != 2 {
+		t.Fatalf("unexpected state after downgrade: %+v", state)
+	}
+
+	for i := 0; i < 3; i++ {
+		lock.RUnlock()
+	}
+	expectGranted(t, "w3", w3)
+	lock.Unlock()
+	expectGranted(t, "r4", r4)
+	lock.RUnlock()
+}
+
+// TestFIFORWMutexConcurrent - goroutines locking, trying, timing out and upgrading
+// at random must never hold conflicting locks, run with -race
+func TestFIFORWMutexConcurrent(t *testing.T) {
+	var lock FIFORWMutex
+	var readers, writers atomic.Int32
+	check := func() {
+		if w := writers.Load(); w > 1 || (w == 1 && readers.Load() > 0) {
+			t.Errorf("%d writers and %d readers hold the lock", w, readers.Load())
+		}
+	}
+	read := func() {
+		readers.Add(1)
+		check()
+		readers.Add(-1)
+	}
+	write := func() {
+		writers.Add(1)
+		check()
+		writers.Add(-1)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for i := 0; i < 300; i++ {
+				switch random.Intn(6) {
+				case 0:
+					lock.RLock()
+					read()
+					lock.RUnlock()
+				case 1:
+					lock.Lock()
+					write()
+					lock.Unlock()
+				case 2:
+					if lock.RLockTimeout(time.Duration(random.Intn(100)) * time.Microsecond) {
+						read()
+						lock.RUnlock()
+					}
+				case 3:
+					if lock.LockTimeout(time.Duration(random.Intn(100)) * time.Microsecond) {
+						write()
+						lock.Unlock()
+					}
+				case 4:
+					if lock.TryLock() {
+						write()
+						lock.Unlock()
+					}
+				case 5:
+					lock.RLock()
+					read()
+					ctx, cancel := context.WithTimeout(context.Background(), time.Duration(random.Intn(100))*time.Microsecond)
+					if granted, _ := lock.upgrade(contextOptions(ctx)); granted {
+						write()
+						lock.Downgrade()
+						read()
+					}
+					cancel()
+					lock.RUnlock()
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	if state := lock.state(); state.nReading != 0 || state.writing || len(state.queued) != 0 || lock.waiting != nil {
+		t.Fatalf("lock not released: %+v", state)
+	}
+}
@@ -1,9 +1,13 @@
 package naming
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 	"net/http"
+	"path"
 	"sync"
+	"time"
 )
 
 // isValidPathHandler - handler for client API /is_valid_path
@@ -18,22 +22,35 @@ func (s *NamingServer) getStorageHandler(body PathRequest) (int, any) {
 	if err != nil {
 		return http.StatusNotFound, err
 	}
-	return http.StatusOK, StorageInfoResponse{"127.0.0.1", storageServer.clientPort}
+	return http.StatusOK, StorageInfoResponse{storageServer.ip, storageServer.clientPort}
 }
 
 // createDirectoryHandler - handler for client API /create_directory
 func (s *NamingServer) createDirectoryHandler(body PathRequest) (int, any) {
-	success, err := s.root.MakeDirectory(body.Path)
+	newDir, err := s.root.MakeDirectory(body.Path, func(now time.Time) *DFSException {
+		return s.journal.commit(journalRecord{Op: opMakeDirectory, Path: path.Clean(body.Path), Time: now.UnixNano()})
+	})
 	if err != nil {
+		if err.Type == QuotaExceededException {
+			return http.StatusConflict, err
+		}
+		if err.Type == IOException {
+			return http.StatusInternalServerError, err
+		}
 		return http.StatusNotFound, err
 	}
-	return http.StatusOK, SuccessResponse{success}
+	return http.StatusOK, SuccessResponse{newDir != nil}
 }
 
 // deleteHandler - handler for client API /delete
 func (s *NamingServer) deleteHandler(body PathRequest) (int, any) {
-	deletedItem, err := s.root.DeletePath(body.Path)
+	deletedItem, err := s.root.DeletePath(body.Path, func(now time.Time) *DFSException {
+		return s.journal.commit(journalRecord{Op: opDeletePath, Path: path.Clean(body.Path), Time: now.UnixNano()})
+	})
 	if err != nil {
+		if err.Type == IOException {
+			return http.StatusInternalServerError, err
+		}
 		return http.StatusNotFound, err
 	}
 	if deletedItem == nil {
@@ -43,10 +60,10 @@ func (s *NamingServer) deleteHandler(body PathRequest) (int, any) {
 	var wg sync.WaitGroup
 	if deletedFile, ok := deletedItem.(*FileInfo); ok {
 		// notify the storage servers asynchronously
-		for _, storageServer := range deletedFile.storageServers {
+		for _, storageServer := range deletedFile.replicaServers() {
 			storageServer := storageServer
 			wg.Add(1)
-			go s.storageDeleteCommand(deletedFile.path, storageServer, &wg)
+			go s.storageDeleteCommand(deletedFile.getPath(), storageServer, &wg)
 		}
 	} else {
 		deletedDir := deletedItem.(*Directory)
@@ -65,20 +82,26 @@ func (s *NamingServer) deleteHandler(body PathRequest) (int, any) {
 // createFileHandler - handler for client API /create_file
 func (s *NamingServer) createFileHandler(body PathRequest) (int, any) {
 	// allocate a storage server
-	s.lock.RLock()
-	if len(s.storageServers) == 0 {
+	storageServers := s.aliveStorageServers()
+	if len(storageServers) == 0 {
 		// no storage server
-		s.lock.RUnlock()
 		err := &DFSException{IllegalStateException, "no storage servers are registered with the naming server."}
 		return http.StatusConflict, err
 	}
-	// allocate a random storage server
-	idx := rand.Intn(len(s.storageServers))
-	storageServer := s.storageServers[idx]
-	s.lock.RUnlock()
+	// allocate a storage server as the placement policy says
+	storageServer := s.placeFile(storageServers)
 
-	file, err := s.root.CreateFile(body.Path, storageServer)
+	key := storageServer.key()
+	file, err := s.root.CreateFile(body.Path, storageServer, func(now time.Time) *DFSException {
+		return s.journal.commit(journalRecord{Op: opCreateFile, Path: path.Clean(body.Path), Server: &key, Time: now.UnixNano()})
+	})
 	if err != nil {
+		if err.Type == QuotaExceededException {
+			return http.StatusConflict, err
+		}
+		if err.Type == IOException {
+			return http.StatusInternalServerError, err
+		}
 		return http.StatusNotFound, err
 	}
 	success := file != nil
@@ -89,13 +112,169 @@ func (s *NamingServer) createFileHandler(body PathRequest) (int, any) {
 	return http.StatusOK, SuccessResponse{success}
 }
 
+// renameHandler - handler for client API /rename
+func (s *NamingServer) renameHandler(body RenameRequest) (int, any) {
+	commit := func(now time.Time) *DFSException {
+		return s.journal.commit(journalRecord{
+			Op:      opMovePath,
+			Path:    path.Clean(body.Path),
+			NewPath: path.Clean(body.NewPath),
+			Time:    now.UnixNano(),
+		})
+	}
+	success, err := s.root.MovePath(body.Path, body.NewPath, commit, func(item FSItem, oldPath string) {
+		// find every storage server holding a moved file
+		var newPath string
+		storageServers := make([]*StorageServerInfo, 0)
+		addServers := func(file *FileInfo) {
+			file.rCountMtx.Lock()
+			defer file.rCountMtx.Unlock()
+			for _, server := range file.storageServers {
+				exists := false
+				for _, added := range storageServers {
+					if added == server {
+						exists = true
+						break
+					}
+				}
+				if !exists {
+					storageServers = append(storageServers, server)
+				}
+			}
+		}
+		if movedFile, ok := item.(*FileInfo); ok {
+			newPath = movedFile.getPath()
+			addServers(movedFile)
+		} else {
+			movedDir := item.(*Directory)
+			newPath = movedDir.GetPath()
+			movedDir.forEachFile(addServers)
+		}
+		// notify the storage servers while the namespace is still locked
+		var wg sync.WaitGroup
+		for _, storageServer := range storageServers {
+			wg.Add(1)
+			go s.storageRenameCommand(oldPath, newPath, storageServer, &wg)
+		}
+		wg.Wait()
+	})
+	if err != nil {
+		if err.Type == QuotaExceededException {
+			return http.StatusConflict, err
+		}
+		if err.Type == IOException {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, SuccessResponse{success}
+}
+
 // listDirHandler - handler for client API /list
-func (s *NamingServer) listDirHandler(body PathRequest) (int, any) {
-	files, err := s.root.ListDir(body.Path)
+func (s *NamingServer) listDirHandler(body ListRequest) (int, any) {
+	items, next, err := s.root.ListDirPage(body.Path, body.Sort, body.StartAfter, body.Limit)
 	if err != nil {
 		return http.StatusNotFound, err
 	}
-	return http.StatusOK, ListFilesResponse{files}
+	if !body.Detailed {
+		files := make([]string, 0, len(items))
+		for _, item := range items {
+			files = append(files, nameOf(item))
+		}
+		return http.StatusOK, ListFilesResponse{files, next}
+	}
+	entries := make([]StatResponse, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, statItem(item))
+	}
+	return http.StatusOK, ListEntriesResponse{entries, next}
+}
+
+// walkHandler - handler for client API /walk
+func (s *NamingServer) walkHandler(body WalkRequest) (int, any) {
+	entries, err := s.root.WalkTree(body.Path, body.MaxDepth)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, PathsResponse{treePaths(entries, body.MarkDirectories)}
+}
+
+// globHandler - handler for client API /glob
+func (s *NamingServer) globHandler(body GlobRequest) (int, any) {
+	entries, err := s.root.Glob(body.Pattern)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, PathsResponse{treePaths(entries, body.MarkDirectories)}
+}
+
+// treePaths - the paths of a walk or a glob, directories end with '/' if markDirectories is set
+func treePaths(entries []treeEntry, markDirectories bool) []string {
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if markDirectories && entry.isDirectory {
+			paths = append(paths, entry.path+"/")
+		} else {
+			paths = append(paths, entry.path)
+		}
+	}
+	return paths
+}
+
+// statHandler - handler for client API /stat
+func (s *NamingServer) statHandler(body PathRequest) (int, any) {
+	item, err := s.root.StatPath(body.Path)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, statItem(item)
+}
+
+// diskUsageHandler - handler for client API /du
+func (s *NamingServer) diskUsageHandler(body PathRequest) (int, any) {
+	item, err := s.root.StatPath(body.Path)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	bytes, files, dirs := item.DiskUsage()
+	response := DiskUsageResponse{path.Clean(body.Path), bytes, files, dirs, 0, 0}
+	if dir, ok := item.(*Directory); ok {
+		response.MaxBytes = dir.maxBytes.Load()
+		response.MaxEntries = dir.maxEntries.Load()
+	}
+	return http.StatusOK, response
+}
+
+// statItem - collects the metadata of a file or directory
+func statItem(item FSItem) StatResponse {
+	if dir, ok := item.(*Directory); ok {
+		return StatResponse{
+			Name:        dir.getName(),
+			Path:        dir.GetPath(),
+			IsDirectory: true,
+			Ctime:       dir.ctime.UnixMilli(),
+			Mtime:       time.Unix(0, dir.mtime.Load()).UnixMilli(),
+			Replicas:    make([]StorageInfoResponse, 0),
+		}
+	}
+	file := item.(*FileInfo)
+	stat := StatResponse{
+		Name:     file.getName(),
+		Path:     file.getPath(),
+		Ctime:    file.ctime.UnixMilli(),
+		Replicas: make([]StorageInfoResponse, 0),
+	}
+	file.metaMtx.Lock()
+	stat.Size = file.size
+	stat.Mtime = file.mtime.UnixMilli()
+	stat.Version = file.version
+	file.metaMtx.Unlock()
+	file.rCountMtx.Lock()
+	for _, storageServer := range file.storageServers {
+		stat.Replicas = append(stat.Replicas, StorageInfoResponse{storageServer.ip, storageServer.clientPort})
+	}
+	file.rCountMtx.Unlock()
+	return stat
 }
 
 // isDirectoryHandler - handler for client API /is_directory
@@ -110,90 +289,401 @@ func (s *NamingServer) isDirectoryHandler(body PathRequest) (int, any) {
 	return http.StatusOK, SuccessResponse{foundDir}
 }
 
+// setReplicationHandler - handler for client API /set_replication
+func (s *NamingServer) setReplicationHandler(body ReplicationRequest) (int, any) {
+	err := s.root.SetReplicas(body.Path, body.Replicas, func(time.Time) *DFSException {
+		return s.journal.commit(journalRecord{Op: opSetReplicas, Path: path.Clean(body.Path), Replicas: body.Replicas})
+	})
+	if err != nil {
+		if err.Type == IOException {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusNotFound, err
+	}
+	s.replicasTuned.Store(true)
+	s.triggerRepair()
+	return http.StatusOK, SuccessResponse{true}
+}
+
+// setQuotaHandler - handler for client API /set_quota
+func (s *NamingServer) setQuotaHandler(body QuotaRequest) (int, any) {
+	err := s.root.SetQuota(body.Path, body.MaxBytes, body.MaxEntries, func(time.Time) *DFSException {
+		return s.journal.commit(journalRecord{Op: opSetQuota, Path: path.Clean(body.Path), MaxBytes: body.MaxBytes, MaxEntries: body.MaxEntries})
+	})
+	if err != nil {
+		if err.Type == IOException {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, SuccessResponse{true}
+}
+
+// openSessionHandler - handler for client API /session/open
+func (s *NamingServer) openSessionHandler(body SessionRequest) (int, any) {
+	session := s.openSession(time.Duration(body.TimeoutMs) * time.Millisecond)
+	return http.StatusOK, SessionResponse{session.id, session.timeout.Milliseconds()}
+}
+
+// keepaliveHandler - handler for client API /session/keepalive
+func (s *NamingServer) keepaliveHandler(body SessionRequest) (int, any) {
+	if s.renewSession(body.SessionID) == nil {
+		return http.StatusNotFound, sessionNotFound(body.SessionID)
+	}
+	return http.StatusOK, SuccessResponse{true}
+}
+
+// closeSessionHandler - handler for client API /session/close
+func (s *NamingServer) closeSessionHandler(body SessionRequest) (int, any) {
+	if !s.closeSession(body.SessionID) {
+		return http.StatusNotFound, sessionNotFound(body.SessionID)
+	}
+	return http.StatusOK, SuccessResponse{true}
+}
+
 // lockHandler - handler for client API /lock
-func (s *NamingServer) lockHandler(body LockRequest) (int, any) {
-	fsItem, err := s.root.LockFileOrDirectory(body.Path, !body.Exclusive)
+// The lock request is withdrawn if ctx is done before the lock is granted.
+func (s *NamingServer) lockHandler(ctx context.Context, body LockRequest) (int, any) {
+	var session *Session
+	if body.SessionID != "" {
+		session = s.renewSession(body.SessionID)
+		if session == nil {
+			return http.StatusNotFound, sessionNotFound(body.SessionID)
+		}
+	}
+	if body.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(body.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	opts := contextOptions(ctx)
+	opts.try = body.Try
+	fsItem, err := s.root.LockFileOrDirectory(body.Path, !body.Exclusive, body.owner(), opts)
 	if err != nil {
+		if err.Type == LockUnavailableException || err.Type == DeadlockException {
+			return http.StatusConflict, err
+		}
 		return http.StatusNotFound, err
 	}
+	if session != nil && !s.addSessionLock(session, path.Clean(body.Path), !body.Exclusive) {
+		// the session expired while waiting for the lock
+		s.root.UnlockFileOrDirectory(body.Path, !body.Exclusive, body.owner())
+		return http.StatusNotFound, sessionNotFound(body.SessionID)
+	}
 	if file, ok := fsItem.(*FileInfo); ok {
-		// handles replication for the file
-		file.rCountMtx.Lock()
-		defer file.rCountMtx.Unlock()
-		if body.Exclusive {
-			// delete all except one replicas
-			file.rCount = 0
-			var wg sync.WaitGroup
-			for _, storageServer := range file.storageServers[1:] {
-				storageServer := storageServer
-				wg.Add(1)
-				go s.storageDeleteCommand(file.path, storageServer, &wg)
-			}
-			wg.Wait()
-		} else {
-			file.rCount++
-			if file.rCount >= 20 {
-				file.rCount -= 20
-				// have one more replica, if possible
-				s.lock.RLock()
-				candidates := make([]*StorageServerInfo, 0)
-				for _, storageServer := range s.storageServers {
-					exists := false
-					for _, currServer := range file.storageServers {
-						if storageServer == currServer {
-							exists = true
-							break
-						}
-					}
-					if !exists {
-						candidates = append(candidates, storageServer)
-					}
+		s.trackAccess(file, body.Exclusive)
+	}
+	return http.StatusOK, nil
+}
+
+// trackAccess - handles replication for a file locked by a client
+// A shared lock counts as a read, an exclusive lock as a write.
+func (s *NamingServer) trackAccess(file *FileInfo, exclusive bool) {
+	file.rCountMtx.Lock()
+	defer file.rCountMtx.Unlock()
+	if exclusive {
+		// delete the replicas added for reads, down to the target replica count
+		file.rCount = 0
+		target := file.targetReplicas(s.config.DefaultReplicas)
+		if target < 1 {
+			target = 1
+		}
+		if len(file.storageServers) > target {
+			s.dropReplicas(file, file.storageServers[:target])
+		}
+	} else {
+		file.rCount++
+		if file.rCount >= 20 {
+			file.rCount -= 20
+			// have one more replica, if possible
+			candidates := make([]*StorageServerInfo, 0)
+			for _, storageServer := range s.aliveStorageServers() {
+				if !file.involves(storageServer) {
+					candidates = append(candidates, storageServer)
 				}
-				s.lock.RUnlock()
-				if len(candidates) > 0 {
-					// choose a random storage server to replicate
-					dst := candidates[rand.Intn(len(candidates))]
-					// choose a random storage server as source
-					src := file.storageServers[rand.Intn(len(file.storageServers))]
-					success := s.storageCopyCommand(file, dst, src)
-					if success {
-						file.storageServers = append(file.storageServers, dst)
+			}
+			if len(candidates) > 0 && len(file.storageServers) > 0 {
+				// choose a storage server to replicate, preferring a new zone
+				dst := s.placeReplica(file.storageServers, candidates)
+				// choose a random storage server as source
+				src := file.storageServers[rand.Intn(len(file.storageServers))]
+				if s.copyReplica(file, dst, src) {
+					key := dst.key()
+					if err := s.journal.Append(journalRecord{Op: opAddReplica, Path: file.getPath(), Server: &key}); err != nil {
+						// the copy is an orphan, which reconciliation deletes
+						fmt.Printf("cannot add replica of %s: %s\n", file.getPath(), err.Error())
+						return
 					}
+					file.storageServers = append(file.storageServers, dst)
 				}
 			}
 		}
 	}
+}
+
+// dropReplicas - deletes the replicas of a file that are not kept
+// Assumes the caller holds file.rCountMtx, which is released while the replicas are
+// deleted from the storage servers, after they have been removed from the file
+func (s *NamingServer) dropReplicas(file *FileInfo, kept []*StorageServerInfo) {
+	dropped := make([]*StorageServerInfo, 0)
+	records := make([]journalRecord, 0)
+	for _, server := range file.storageServers {
+		isKept := false
+		for _, keptServer := range kept {
+			isKept = isKept || keptServer == server
+		}
+		if !isKept {
+			key := server.key()
+			dropped = append(dropped, server)
+			records = append(records, journalRecord{Op: opRemoveReplica, Path: file.getPath(), Server: &key})
+		}
+	}
+	if err := s.journal.Append(records...); err != nil {
+		fmt.Printf("cannot remove replicas of %s: %s\n", file.getPath(), err.Error())
+		return
+	}
+	file.storageServers = append([]*StorageServerInfo(nil), kept...)
+	s.deleteReplicas(file, dropped)
+}
+
+// lockUpgradeHandler - handler for client API /lock_upgrade
+// The upgrade request is withdrawn if ctx is done before it is granted.
+func (s *NamingServer) lockUpgradeHandler(ctx context.Context, body LockRequest) (int, any) {
+	var session *Session
+	if body.SessionID != "" {
+		session = s.renewSession(body.SessionID)
+		if session == nil {
+			return http.StatusNotFound, sessionNotFound(body.SessionID)
+		}
+	}
+	if body.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(body.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	opts := contextOptions(ctx)
+	opts.try = body.Try
+	fsItem, err := s.root.UpgradeLock(body.Path, body.owner(), opts)
+	if err != nil {
+		switch err.Type {
+		case LockOwnershipException, LockUnavailableException, DeadlockException, IllegalStateException:
+			return http.StatusConflict, err
+		}
+		return http.StatusNotFound, err
+	}
+	if session != nil {
+		s.removeSessionLock(session, path.Clean(body.Path), true)
+		if !s.addSessionLock(session, path.Clean(body.Path), false) {
+			// the session expired while waiting for the upgrade
+			s.root.UnlockFileOrDirectory(body.Path, false, body.owner())
+			return http.StatusNotFound, sessionNotFound(body.SessionID)
+		}
+	}
+	if file, ok := fsItem.(*FileInfo); ok {
+		s.trackAccess(file, true)
+	}
+	return http.StatusOK, nil
+}
+
+// lockDowngradeHandler - handler for client API /lock_downgrade
+func (s *NamingServer) lockDowngradeHandler(body LockRequest) (int, any) {
+	var session *Session
+	if body.SessionID != "" {
+		session = s.renewSession(body.SessionID)
+		if session == nil {
+			return http.StatusNotFound, sessionNotFound(body.SessionID)
+		}
+	}
+	err := s.root.DowngradeLock(body.Path, body.owner())
+	if err != nil {
+		if err.Type == LockOwnershipException {
+			return http.StatusConflict, err
+		}
+		return http.StatusNotFound, err
+	}
+	if session != nil {
+		s.removeSessionLock(session, path.Clean(body.Path), false)
+		if !s.addSessionLock(session, path.Clean(body.Path), true) {
+			// the session expired in the meantime
+			s.root.UnlockFileOrDirectory(body.Path, true, body.owner())
+			return http.StatusNotFound, sessionNotFound(body.SessionID)
+		}
+	}
 	return http.StatusOK, nil
 }
 
 // unlockHandler - handler for client API /unlock
 func (s *NamingServer) unlockHandler(body LockRequest) (int, any) {
-	err := s.root.UnlockFileOrDirectory(body.Path, !body.Exclusive)
+	var session *Session
+	if body.SessionID != "" {
+		session = s.renewSession(body.SessionID)
+		if session == nil {
+			return http.StatusNotFound, sessionNotFound(body.SessionID)
+		}
+	}
+	err := s.root.UnlockFileOrDirectory(body.Path, !body.Exclusive, body.owner())
 	if err != nil {
+		if err.Type == LockOwnershipException {
+			return http.StatusConflict, err
+		}
 		return http.StatusNotFound, err
 	}
+	if session != nil {
+		s.removeSessionLock(session, path.Clean(body.Path), !body.Exclusive)
+	}
 	return http.StatusOK, nil
 }
 
+// lockTableHandler - handler for admin API /admin/locks
+func (s *NamingServer) lockTableHandler() (int, any) {
+	return http.StatusOK, s.root.LockTable()
+}
+
+// forceUnlockHandler - handler for admin API /admin/release
+// It releases a lock held by any client, as if its holder unlocked it.
+func (s *NamingServer) forceUnlockHandler(body ForceUnlockRequest) (int, any) {
+	err := s.root.UnlockFileOrDirectory(body.Path, !body.Exclusive, body.Holder)
+	if err != nil {
+		if err.Type == LockOwnershipException {
+			return http.StatusConflict, err
+		}
+		return http.StatusNotFound, err
+	}
+	s.forgetSessionLock(body.Holder, path.Clean(body.Path), !body.Exclusive)
+	fmt.Printf("lock on %s held by %q is released by an operator\n", path.Clean(body.Path), body.Holder)
+	return http.StatusOK, SuccessResponse{true}
+}
+
+// storageServersHandler - handler for admin API /admin/storage
+func (s *NamingServer) storageServersHandler() (int, any) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	servers := make([]StorageServerResponse, 0, len(s.storageServers))
+	for _, server := range s.storageServers {
+		state := "alive"
+		if server.state.Load() == serverSuspect {
+			state = "suspect"
+		}
+		var drain *DrainResponse
+		if server.drain != nil {
+			progress := server.drain.response(server)
+			drain = &progress
+		}
+		servers = append(servers, StorageServerResponse{
+			StorageIP:   server.ip,
+			ClientPort:  server.clientPort,
+			CommandPort: server.commandPort,
+			Zone:        server.zone,
+			State:       state,
+			FileCount:   server.fileCount,
+			UsedBytes:   server.usedBytes,
+			TotalBytes:  server.totalBytes,
+			FreeBytes:   server.freeBytes,
+			Drain:       drain,
+		})
+	}
+	placement := s.config.Placement
+	if placement == "" {
+		placement = placeRandom
+	}
+	return http.StatusOK, StorageServersResponse{placement, servers}
+}
+
+// spreadHandler - handler for admin API /admin/spread
+func (s *NamingServer) spreadHandler() (int, any) {
+	return http.StatusOK, s.spreadViolations()
+}
+
+// decommissionHandler - handler for admin API /admin/decommission
+func (s *NamingServer) decommissionHandler(body DecommissionRequest) (int, any) {
+	progress, err := s.decommission(body)
+	if err != nil {
+		if err.Type == IOException {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, progress
+}
+
+// reconcileHandler - handler for admin API /admin/reconcile
+func (s *NamingServer) reconcileHandler() (int, any) {
+	return http.StatusOK, s.reconcileReport()
+}
+
+// commandQueueHandler - handler for admin API /admin/commands
+func (s *NamingServer) commandQueueHandler() (int, any) {
+	return http.StatusOK, s.commands.report()
+}
+
 // handler for registration API
+// s.lock is not held while the files are registered, as registration w-locks the namespace,
+// and other code takes s.lock while holding namespace locks.
 func (s *NamingServer) registerStorageHandler(body RegisterRequest) (int, any) {
 	// check if this storage server is already registered
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	if _, retired := s.decommissioned[storageKey{body.StorageIP, body.ClientPort, body.CommandPort}]; retired {
+		s.lock.Unlock()
+		ex := DFSException{IllegalStateException, "This storage server has been decommissioned."}
+		return http.StatusGone, ex
+	}
+	registered := s.registering[storageKey{body.StorageIP, body.ClientPort, body.CommandPort}]
 	for _, server := range s.storageServers {
-		if server.clientPort == body.ClientPort && server.commandPort == body.CommandPort {
-			// already registered
-			ex := DFSException{IllegalStateException, "This storage server is already registered."}
-			return http.StatusConflict, ex
-		}
+		registered = registered || server.is(body.StorageIP, body.ClientPort, body.CommandPort)
+	}
+	if registered {
+		s.lock.Unlock()
+		ex := DFSException{IllegalStateException, "This storage server is already registered."}
+		return http.StatusConflict, ex
 	}
 	server := &StorageServerInfo{
+		ip:          body.StorageIP,
 		clientPort:  body.ClientPort,
 		commandPort: body.CommandPort,
 	}
-	s.storageServers = append(s.storageServers, server)
+	recovered, wasRecovered := s.recovered[server.key()]
+	if wasRecovered {
+		// take over the files recovered from the journal
+		server = recovered
+		server.state.Store(serverAlive)
+		delete(s.recovered, server.key())
+	}
+	key := server.key()
+	s.registering[key] = true
+	s.lock.Unlock()
+
 	// register all of its files
-	success := s.root.RegisterFiles(body.Files, server)
+	success, _, err := s.root.RegisterFiles(body.Files, body.Sizes, server, func(success []bool, dropped []*FileInfo) *DFSException {
+		records := make([]journalRecord, 0)
+		for i := range success {
+			if pth := path.Clean(body.Files[i]); success[i] && pth != "/" {
+				record := journalRecord{Op: opCreateFile, Path: pth, Server: &key}
+				if i < len(body.Sizes) && body.Sizes[i] > 0 {
+					record.Size = body.Sizes[i]
+				}
+				records = append(records, record)
+			}
+		}
+		for _, file := range dropped {
+			records = append(records, journalRecord{Op: opRemoveReplica, Path: file.getPath(), Server: &key})
+		}
+		return s.journal.commit(records...)
+	})
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.registering, key)
+	if err != nil {
+		// nothing has been registered, the storage server tries again later
+		if wasRecovered {
+			server.state.Store(serverSuspect)
+			s.recovered[key] = server
+		}
+		return http.StatusInternalServerError, err
+	}
+	server.zone = body.Zone
+	server.totalBytes = body.TotalBytes
+	server.freeBytes = body.FreeBytes
+	s.storageServers = append(s.storageServers, server)
 	response := make(map[string][]string)
 	response["files"] = make([]string, 0)
 	for i := range success {
@@ -204,3 +694,92 @@ func (s *NamingServer) registerStorageHandler(body RegisterRequest) (int, any) {
 	}
 	return http.StatusOK, response
 }
+
+// heartbeatHandler - handler for registration API /heartbeat
+func (s *NamingServer) heartbeatHandler(body HeartbeatRequest) (int, any) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, server := range s.storageServers {
+		if server.is(body.StorageIP, body.ClientPort, body.CommandPort) {
+			server.lastHeartbeat = time.Now()
+			server.fileCount = body.FileCount
+			server.usedBytes = body.UsedBytes
+			server.totalBytes = body.TotalBytes
+			server.freeBytes = body.FreeBytes
+			if server.state.Swap(serverAlive) == serverSuspect {
+				fmt.Printf("storage server %v is alive again\n", server)
+			}
+			return http.StatusOK, SuccessResponse{true}
+		}
+	}
+	if _, retired := s.decommissioned[storageKey{body.StorageIP, body.ClientPort, body.CommandPort}]; retired {
+		ex := DFSException{IllegalStateException, "This storage server has been decommissioned."}
+		return http.StatusGone, ex
+	}
+	// unknown or dead server, it has to register again
+	ex := DFSException{IllegalStateException, "This storage server is not registered."}
+	return http.StatusNotFound, ex
+}
+
+// notifyWriteHandler - handler for registration API /notify_write
+func (s *NamingServer) notifyWriteHandler(body WriteNotification) (int, any) {
+	var sender *StorageServerInfo
+	s.lock.RLock()
+	for _, server := range s.storageServers {
+		if server.is(body.StorageIP, body.ClientPort, body.CommandPort) {
+			sender = server
+			break
+		}
+	}
+	s.lock.RUnlock()
+	if sender == nil {
+		ex := DFSException{IllegalStateException, "This storage server is not registered."}
+		return http.StatusNotFound, ex
+	}
+
+	file, ok := s.root.findItem(body.Path).(*FileInfo)
+	if !ok {
+		ex := DFSException{FileNotFoundException, fmt.Sprintf("file %s does not exist.", body.Path)}
+		return http.StatusNotFound, ex
+	}
+	file.rCountMtx.Lock()
+	defer file.rCountMtx.Unlock()
+	isReplica := false
+	for _, server := range file.storageServers {
+		if server == sender {
+			isReplica = true
+			break
+		}
+	}
+	if !isReplica {
+		ex := DFSException{IllegalStateException, "This storage server does not hold the file."}
+		return http.StatusConflict, ex
+	}
+
+	mtime := time.Now()
+	_, err := file.recordWrite(body.Size, mtime, func(version int64) *DFSException {
+		return s.journal.commit(journalRecord{Op: opUpdateFile, Path: file.getPath(), Size: body.Size, Version: version, Time: mtime.UnixNano()})
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(file.storageServers) > 1 {
+		// the other replicas are stale, repair copies the written one once the writer is done
+		s.dropReplicas(file, []*StorageServerInfo{sender})
+		s.triggerRepair()
+	}
+	return http.StatusOK, SuccessResponse{true}
+}
+
+// checkQuotaHandler - handler for registration API /check_quota
+// Storage servers call it before a write grows a file to body.Size bytes.
+func (s *NamingServer) checkQuotaHandler(body WriteNotification) (int, any) {
+	err := s.root.CheckWrite(body.Path, body.Size)
+	if err != nil {
+		if err.Type == QuotaExceededException {
+			return http.StatusConflict, err
+		}
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, SuccessResponse{true}
+}
@@ -0,0 +1,652 @@
+package naming
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	journalFileName  = "journal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// operations recorded in the journal
+const (
+	opMakeDirectory = "mkdir"
+	opCreateFile    = "create"
+	opDeletePath    = "delete"
+	opAddReplica    = "add_replica"
+	opRemoveReplica = "remove_replica"
+	opSetReplicas   = "set_replicas"
+	opSetQuota      = "set_quota"
+	opMovePath      = "move"
+	opUpdateFile    = "update"
+	// a storage server is decommissioned, or may register again
+	opDecommission = "decommission"
+	opReadmit      = "readmit"
+)
+
+// storageKey - identifies a storage server across restarts of the naming server
+type storageKey struct {
+	IP          string `json:"ip,omitempty"`
+	ClientPort  int    `json:"client_port"`
+	CommandPort int    `json:"command_port"`
+}
+
+// withAddress - the key with the address every storage server had before they were
+// identified by address, for keys read from older journals and snapshots
+func (k storageKey) withAddress() storageKey {
+	if k.IP == "" {
+		k.IP = "127.0.0.1"
+	}
+	return k
+}
+
+// journalRecord - one namespace mutation in the write-ahead log
+type journalRecord struct {
+	// log sequence number, assigned by Append, increasing by one from record to record
+	LSN int64 `json:"lsn,omitempty"`
+	// number of records following it that were appended together with it
+	More   int         `json:"more,omitempty"`
+	Op     string      `json:"op"`
+	Path   string      `json:"path"`
+	Server *storageKey `json:"server,omitempty"`
+	// target replica count for opSetReplicas, 0 means inherited
+	Replicas int `json:"replicas,omitempty"`
+	// quotas for opSetQuota, 0 means unlimited
+	MaxBytes   int64 `json:"max_bytes,omitempty"`
+	MaxEntries int64 `json:"max_entries,omitempty"`
+	// destination path for opMovePath
+	NewPath string `json:"new_path,omitempty"`
+	// file size and version for opUpdateFile, size of a registered file for opCreateFile
+	Size    int64 `json:"size,omitempty"`
+	Version int64 `json:"version,omitempty"`
+	// time of the mutation in unix nanoseconds
+	Time int64 `json:"time,omitempty"`
+}
+
+// snapshotDirectory - one directory in a snapshot
+type snapshotDirectory struct {
+	Path  string `json:"path"`
+	Ctime int64  `json:"ctime"`
+	Mtime int64  `json:"mtime"`
+}
+
+// snapshotFile - one file, its metadata and its replicas in a snapshot
+type snapshotFile struct {
+	Path    string       `json:"path"`
+	Servers []storageKey `json:"servers"`
+	Size    int64        `json:"size"`
+	Ctime   int64        `json:"ctime"`
+	Mtime   int64        `json:"mtime"`
+	Version int64        `json:"version"`
+}
+
+// snapshotQuota - the quotas of one directory in a snapshot
+type snapshotQuota struct {
+	MaxBytes   int64 `json:"max_bytes,omitempty"`
+	MaxEntries int64 `json:"max_entries,omitempty"`
+}
+
+// snapshot - compacted image of the namespace
+type snapshot struct {
+	// the last record folded into the snapshot, records up to it are skipped on replay
+	LSN         int64               `json:"lsn,omitempty"`
+	Directories []snapshotDirectory `json:"directories"`
+	Files       []snapshotFile      `json:"files"`
+	// explicit target replica counts of files and directories
+	Replicas map[string]int `json:"replicas,omitempty"`
+	// quotas of directories
+	Quotas map[string]snapshotQuota `json:"quotas,omitempty"`
+	// storage servers that may not register again
+	Decommissioned []storageKey `json:"decommissioned,omitempty"`
+}
+
+// namespaceState - flat view of the namespace used while replaying the journal
+// The root directory is stored as "/".
+type namespaceState struct {
+	directories map[string]*snapshotDirectory
+	files       map[string]*snapshotFile
+	replicas    map[string]int
+	quotas      map[string]snapshotQuota
+	// decommissioned storage servers, which are not part of the namespace but must
+	// be remembered across restarts all the same
+	decommissioned map[storageKey]empty
+}
+
+func newNamespaceState() *namespaceState {
+	st := &namespaceState{
+		directories:    make(map[string]*snapshotDirectory),
+		files:          make(map[string]*snapshotFile),
+		replicas:       make(map[string]int),
+		quotas:         make(map[string]snapshotQuota),
+		decommissioned: make(map[storageKey]empty),
+	}
+	st.directories["/"] = &snapshotDirectory{Path: "/"}
+	return st
+}
+
+// addParents - records every missing ancestor directory of pth
+func (st *namespaceState) addParents(pth string, ctime int64) {
+	for dir := path.Dir(pth); dir != "/"; dir = path.Dir(dir) {
+		if _, exists := st.directories[dir]; !exists {
+			st.directories[dir] = &snapshotDirectory{dir, ctime, ctime}
+		}
+	}
+}
+
+// touchParent - updates the modification time of the parent directory of pth
+func (st *namespaceState) touchParent(pth string, mtime int64) {
+	if dir, exists := st.directories[path.Dir(pth)]; exists && mtime > 0 {
+		dir.Mtime = mtime
+	}
+}
+
+// unixTime - converts a time in the journal to time.Time
+// Records written without a time are restored with the current time.
+func unixTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, nanos)
+}
+
+// movedPath - the new path of pth after moving src to dst
+// The second return value is false if pth is not src or below it.
+func movedPath(pth string, src string, dst string) (string, bool) {
+	if pth == src {
+		return dst, true
+	}
+	if strings.HasPrefix(pth, src+"/") {
+		return dst + strings.TrimPrefix(pth, src), true
+	}
+	return "", false
+}
+
+// apply - replays one journal record on the state
+func (st *namespaceState) apply(record journalRecord) {
+	switch record.Op {
+	case opMakeDirectory:
+		st.addParents(record.Path, record.Time)
+		if _, exists := st.directories[record.Path]; !exists {
+			st.directories[record.Path] = &snapshotDirectory{record.Path, record.Time, record.Time}
+			st.touchParent(record.Path, record.Time)
+		}
+	case opCreateFile:
+		// creating an existing file only adds the replica (re-registration)
+		st.addParents(record.Path, record.Time)
+		if _, exists := st.files[record.Path]; !exists {
+			st.files[record.Path] = &snapshotFile{
+				Path:    record.Path,
+				Servers: make([]storageKey, 0),
+				Size:    record.Size,
+				Ctime:   record.Time,
+				Mtime:   record.Time,
+			}
+			st.touchParent(record.Path, record.Time)
+		}
+		st.apply(journalRecord{Op: opAddReplica, Path: record.Path, Server: record.Server})
+	case opDeletePath:
+		if _, exists := st.files[record.Path]; exists {
+			// nothing below a file
+			delete(st.files, record.Path)
+			delete(st.replicas, record.Path)
+			st.touchParent(record.Path, record.Time)
+			return
+		}
+		prefix := record.Path + "/"
+		delete(st.directories, record.Path)
+		delete(st.files, record.Path)
+		delete(st.replicas, record.Path)
+		for item := range st.replicas {
+			if strings.HasPrefix(item, prefix) {
+				delete(st.replicas, item)
+			}
+		}
+		delete(st.quotas, record.Path)
+		for dir := range st.quotas {
+			if strings.HasPrefix(dir, prefix) {
+				delete(st.quotas, dir)
+			}
+		}
+		for dir := range st.directories {
+			if strings.HasPrefix(dir, prefix) {
+				delete(st.directories, dir)
+			}
+		}
+		for file := range st.files {
+			if strings.HasPrefix(file, prefix) {
+				delete(st.files, file)
+			}
+		}
+		st.touchParent(record.Path, record.Time)
+	case opAddReplica:
+		file, exists := st.files[record.Path]
+		if !exists || record.Server == nil {
+			return
+		}
+		for _, server := range file.Servers {
+			if server == *record.Server {
+				return
+			}
+		}
+		file.Servers = append(file.Servers, *record.Server)
+	case opRemoveReplica:
+		file, exists := st.files[record.Path]
+		if !exists || record.Server == nil {
+			return
+		}
+		kept := make([]storageKey, 0, len(file.Servers))
+		for _, server := range file.Servers {
+			if server != *record.Server {
+				kept = append(kept, server)
+			}
+		}
+		file.Servers = kept
+	case opMovePath:
+		st.addParents(record.NewPath, record.Time)
+		if file, exists := st.files[record.Path]; exists {
+			// nothing below a file
+			delete(st.files, record.Path)
+			file.Path = record.NewPath
+			st.files[file.Path] = file
+			if replicas, exists := st.replicas[record.Path]; exists {
+				delete(st.replicas, record.Path)
+				st.replicas[record.NewPath] = replicas
+			}
+			st.touchParent(record.Path, record.Time)
+			st.touchParent(record.NewPath, record.Time)
+			return
+		}
+		// collect moved entries first, so they are not visited twice
+		movedDirs := make([]*snapshotDirectory, 0)
+		for pth, dir := range st.directories {
+			if newPath, moved := movedPath(pth, record.Path, record.NewPath); moved {
+				delete(st.directories, pth)
+				dir.Path = newPath
+				movedDirs = append(movedDirs, dir)
+			}
+		}
+		movedFiles := make([]*snapshotFile, 0)
+		for pth, file := range st.files {
+			if newPath, moved := movedPath(pth, record.Path, record.NewPath); moved {
+				delete(st.files, pth)
+				file.Path = newPath
+				movedFiles = append(movedFiles, file)
+			}
+		}
+		movedReplicas := make(map[string]int)
+		for item, replicas := range st.replicas {
+			if newItem, moved := movedPath(item, record.Path, record.NewPath); moved {
+				delete(st.replicas, item)
+				movedReplicas[newItem] = replicas
+			}
+		}
+		for _, dir := range movedDirs {
+			st.directories[dir.Path] = dir
+		}
+		for _, file := range movedFiles {
+			st.files[file.Path] = file
+		}
+		for item, replicas := range movedReplicas {
+			st.replicas[item] = replicas
+		}
+		movedQuotas := make(map[string]snapshotQuota)
+		for dir, quota := range st.quotas {
+			if newDir, moved := movedPath(dir, record.Path, record.NewPath); moved {
+				delete(st.quotas, dir)
+				movedQuotas[newDir] = quota
+			}
+		}
+		for dir, quota := range movedQuotas {
+			st.quotas[dir] = quota
+		}
+		st.touchParent(record.Path, record.Time)
+		st.touchParent(record.NewPath, record.Time)
+	case opUpdateFile:
+		if file, exists := st.files[record.Path]; exists {
+			file.Size = record.Size
+			file.Version = record.Version
+			file.Mtime = record.Time
+		}
+	case opSetReplicas:
+		if record.Replicas > 0 {
+			st.replicas[record.Path] = record.Replicas
+		} else {
+			delete(st.replicas, record.Path)
+		}
+	case opSetQuota:
+		if record.MaxBytes > 0 || record.MaxEntries > 0 {
+			st.quotas[record.Path] = snapshotQuota{record.MaxBytes, record.MaxEntries}
+		} else {
+			delete(st.quotas, record.Path)
+		}
+	case opDecommission:
+		if record.Server != nil {
+			st.decommissioned[*record.Server] = empty{}
+		}
+	case opReadmit:
+		if record.Server != nil {
+			delete(st.decommissioned, *record.Server)
+		}
+	}
+}
+
+// toSnapshot - converts the state to its on-disk form, sorted by path
+func (st *namespaceState) toSnapshot() snapshot {
+	snap := snapshot{
+		Directories: make([]snapshotDirectory, 0, len(st.directories)),
+		Files:       make([]snapshotFile, 0, len(st.files)),
+	}
+	for _, dir := range st.directories {
+		snap.Directories = append(snap.Directories, *dir)
+	}
+	sort.Slice(snap.Directories, func(i, j int) bool {
+		return snap.Directories[i].Path < snap.Directories[j].Path
+	})
+	for _, file := range st.files {
+		snap.Files = append(snap.Files, *file)
+	}
+	sort.Slice(snap.Files, func(i, j int) bool {
+		return snap.Files[i].Path < snap.Files[j].Path
+	})
+	if len(st.replicas) > 0 {
+		snap.Replicas = st.replicas
+	}
+	if len(st.quotas) > 0 {
+		snap.Quotas = st.quotas
+	}
+	for key := range st.decommissioned {
+		snap.Decommissioned = append(snap.Decommissioned, key)
+	}
+	sort.Slice(snap.Decommissioned, func(i, j int) bool {
+		a, b := snap.Decommissioned[i], snap.Decommissioned[j]
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+		if a.ClientPort != b.ClientPort {
+			return a.ClientPort < b.ClientPort
+		}
+		return a.CommandPort < b.CommandPort
+	})
+	return snap
+}
+
+// Journal - write-ahead log of namespace mutations with periodic snapshots
+// Every record is flushed to disk before Append returns, and a mutation is only
+// applied to the namespace once its records have been appended. After snapshotInterval
+// records the log is compacted into a new snapshot and truncated.
+// The journal keeps its own flat copy of the namespace, updated by every record, from
+// which snapshots are written. A snapshot records the LSN of the last record folded
+// into it, so a log that was not truncated after the snapshot is not replayed twice.
+// A nil *Journal is valid and discards every record.
+type Journal struct {
+	dir              string
+	snapshotInterval int
+	file             *os.File
+	size             int64 // bytes of the log that have been flushed
+	nRecords         int
+	lsn              int64 // LSN of the last record appended
+	state            *namespaceState
+	mtx              sync.Mutex
+}
+
+// openJournal - opens the journal in dir and recovers the namespace stored in it
+// The recovered log is immediately compacted into a fresh snapshot, which also
+// drops a torn record at its end.
+func openJournal(dir string, snapshotInterval int) (*Journal, *namespaceState, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, nil, err
+	}
+	j := &Journal{
+		dir:              dir,
+		snapshotInterval: snapshotInterval,
+	}
+	state, lsn, err := j.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = j.writeSnapshot(state, lsn); err != nil {
+		return nil, nil, err
+	}
+	j.file, err = os.OpenFile(j.journalPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	j.state = state
+	j.lsn = lsn
+	return j, state, nil
+}
+
+func (j *Journal) journalPath() string {
+	return filepath.Join(j.dir, journalFileName)
+}
+
+func (j *Journal) snapshotPath() string {
+	return filepath.Join(j.dir, snapshotFileName)
+}
+
+// load - reads the latest snapshot and replays the log on top of it
+// A torn record at the end of the log (crash during append) is ignored, as its
+// mutation was never acknowledged, and so are the records appended together with it.
+// A record that cannot be parsed anywhere else means the log is corrupted, and loading fails.
+// returns the state and the LSN of the last record in it
+func (j *Journal) load() (*namespaceState, int64, error) {
+	state := newNamespaceState()
+	var lsn int64 = 0
+	data, err := os.ReadFile(j.snapshotPath())
+	if err == nil {
+		var snap snapshot
+		if err = json.Unmarshal(data, &snap); err != nil {
+			return nil, 0, fmt.Errorf("corrupted snapshot %s: %w", j.snapshotPath(), err)
+		}
+		lsn = snap.LSN
+		for i := range snap.Directories {
+			state.directories[snap.Directories[i].Path] = &snap.Directories[i]
+		}
+		for i := range snap.Files {
+			for k, key := range snap.Files[i].Servers {
+				snap.Files[i].Servers[k] = key.withAddress()
+			}
+			state.files[snap.Files[i].Path] = &snap.Files[i]
+		}
+		for item, replicas := range snap.Replicas {
+			state.replicas[item] = replicas
+		}
+		for dir, quota := range snap.Quotas {
+			state.quotas[dir] = quota
+		}
+		for _, key := range snap.Decommissioned {
+			state.decommissioned[key.withAddress()] = empty{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(j.journalPath())
+	if os.IsNotExist(err) {
+		return state, lsn, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	torn := 0 // line of a record that cannot be parsed
+	// records of an append that have been read, but not all of its records yet
+	pending := make([]journalRecord, 0)
+	for scanner.Scan() {
+		line++
+		if torn > 0 {
+			// only the last record may be torn, anything before it was flushed
+			return nil, 0, fmt.Errorf("corrupted journal %s: cannot parse record %d", j.journalPath(), torn)
+		}
+		var record journalRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			torn = line
+			continue
+		}
+		if record.LSN > 0 && record.LSN <= lsn {
+			// already in the snapshot, which was written before the log was truncated
+			continue
+		}
+		if record.Server != nil {
+			key := record.Server.withAddress()
+			record.Server = &key
+		}
+		pending = append(pending, record)
+		if record.More > 0 {
+			continue
+		}
+		for _, record := range pending {
+			state.apply(record)
+			if record.LSN > 0 {
+				lsn = record.LSN
+			}
+		}
+		pending = pending[:0]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot read journal %s: %w", j.journalPath(), err)
+	}
+	if torn > 0 {
+		fmt.Printf("ignoring torn journal record %d\n", torn)
+	}
+	if len(pending) > 0 {
+		fmt.Printf("ignoring %d journal records of an incomplete append\n", len(pending))
+	}
+	return state, lsn, nil
+}
+
+// writeSnapshot - atomically replaces the snapshot on disk with state, which
+// includes every record up to lsn
+func (j *Journal) writeSnapshot(state *namespaceState, lsn int64) error {
+	snap := state.toSnapshot()
+	snap.LSN = lsn
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmpPath := j.snapshotPath() + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, j.snapshotPath()); err != nil {
+		return err
+	}
+	// the rename is only durable once the directory is flushed, the log must not
+	// be truncated before that
+	return syncDir(j.dir)
+}
+
+// syncDir - flushes the entries of directory dir to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// compact - writes the state of the journal to a new snapshot and truncates the log
+// The caller must hold j.mtx.
+func (j *Journal) compact() error {
+	if err := j.writeSnapshot(j.state, j.lsn); err != nil {
+		return err
+	}
+	if err := j.truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	j.nRecords = 0
+	return nil
+}
+
+// Append - durably appends records to the log
+// All records are written and flushed together. If they cannot be, the log is
+// truncated to its previous end, so that a torn write is not followed by later
+// records, and the error is returned: the caller must not apply the mutation.
+func (j *Journal) Append(records ...journalRecord) error {
+	if j == nil || len(records) == 0 {
+		return nil
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	buffer := make([]byte, 0)
+	for i := range records {
+		records[i].LSN = j.lsn + int64(i) + 1
+		records[i].More = len(records) - i - 1
+		data, err := json.Marshal(records[i])
+		if err != nil {
+			return err
+		}
+		buffer = append(buffer, data...)
+		buffer = append(buffer, '\n')
+	}
+	_, err := j.file.Write(buffer)
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		if truncErr := j.truncate(j.size); truncErr != nil {
+			fmt.Printf("cannot truncate torn journal records: %s\n", truncErr.Error())
+		}
+		return fmt.Errorf("cannot write journal: %w", err)
+	}
+	j.size += int64(len(buffer))
+	j.nRecords += len(records)
+	j.lsn += int64(len(records))
+	for _, record := range records {
+		j.state.apply(record)
+	}
+	if j.snapshotInterval > 0 && j.nRecords >= j.snapshotInterval {
+		if err := j.compact(); err != nil {
+			fmt.Printf("journal compaction failed: %s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+// truncate - cuts the log at size bytes and appends from there
+// The caller must hold j.mtx.
+func (j *Journal) truncate(size int64) error {
+	if err := j.file.Truncate(size); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(size, 0)
+	return err
+}
+
+// commit - appends records for a mutation requested by a client
+// returns the error to send to the client if the records cannot be appended
+func (j *Journal) commit(records ...journalRecord) *DFSException {
+	if err := j.Append(records...); err != nil {
+		fmt.Println(err.Error())
+		return &DFSException{IOException, err.Error()}
+	}
+	return nil
+}
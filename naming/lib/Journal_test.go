@@ -0,0 +1,165 @@
+package naming
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testJournal - opens the journal in dir, and closes it when the test ends
+func testJournal(t *testing.T, dir string, snapshotInterval int) (*Journal, *namespaceState) {
+	t.Helper()
+	j, state, err := openJournal(dir, snapshotInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.file.Close() })
+	return j, state
+}
+
+// writeLog - writes one journal record per line, each marshalled unless it is a string
+func writeLog(t *testing.T, dir string, records ...any) {
+	t.Helper()
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		if line, ok := record.(string); ok {
+			lines = append(lines, line)
+			continue
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(data)+"\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, journalFileName), []byte(strings.Join(lines, "")), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestSnapshot - writes a snapshot of the directories in paths, up to lsn
+func writeTestSnapshot(t *testing.T, dir string, lsn int64, paths ...string) {
+	t.Helper()
+	snap := snapshot{LSN: lsn, Directories: []snapshotDirectory{{Path: "/"}}, Files: []snapshotFile{}}
+	for _, pth := range paths {
+		snap.Directories = append(snap.Directories, snapshotDirectory{Path: pth})
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, snapshotFileName), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// directoryPaths - the sorted paths of the directories in state, without the root
+func directoryPaths(state *namespaceState) []string {
+	paths := make([]string, 0, len(state.directories))
+	for pth := range state.directories {
+		if pth != "/" {
+			paths = append(paths, pth)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestJournalReplay(t *testing.T) {
+	mkdir := func(lsn int64, more int, pth string) journalRecord {
+		return journalRecord{LSN: lsn, More: more, Op: opMakeDirectory, Path: pth}
+	}
+	tests := []struct {
+		name     string
+		snapshot []string // directories in the snapshot, which is up to LSN 2
+		log      []any
+		expected string // directories after replay
+	}{
+		{"snapshot and log", []string{"/a"}, []any{mkdir(3, 0, "/b"), mkdir(4, 0, "/c")}, "/a /b /c"},
+		{"records in the snapshot are skipped", []string{"/a"}, []any{mkdir(1, 0, "/x"), mkdir(2, 0, "/y"), mkdir(3, 0, "/b")}, "/a /b"},
+		{"torn record at the end", nil, []any{mkdir(3, 0, "/b"), `{"lsn":4,"op":"mk`}, "/b"},
+		{"incomplete append at the end", nil, []any{mkdir(3, 0, "/b"), mkdir(4, 1, "/c")}, "/b"},
+		{"torn record of an append", nil, []any{mkdir(3, 1, "/b"), `{"lsn":4,"op":"mk`}, ""},
+		{"complete append", nil, []any{mkdir(3, 2, "/b"), mkdir(4, 1, "/b/c"), mkdir(5, 0, "/d")}, "/b /b/c /d"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestSnapshot(t, dir, 2, test.snapshot...)
+			writeLog(t, dir, test.log...)
+			j, state := testJournal(t, dir, 0)
+			if paths := strings.Join(directoryPaths(state), " "); paths != test.expected {
+				t.Fatalf("recovered directories %q, expected %q", paths, test.expected)
+			}
+
+			// the recovered state is compacted, and later records are not skipped
+			if err := j.Append(journalRecord{Op: opMakeDirectory, Path: "/z"}); err != nil {
+				t.Fatal(err)
+			}
+			j.file.Close()
+			_, reopened := testJournal(t, dir, 0)
+			expected := strings.TrimSpace(test.expected + " /z")
+			if paths := strings.Join(directoryPaths(reopened), " "); paths != expected {
+				t.Fatalf("reopened directories %q, expected %q", paths, expected)
+			}
+		})
+	}
+}
+
+func TestJournalCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	writeLog(t, dir,
+		journalRecord{LSN: 1, Op: opMakeDirectory, Path: "/a"},
+		"{\"lsn\":2,\"op\":\"mk\n",
+		journalRecord{LSN: 3, Op: opMakeDirectory, Path: "/b"},
+	)
+	if _, _, err := openJournal(dir, 0); err == nil {
+		t.Fatal("journal corrupted before its last record is loaded")
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir := t.TempDir()
+	key := storageKey{IP: "127.0.0.1", ClientPort: 9001, CommandPort: 9002}
+	j, _ := testJournal(t, dir, 3)
+	records := []journalRecord{
+		{Op: opMakeDirectory, Path: "/a"},
+		{Op: opCreateFile, Path: "/a/f", Server: &key, Size: 5},
+		{Op: opSetReplicas, Path: "/a", Replicas: 2},
+		{Op: opMakeDirectory, Path: "/b"},
+	}
+	for _, record := range records {
+		if err := j.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first three records are folded into the snapshot, the last one is in the log
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.LSN != 3 || len(snap.Files) != 1 || snap.Replicas["/a"] != 2 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	if j.nRecords != 1 || j.lsn != 4 {
+		t.Fatalf("%d records in the log up to LSN %d, expected 1 up to LSN 4", j.nRecords, j.lsn)
+	}
+
+	j.file.Close()
+	_, state := testJournal(t, dir, 3)
+	if paths := strings.Join(directoryPaths(state), " "); paths != "/a /b" {
+		t.Fatalf("recovered directories %q", paths)
+	}
+	file, exists := state.files["/a/f"]
+	if !exists || file.Size != 5 || len(file.Servers) != 1 || file.Servers[0] != key {
+		t.Fatalf("recovered file %+v", file)
+	}
+}
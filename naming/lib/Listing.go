@@ -0,0 +1,140 @@
+package naming
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sort orders of directory listings
+const (
+	sortByName  = "name"
+	sortByMtime = "mtime"
+	sortBySize  = "size"
+)
+
+// listEntry - one entry of a directory listing
+type listEntry struct {
+	name string
+	key  int64 // mtime or size, depending on the sort order
+	item FSItem
+}
+
+// less - whether e comes before other, ties of the key are broken by name
+func (e listEntry) less(other listEntry) bool {
+	if e.key != other.key {
+		return e.key < other.key
+	}
+	return e.name < other.name
+}
+
+// sortKey - returns the key of a file or directory in sort order by
+// Directories have size 0.
+func sortKey(item FSItem, by string) int64 {
+	switch item := item.(type) {
+	case *Directory:
+		if by == sortByMtime {
+			return item.mtime.Load()
+		}
+	case *FileInfo:
+		item.metaMtx.Lock()
+		defer item.metaMtx.Unlock()
+		switch by {
+		case sortByMtime:
+			return item.mtime.UnixNano()
+		case sortBySize:
+			return item.size
+		}
+	}
+	return 0
+}
+
+// continuationToken - the cursor pointing after an entry
+// It is the name of the entry if sorted by name, or "<key>/<name>" otherwise.
+// Names never contain '/', so the token can always be split back.
+func continuationToken(entry listEntry, by string) string {
+	if by == sortByName {
+		return entry.name
+	}
+	return fmt.Sprintf("%d/%s", entry.key, entry.name)
+}
+
+// parseCursor - parses a continuation token of sort order by
+func parseCursor(token string, by string) (listEntry, *DFSException) {
+	if by == sortByName {
+		return listEntry{name: token}, nil
+	}
+	key, name, found := strings.Cut(token, "/")
+	if !found {
+		return listEntry{}, &DFSException{IllegalArgumentException, fmt.Sprintf("invalid cursor %s for sort order %s.", token, by)}
+	}
+	k, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return listEntry{}, &DFSException{IllegalArgumentException, fmt.Sprintf("invalid cursor %s for sort order %s.", token, by)}
+	}
+	return listEntry{name: name, key: k}, nil
+}
+
+// ListDirPage - lists at most limit files and directories in a directory, like ListDir
+// The entries are sorted as specified in by, which defaults to name, and the page
+// starts after the cursor startAfter if it is not empty. A limit of 0 means no limit.
+// The second return value is the cursor of the next page, empty if this is the last one.
+// Assumes the client has r-lock of the directory
+func (d *Directory) ListDirPage(pth string, by string, startAfter string, limit int) ([]FSItem, string, *DFSException) {
+	if by == "" {
+		by = sortByName
+	}
+	if by != sortByName && by != sortByMtime && by != sortBySize {
+		return nil, "", &DFSException{IllegalArgumentException, fmt.Sprintf("unknown sort order %s.", by)}
+	}
+	if limit < 0 {
+		return nil, "", &DFSException{IllegalArgumentException, "the limit cannot be negative."}
+	}
+	names := pathToNames(pth)
+	if len(names) == 0 {
+		return nil, "", &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+	}
+	dir := d.walkPath(names) // directory to be listed
+	if dir == nil {
+		return nil, "", &DFSException{FileNotFoundException, fmt.Sprintf("Cannot find directory %s.", pth)}
+	}
+
+	itemNames := dir.sortedEntries()
+	entries := make([]listEntry, 0, len(itemNames))
+	for _, name := range itemNames {
+		item := dir.entry(name)
+		entries = append(entries, listEntry{name, sortKey(item, by), item})
+	}
+	if by != sortByName {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].key < entries[j].key
+		})
+	}
+
+	// skip the entries up to the cursor
+	start := 0
+	if startAfter != "" {
+		cursor, err := parseCursor(startAfter, by)
+		if err != nil {
+			return nil, "", err
+		}
+		start = sort.Search(len(entries), func(i int) bool {
+			return cursor.less(entries[i])
+		})
+	}
+	end := len(entries)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	items := make([]FSItem, 0, end-start)
+	for _, entry := range entries[start:end] {
+		items = append(items, entry.item)
+	}
+	next := ""
+	if end < len(entries) {
+		next = continuationToken(entries[end-1], by)
+	}
+	return items, next, nil
+}
@@ -0,0 +1,143 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newListingRoot - a namespace with /d holding files a, b and c, and directory e
+// Sizes are a 30, b 10, c 10, e 0. Files are modified in the order b, c, a, long before e.
+func newListingRoot(t *testing.T) *Directory {
+	t.Helper()
+	root := newTestRoot()
+	if _, err := root.MakeDirectory("/d", nil); err != nil {
+		t.Fatal(err.Msg)
+	}
+	files := []struct {
+		name  string
+		size  int64
+		mtime int64
+	}{{"a", 30, 3}, {"b", 10, 1}, {"c", 10, 2}}
+	for _, f := range files {
+		file, err := root.CreateFile("/d/"+f.name, nil, nil)
+		if err != nil {
+			t.Fatal(err.Msg)
+		}
+		file.recordWrite(f.size, time.Unix(f.mtime, 0), func(version int64) *DFSException { return nil })
+	}
+	if _, err := root.MakeDirectory("/d/e", nil); err != nil {
+		t.Fatal(err.Msg)
+	}
+	return root
+}
+
+// listPages - lists /d page by page, returns the names of every page
+func listPages(t *testing.T, root *Directory, by string, limit int) []string {
+	t.Helper()
+	pages := make([]string, 0)
+	cursor := ""
+	for {
+		items, next, err := root.ListDirPage("/d", by, cursor, limit)
+		if err != nil {
+			t.Fatal(err.Msg)
+		}
+		names := make([]string, 0, len(items))
+		for _, item := range items {
+			names = append(names, nameOf(item))
+		}
+		pages = append(pages, strings.Join(names, " "))
+		if next == "" {
+			return pages
+		}
+		if len(pages) > 10 {
+			t.Fatalf("pages do not end: %v", pages)
+		}
+		cursor = next
+	}
+}
+
+func TestListDirPage(t *testing.T) {
+	tests := []struct {
+		by    string
+		limit int
+		pages []string
+	}{
+		{"", 0, []string{"a b c e"}},
+		{sortByName, 2, []string{"a b", "c e"}},
+		{sortByName, 3, []string{"a b c", "e"}},
+		{sortByName, 4, []string{"a b c e"}},
+		{sortBySize, 2, []string{"e b", "c a"}},
+		// ties of the size are broken by name across pages
+		{sortBySize, 1, []string{"e", "b", "c", "a"}},
+		{sortByMtime, 3, []string{"b c a", "e"}},
+	}
+	root := newListingRoot(t)
+	for _, test := range tests {
+		pages := listPages(t, root, test.by, test.limit)
+		if strings.Join(pages, " | ") != strings.Join(test.pages, " | ") {
+			t.Errorf("sort %q, limit %d: pages %q, expected %q", test.by, test.limit, pages, test.pages)
+		}
+	}
+}
+
+// TestListDirPageCursorChanges - a cursor stays valid when entries around it change
+func TestListDirPageCursorChanges(t *testing.T) {
+	tests := []struct {
+		by     string
+		change func(root *Directory)
+		second string
+	}{
+		// the entry the cursor points after is deleted
+		{sortByName, func(root *Directory) { root.DeletePath("/d/b", nil) }, "c e"},
+		{sortBySize, func(root *Directory) { root.DeletePath("/d/b", nil) }, "c a"},
+		// an entry is created before the cursor, and another one after it
+		{sortByName, func(root *Directory) {
+			root.CreateFile("/d/0", nil, nil)
+			root.CreateFile("/d/bb", nil, nil)
+		}, "bb c"},
+	}
+	for _, test := range tests {
+		root := newListingRoot(t)
+		_, cursor, err := root.ListDirPage("/d", test.by, "", 2)
+		if err != nil {
+			t.Fatal(err.Msg)
+		}
+		test.change(root)
+		items, _, err := root.ListDirPage("/d", test.by, cursor, 2)
+		if err != nil {
+			t.Fatal(err.Msg)
+		}
+		names := make([]string, 0, len(items))
+		for _, item := range items {
+			names = append(names, nameOf(item))
+		}
+		if page := strings.Join(names, " "); page != test.second {
+			t.Errorf("sort %q after cursor %q: page %q, expected %q", test.by, cursor, page, test.second)
+		}
+	}
+}
+
+func TestListDirPageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		pth    string
+		by     string
+		cursor string
+		limit  int
+		err    string
+	}{
+		{"unknown sort order", "/d", "ctime", "", 0, IllegalArgumentException},
+		{"negative limit", "/d", sortByName, "", -1, IllegalArgumentException},
+		{"cursor without key", "/d", sortBySize, "a", 0, IllegalArgumentException},
+		{"cursor with invalid key", "/d", sortByMtime, "x/a", 0, IllegalArgumentException},
+		{"missing directory", "/x", sortByName, "", 0, FileNotFoundException},
+		{"illegal path", "d", sortByName, "", 0, IllegalArgumentException},
+	}
+	root := newListingRoot(t)
+	for _, test := range tests {
+		if _, _, err := root.ListDirPage(test.pth, test.by, test.cursor, test.limit); err == nil || err.Type != test.err {
+			t.Errorf("%s: error %v, expected %s", test.name, err, test.err)
+		}
+	}
+}
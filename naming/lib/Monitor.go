@@ -0,0 +1,111 @@
+package naming
+
+import (
+	"fmt"
+	"time"
+)
+
+// liveness states of a storage server
+// A storage server that has never sent a heartbeat stays alive forever.
+const (
+	serverAlive int32 = iota
+	serverSuspect
+	serverDead
+)
+
+// aliveStorageServers - returns registered storage servers that are not suspected, dead
+// or draining, which are the ones new files and replicas can be placed on
+func (s *NamingServer) aliveStorageServers() []*StorageServerInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	servers := make([]*StorageServerInfo, 0, len(s.storageServers))
+	for _, server := range s.storageServers {
+		if server.state.Load() == serverAlive && !server.draining.Load() {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// monitorStorageServers - periodically checks the heartbeats of storage servers
+// Servers silent for SuspectTimeout are suspected: they are no longer chosen for new
+// files or replicas. Servers silent for DeadTimeout are removed from the registry
+// and from the replicas of every file, and so are the storage servers of a recovered
+// namespace that have not registered again DeadTimeout after it was recovered.
+func (s *NamingServer) monitorStorageServers() {
+	interval := s.config.DeadTimeout / 4
+	if s.config.SuspectTimeout > 0 && s.config.SuspectTimeout/2 < interval {
+		interval = s.config.SuspectTimeout / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		dead := make([]*StorageServerInfo, 0)
+		s.lock.Lock()
+		kept := make([]*StorageServerInfo, 0, len(s.storageServers))
+		for _, server := range s.storageServers {
+			if server.lastHeartbeat.IsZero() {
+				kept = append(kept, server)
+				continue
+			}
+			silence := now.Sub(server.lastHeartbeat)
+			if silence >= s.config.DeadTimeout {
+				server.state.Store(serverDead)
+				dead = append(dead, server)
+				continue
+			}
+			if s.config.SuspectTimeout > 0 && silence >= s.config.SuspectTimeout {
+				if server.state.Swap(serverSuspect) == serverAlive {
+					fmt.Printf("storage server %v is suspected to have failed\n", server)
+				}
+			}
+			kept = append(kept, server)
+		}
+		s.storageServers = kept
+		expired := make([]*StorageServerInfo, 0)
+		if !s.restored.IsZero() && now.Sub(s.restored) >= s.config.DeadTimeout {
+			for key, server := range s.recovered {
+				server.state.Store(serverDead)
+				expired = append(expired, server)
+				delete(s.recovered, key)
+			}
+		}
+		s.lock.Unlock()
+
+		for _, server := range dead {
+			fmt.Printf("storage server %v is dead\n", server)
+			s.dropStorageServer(server)
+		}
+		for _, server := range expired {
+			fmt.Printf("storage server %v has not registered again, it is dead\n", server)
+			s.dropStorageServer(server)
+		}
+		if len(dead) > 0 || len(expired) > 0 {
+			s.triggerRepair()
+		}
+	}
+}
+
+// dropStorageServer - removes a dead storage server from the replicas of every file
+func (s *NamingServer) dropStorageServer(server *StorageServerInfo) {
+	key := server.key()
+	records := make([]journalRecord, 0)
+	held := make([]*FileInfo, 0)
+	s.root.forEachFileLocked(func(file *FileInfo) {
+		for _, replica := range file.replicaServers() {
+			if replica == server {
+				records = append(records, journalRecord{Op: opRemoveReplica, Path: file.getPath(), Server: &key})
+				held = append(held, file)
+				break
+			}
+		}
+	})
+	if err := s.journal.Append(records...); err != nil {
+		fmt.Printf("cannot drop storage server %v from the replicas of its files: %s\n", server, err.Error())
+		return
+	}
+	for _, file := range held {
+		file.removeReplica(server)
+	}
+}
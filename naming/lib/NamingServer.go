@@ -3,40 +3,175 @@ package naming
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type StorageServerInfo struct {
+	// address advertised by the server, used by the naming server and clients to reach it
+	ip          string
 	clientPort  int
 	commandPort int
+	// failure domain of the server, e.g. a rack, guarded by NamingServer.lock
+	zone string
+	// liveness state of the server, see Monitor.go
+	state atomic.Int32
+	// the server is being decommissioned, no new files are placed on it
+	draining atomic.Bool
+	// fields guarded by NamingServer.lock
+	lastHeartbeat time.Time
+	fileCount     int
+	usedBytes     int64
+	// capacity of the disk of the server, 0 if it has not been reported
+	totalBytes int64
+	freeBytes  int64
+	// progress of the decommissioning of the server, nil if it was never started
+	drain *drainProgress
+}
+
+// key - identity of the storage server used in the journal
+func (info *StorageServerInfo) key() storageKey {
+	return storageKey{info.ip, info.clientPort, info.commandPort}
+}
+
+// is - whether the storage server is the one at ip with the given ports
+func (info *StorageServerInfo) is(ip string, clientPort int, commandPort int) bool {
+	return info.ip == ip && info.clientPort == clientPort && info.commandPort == commandPort
+}
+
+// commandURL - the URL of a command on the command interface of the storage server
+func (info *StorageServerInfo) commandURL(command string) string {
+	return info.key().commandURL(command)
+}
+
+// String - the client address of the storage server, used in logs
+func (info *StorageServerInfo) String() string {
+	return net.JoinHostPort(info.ip, strconv.Itoa(info.clientPort))
+}
+
+// Config - optional settings of a naming server
+type Config struct {
+	// BindAddress - address the service and registration interfaces listen on,
+	// all addresses if empty
+	BindAddress string
+	// DataDir - directory holding the journal and snapshots of the namespace
+	// The namespace is kept in memory only if DataDir is empty.
+	DataDir string
+	// SnapshotInterval - number of journal records between two snapshots
+	SnapshotInterval int
+	// SuspectTimeout - a storage server is suspected after missing heartbeats for this long
+	SuspectTimeout time.Duration
+	// DeadTimeout - a storage server is declared dead after missing heartbeats for this long
+	// Failure detection is disabled if DeadTimeout is not positive.
+	DeadTimeout time.Duration
+	// DefaultReplicas - target replica count of files without an explicit target
+	DefaultReplicas int
+	// RepairInterval - period of scans for under-replicated files
+	// Re-replication is disabled if RepairInterval is not positive.
+	RepairInterval time.Duration
+	// SessionTimeout - default lease of client sessions
+	// Sessions never expire if SessionTimeout is not positive.
+	SessionTimeout time.Duration
+	// DeadlockInterval - period of scans for deadlocks between client lock requests
+	// Deadlock detection is disabled if DeadlockInterval is not positive.
+	DeadlockInterval time.Duration
+	// Placement - policy choosing the storage servers of new files and replicas,
+	// one of "random", "least-used", "weighted" and "round-robin"
+	// Files are placed at random if Placement is empty.
+	Placement string
+	// RebalanceInterval - period of rounds moving files from the fullest to the emptiest storage servers
+	// Rebalancing is disabled if RebalanceInterval is not positive.
+	RebalanceInterval time.Duration
+	// RebalanceThreshold - storage servers whose utilization is within this fraction of
+	// their capacity from the average utilization are balanced
+	RebalanceThreshold float64
+	// RebalanceBandwidth - bytes per second the rebalancer may copy on average, unlimited if not positive
+	RebalanceBandwidth int64
+	// ReconcileInterval - period of comparisons of the files stored by storage servers with the namespace
+	// Reconciliation is disabled if ReconcileInterval is not positive.
+	ReconcileInterval time.Duration
+	// CommandBackoff - delay before retrying a command that a storage server did not receive,
+	// doubled after every further failure up to CommandMaxBackoff
+	CommandBackoff    time.Duration
+	CommandMaxBackoff time.Duration
+	// CommandAttempts - a command is abandoned after failing this many times, never if not positive
+	CommandAttempts int
+	// OrphanGracePeriod - files stored by a storage server that the namespace does not place on it
+	// are deleted, and replicas it does not store are forgotten, once they have been found for this long
+	OrphanGracePeriod time.Duration
 }
 
 type NamingServer struct {
 	servicePort      int
 	registrationPort int
+	config           Config
 	service          *gin.Engine
 	registration     *gin.Engine
 	root             *Directory
+	journal          *Journal
+	commands         *commandQueue
+	placement        PlacementPolicy
 	// fields that need locking before access
 	storageServers []*StorageServerInfo
+	// storage servers referenced by the recovered namespace that have not registered yet
+	recovered map[storageKey]*StorageServerInfo
+	restored  time.Time // when the namespace was recovered
+	// storage servers whose registration is in progress
+	registering map[storageKey]bool
+	// storage servers that have been decommissioned and may not register again
+	decommissioned map[storageKey]*StorageServerInfo
 	lock           sync.RWMutex
+	// fields used for re-replication
+	repairTrigger chan empty
+	replicasTuned atomic.Bool // any explicit target replica count has been set
+	// last reconciliation of every storage server
+	reconciled   map[storageKey]*reconcileState
+	reconcileMtx sync.Mutex
+	// client sessions by id
+	sessions    map[string]*Session
+	sessionsMtx sync.Mutex
 }
 
 // NewNamingServer - initialize a naming server, register all APIs
-func NewNamingServer(servicePort int, registrationPort int) *NamingServer {
+// If config.DataDir is set, the namespace is recovered from the journal in it.
+func NewNamingServer(servicePort int, registrationPort int, config Config) (*NamingServer, error) {
+	placement, err := newPlacementPolicy(config.Placement)
+	if err != nil {
+		return nil, err
+	}
 	namingServer := NamingServer{
 		servicePort:      servicePort,
 		registrationPort: registrationPort,
-		root: &Directory{
-			name:         "",
-			parent:       nil,
-			lock:         NewFIFORWMutex(),
-			rLockedItems: make(map[string]*RLockedItem),
-			wLockedItems: make(map[string]FSItem),
-		},
-		service:      gin.Default(),
-		registration: gin.Default(),
+		config:           config,
+		placement:        placement,
+		root:             newDirectory("", nil, time.Now()),
+		service:          gin.Default(),
+		registration:     gin.Default(),
+		recovered:        make(map[storageKey]*StorageServerInfo),
+		registering:      make(map[storageKey]bool),
+		decommissioned:   make(map[storageKey]*StorageServerInfo),
+		repairTrigger:    make(chan empty, 1),
+		reconciled:       make(map[storageKey]*reconcileState),
+		sessions:         make(map[string]*Session),
+	}
+	namingServer.root.rLockedItems = make(map[string]*RLockedItem)
+	namingServer.root.wLockedItems = make(map[string]*WLockedItem)
+	namingServer.root.waiters = make(map[*lockWaiter]empty)
+	if config.DataDir != "" {
+		journal, state, err := openJournal(config.DataDir, config.SnapshotInterval)
+		if err != nil {
+			return nil, err
+		}
+		namingServer.journal = journal
+		namingServer.restore(state)
+	}
+	if namingServer.commands, err = openCommandQueue(config); err != nil {
+		return nil, err
 	}
 
 	// register client APIs
@@ -85,8 +220,17 @@ func NewNamingServer(servicePort int, registrationPort int) *NamingServer {
 		statusCode, response := namingServer.createFileHandler(request)
 		ctx.JSON(statusCode, response)
 	})
+	namingServer.service.POST("/rename", func(ctx *gin.Context) {
+		var request RenameRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.renameHandler(request)
+		ctx.JSON(statusCode, response)
+	})
 	namingServer.service.POST("/list", func(ctx *gin.Context) {
-		var request PathRequest
+		var request ListRequest
 		if err := ctx.BindJSON(&request); err != nil {
 			ctx.JSON(http.StatusBadRequest, nil)
 			return
@@ -94,6 +238,42 @@ func NewNamingServer(servicePort int, registrationPort int) *NamingServer {
 		statusCode, response := namingServer.listDirHandler(request)
 		ctx.JSON(statusCode, response)
 	})
+	namingServer.service.POST("/walk", func(ctx *gin.Context) {
+		var request WalkRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.walkHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/glob", func(ctx *gin.Context) {
+		var request GlobRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.globHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/stat", func(ctx *gin.Context) {
+		var request PathRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.statHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/du", func(ctx *gin.Context) {
+		var request PathRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.diskUsageHandler(request)
+		ctx.JSON(statusCode, response)
+	})
 	namingServer.service.POST("/is_directory", func(ctx *gin.Context) {
 		var request PathRequest
 		if err := ctx.BindJSON(&request); err != nil {
@@ -103,13 +283,84 @@ func NewNamingServer(servicePort int, registrationPort int) *NamingServer {
 		statusCode, response := namingServer.isDirectoryHandler(request)
 		ctx.JSON(statusCode, response)
 	})
+	namingServer.service.POST("/set_replication", func(ctx *gin.Context) {
+		var request ReplicationRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.setReplicationHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/set_quota", func(ctx *gin.Context) {
+		var request QuotaRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.setQuotaHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/session/open", func(ctx *gin.Context) {
+		var request SessionRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.openSessionHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/session/keepalive", func(ctx *gin.Context) {
+		var request SessionRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.keepaliveHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/session/close", func(ctx *gin.Context) {
+		var request SessionRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.closeSessionHandler(request)
+		ctx.JSON(statusCode, response)
+	})
 	namingServer.service.POST("/lock", func(ctx *gin.Context) {
 		var request LockRequest
 		if err := ctx.BindJSON(&request); err != nil {
 			ctx.JSON(http.StatusBadRequest, nil)
 			return
 		}
-		statusCode, response := namingServer.lockHandler(request)
+		statusCode, response := namingServer.lockHandler(ctx.Request.Context(), request)
+		if response != nil {
+			ctx.JSON(statusCode, response)
+		} else {
+			ctx.Status(statusCode)
+		}
+	})
+	namingServer.service.POST("/lock_upgrade", func(ctx *gin.Context) {
+		var request LockRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.lockUpgradeHandler(ctx.Request.Context(), request)
+		if response != nil {
+			ctx.JSON(statusCode, response)
+		} else {
+			ctx.Status(statusCode)
+		}
+	})
+	namingServer.service.POST("/lock_downgrade", func(ctx *gin.Context) {
+		var request LockRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.lockDowngradeHandler(request)
 		if response != nil {
 			ctx.JSON(statusCode, response)
 		} else {
@@ -130,6 +381,46 @@ func NewNamingServer(servicePort int, registrationPort int) *NamingServer {
 		}
 	})
 
+	// register admin APIs
+	namingServer.service.GET("/admin/locks", func(ctx *gin.Context) {
+		statusCode, response := namingServer.lockTableHandler()
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/admin/release", func(ctx *gin.Context) {
+		var request ForceUnlockRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.forceUnlockHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.GET("/admin/storage", func(ctx *gin.Context) {
+		statusCode, response := namingServer.storageServersHandler()
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.GET("/admin/spread", func(ctx *gin.Context) {
+		statusCode, response := namingServer.spreadHandler()
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.GET("/admin/reconcile", func(ctx *gin.Context) {
+		statusCode, response := namingServer.reconcileHandler()
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.GET("/admin/commands", func(ctx *gin.Context) {
+		statusCode, response := namingServer.commandQueueHandler()
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.service.POST("/admin/decommission", func(ctx *gin.Context) {
+		var request DecommissionRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.decommissionHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+
 	// register registration API
 	namingServer.registration.POST("/register", func(ctx *gin.Context) {
 		var request RegisterRequest
@@ -140,19 +431,143 @@ func NewNamingServer(servicePort int, registrationPort int) *NamingServer {
 		statusCode, response := namingServer.registerStorageHandler(request)
 		ctx.JSON(statusCode, response)
 	})
-	return &namingServer
+	namingServer.registration.POST("/heartbeat", func(ctx *gin.Context) {
+		var request HeartbeatRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.heartbeatHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.registration.POST("/notify_write", func(ctx *gin.Context) {
+		var request WriteNotification
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.notifyWriteHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	namingServer.registration.POST("/check_quota", func(ctx *gin.Context) {
+		var request WriteNotification
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := namingServer.checkQuotaHandler(request)
+		ctx.JSON(statusCode, response)
+	})
+	return &namingServer, nil
+}
+
+// restore - rebuilds the namespace from a recovered journal state
+// Storage servers holding recovered files are remembered in s.recovered and
+// take over their files again when they register. Until then they are suspected,
+// so clients are sent to registered replicas first.
+func (s *NamingServer) restore(state *namespaceState) {
+	s.restored = time.Now()
+	dirs := make([]string, 0, len(state.directories))
+	for dir := range state.directories {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		s.root.makeDirectories(pathToNames(dir)[1:])
+	}
+	for pth, snapFile := range state.files {
+		names := pathToNames(pth)
+		parent, _ := s.root.makeDirectories(names[1 : len(names)-1])
+		if parent == nil {
+			fmt.Printf("cannot restore file %s: parent directory conflicts with a file\n", pth)
+			continue
+		}
+		file := newFileInfo(names[len(names)-1], pth, parent, unixTime(snapFile.Ctime))
+		file.size = snapFile.Size
+		file.mtime = unixTime(snapFile.Mtime)
+		file.version = snapFile.Version
+		for _, key := range snapFile.Servers {
+			server, exists := s.recovered[key]
+			if !exists {
+				server = &StorageServerInfo{
+					ip:          key.IP,
+					clientPort:  key.ClientPort,
+					commandPort: key.CommandPort,
+				}
+				server.state.Store(serverSuspect)
+				s.recovered[key] = server
+			}
+			file.storageServers = append(file.storageServers, server)
+		}
+		parent.addSubFile(file)
+	}
+	// directory times are restored last, restoring the entries touches them
+	for _, snapDir := range state.directories {
+		dir, ok := s.root.findItem(snapDir.Path).(*Directory)
+		if !ok {
+			continue
+		}
+		if snapDir.Ctime > 0 {
+			dir.ctime = unixTime(snapDir.Ctime)
+		}
+		if snapDir.Mtime > 0 {
+			dir.touch(unixTime(snapDir.Mtime))
+		}
+	}
+	for pth, quota := range state.quotas {
+		if err := s.root.SetQuota(pth, quota.MaxBytes, quota.MaxEntries, nil); err != nil {
+			fmt.Printf("cannot restore quota of %s: %s\n", pth, err.Msg)
+		}
+	}
+	for pth, replicas := range state.replicas {
+		if err := s.root.SetReplicas(pth, replicas, nil); err != nil {
+			fmt.Printf("cannot restore target replica count of %s: %s\n", pth, err.Msg)
+			continue
+		}
+		s.replicasTuned.Store(true)
+	}
+	for key := range state.decommissioned {
+		retired := &StorageServerInfo{
+			ip:          key.IP,
+			clientPort:  key.ClientPort,
+			commandPort: key.CommandPort,
+			// how long draining took is not journaled
+			drain: &drainProgress{state: drainDone, started: s.restored, ended: s.restored},
+		}
+		retired.state.Store(serverDead)
+		s.decommissioned[key] = retired
+	}
 }
 
 // Run - launch the naming server
 // the caller will block until the naming server fails
 func (s *NamingServer) Run() {
+	if s.config.DeadTimeout > 0 {
+		go s.monitorStorageServers()
+	}
+	if s.config.RepairInterval > 0 {
+		go s.repairLoop()
+	}
+	if s.config.SessionTimeout > 0 {
+		go s.expireSessions()
+	}
+	if s.config.DeadlockInterval > 0 {
+		go s.detectDeadlocks()
+	}
+	s.commands.start()
+	if s.config.RebalanceInterval > 0 {
+		go s.rebalanceLoop()
+	}
+	if s.config.ReconcileInterval > 0 {
+		go s.reconcileLoop()
+	}
 	chanErr := make(chan error)
 	go func() {
-		err := s.service.Run(fmt.Sprintf("localhost:%d", s.servicePort))
+		err := s.service.Run(net.JoinHostPort(s.config.BindAddress, strconv.Itoa(s.servicePort)))
 		chanErr <- err
 	}()
 	go func() {
-		err := s.registration.Run(fmt.Sprintf("localhost:%d", s.registrationPort))
+		err := s.registration.Run(net.JoinHostPort(s.config.BindAddress, strconv.Itoa(s.registrationPort)))
 		chanErr <- err
 	}()
 
@@ -0,0 +1,160 @@
+package naming
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// names of placement policies, see Config.Placement
+const (
+	placeRandom     = "random"
+	placeLeastUsed  = "least-used"
+	placeWeighted   = "weighted"
+	placeRoundRobin = "round-robin"
+)
+
+// serverLoad - the usage and capacity of a storage server, as last reported
+// A totalBytes of 0 means the server has not reported its capacity.
+type serverLoad struct {
+	server     *StorageServerInfo
+	fileCount  int
+	usedBytes  int64
+	totalBytes int64
+	freeBytes  int64
+}
+
+// usedFraction - the fraction of the capacity of the server that is in use
+func (l serverLoad) usedFraction() float64 {
+	return 1 - float64(l.freeBytes)/float64(l.totalBytes)
+}
+
+// PlacementPolicy - chooses the storage server holding a new file or a new replica
+type PlacementPolicy interface {
+	// Place - returns one of candidates, which is never empty
+	Place(candidates []serverLoad) *StorageServerInfo
+}
+
+// newPlacementPolicy - returns the placement policy of the given name
+func newPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case "", placeRandom:
+		return randomPlacement{}, nil
+	case placeLeastUsed:
+		return leastUsedPlacement{}, nil
+	case placeWeighted:
+		return weightedPlacement{}, nil
+	case placeRoundRobin:
+		return &roundRobinPlacement{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement policy %s", name)
+}
+
+// withCapacity - returns the candidates that have reported their capacity
+// If none has, e.g. storage servers that do not send heartbeats, all candidates are returned.
+func withCapacity(candidates []serverLoad) []serverLoad {
+	reported := make([]serverLoad, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.totalBytes > 0 {
+			reported = append(reported, candidate)
+		}
+	}
+	if len(reported) == 0 {
+		return candidates
+	}
+	return reported
+}
+
+// randomPlacement - chooses a storage server uniformly at random
+type randomPlacement struct{}
+
+func (randomPlacement) Place(candidates []serverLoad) *StorageServerInfo {
+	return candidates[rand.Intn(len(candidates))].server
+}
+
+// leastUsedPlacement - chooses the storage server with the smallest fraction of its
+// capacity in use, ties are broken at random
+// Without reported capacities, the server storing the fewest bytes is chosen.
+type leastUsedPlacement struct{}
+
+func (leastUsedPlacement) Place(candidates []serverLoad) *StorageServerInfo {
+	candidates = withCapacity(candidates)
+	usage := func(load serverLoad) float64 {
+		if load.totalBytes > 0 {
+			return load.usedFraction()
+		}
+		return float64(load.usedBytes)
+	}
+	best := make([]serverLoad, 0, 1)
+	for _, candidate := range candidates {
+		if len(best) == 0 || usage(candidate) < usage(best[0]) {
+			best = append(best[:0], candidate)
+		} else if usage(candidate) == usage(best[0]) {
+			best = append(best, candidate)
+		}
+	}
+	return randomPlacement{}.Place(best)
+}
+
+// weightedPlacement - chooses a storage server at random, with a probability
+// proportional to its free space
+// Without reported capacities, or if every server is full, it chooses uniformly.
+type weightedPlacement struct{}
+
+func (weightedPlacement) Place(candidates []serverLoad) *StorageServerInfo {
+	candidates = withCapacity(candidates)
+	var total int64 = 0
+	for _, candidate := range candidates {
+		if candidate.totalBytes > 0 && candidate.freeBytes > 0 {
+			total += candidate.freeBytes
+		}
+	}
+	if total == 0 {
+		return randomPlacement{}.Place(candidates)
+	}
+	r := rand.Int63n(total)
+	for _, candidate := range candidates {
+		if candidate.totalBytes > 0 && candidate.freeBytes > 0 {
+			if r < candidate.freeBytes {
+				return candidate.server
+			}
+			r -= candidate.freeBytes
+		}
+	}
+	return candidates[len(candidates)-1].server
+}
+
+// roundRobinPlacement - chooses storage servers in turn, in order of their addresses
+type roundRobinPlacement struct {
+	next atomic.Uint64
+}
+
+func (p *roundRobinPlacement) Place(candidates []serverLoad) *StorageServerInfo {
+	sorted := make([]serverLoad, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].server, sorted[j].server
+		if a.ip != b.ip {
+			return a.ip < b.ip
+		}
+		return a.clientPort < b.clientPort
+	})
+	return sorted[(p.next.Add(1)-1)%uint64(len(sorted))].server
+}
+
+// storageLoads - returns the usage and capacity of the given storage servers
+func (s *NamingServer) storageLoads(servers []*StorageServerInfo) []serverLoad {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	loads := make([]serverLoad, 0, len(servers))
+	for _, server := range servers {
+		loads = append(loads, serverLoad{server, server.fileCount, server.usedBytes, server.totalBytes, server.freeBytes})
+	}
+	return loads
+}
+
+// placeFile - chooses one of the candidates to store a new file or a new replica
+func (s *NamingServer) placeFile(candidates []*StorageServerInfo) *StorageServerInfo {
+	return s.placement.Place(s.storageLoads(candidates))
+}
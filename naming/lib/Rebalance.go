@@ -0,0 +1,207 @@
+package naming
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// rebalanceServer - a storage server taking part in a rebalancing round
+type rebalanceServer struct {
+	server     *StorageServerInfo
+	zone       string
+	totalBytes int64
+	usedBytes  int64       // bytes of the files held by the server, as recorded in the namespace
+	files      []*FileInfo // files held by the server, largest first
+	tried      map[*FileInfo]bool
+}
+
+func (r *rebalanceServer) utilization() float64 {
+	return float64(r.usedBytes) / float64(r.totalBytes)
+}
+
+// rebalanceLoop - periodically moves files from the fullest to the emptiest storage servers
+// Every round may copy as many bytes as RebalanceBandwidth allows over one interval.
+// A round copying more than that, e.g. because of a single large file, is paid for
+// by the next rounds.
+func (s *NamingServer) rebalanceLoop() {
+	ticker := time.NewTicker(s.config.RebalanceInterval)
+	defer ticker.Stop()
+	allowance := int64(-1)
+	if s.config.RebalanceBandwidth > 0 {
+		allowance = int64(float64(s.config.RebalanceBandwidth) * s.config.RebalanceInterval.Seconds())
+	}
+	var budget int64 = 0
+	for range ticker.C {
+		if allowance < 0 {
+			s.rebalance(-1)
+			continue
+		}
+		budget += allowance
+		if budget > allowance {
+			budget = allowance
+		}
+		if budget > 0 {
+			budget -= s.rebalance(budget)
+		}
+	}
+}
+
+// rebalance - moves files from storage servers whose utilization is more than
+// RebalanceThreshold above the average to those more than RebalanceThreshold below it
+// Utilization is the fraction of the capacity of a server taken by the files it holds,
+// so only healthy servers that have reported their capacity take part. The largest file
+// that fits is moved first, and no file is moved once budget bytes have been copied,
+// unless budget is negative.
+// returns the number of bytes copied
+func (s *NamingServer) rebalance(budget int64) int64 {
+	servers := make(map[*StorageServerInfo]*rebalanceServer)
+	for _, load := range s.storageLoads(s.aliveStorageServers()) {
+		if load.totalBytes > 0 {
+			servers[load.server] = &rebalanceServer{server: load.server, totalBytes: load.totalBytes, tried: make(map[*FileInfo]bool)}
+		}
+	}
+	if len(servers) < 2 {
+		return 0
+	}
+	s.lock.RLock()
+	zones := make(map[*StorageServerInfo]string, len(s.storageServers))
+	for _, server := range s.storageServers {
+		zones[server] = server.zone
+	}
+	s.lock.RUnlock()
+
+	sizes := make(map[*FileInfo]int64)
+	s.root.forEachFileLocked(func(file *FileInfo) {
+		file.metaMtx.Lock()
+		size := file.size
+		file.metaMtx.Unlock()
+		sizes[file] = size
+		for _, replica := range file.replicaServers() {
+			if server, exists := servers[replica]; exists {
+				server.usedBytes += size
+				server.files = append(server.files, file)
+			}
+		}
+	})
+	var usedBytes, totalBytes int64 = 0, 0
+	for _, server := range servers {
+		server.zone = zones[server.server]
+		usedBytes += server.usedBytes
+		totalBytes += server.totalBytes
+		sort.Slice(server.files, func(i, j int) bool {
+			return sizes[server.files[i]] > sizes[server.files[j]]
+		})
+	}
+	average := float64(usedBytes) / float64(totalBytes)
+
+	var copied int64 = 0
+	for budget < 0 || copied < budget {
+		var src, dst *rebalanceServer
+		for _, server := range servers {
+			if src == nil || server.utilization() > src.utilization() {
+				src = server
+			}
+			if dst == nil || server.utilization() < dst.utilization() {
+				dst = server
+			}
+		}
+		if src == dst || src.utilization()-average <= s.config.RebalanceThreshold && average-dst.utilization() <= s.config.RebalanceThreshold {
+			break
+		}
+		// move no more than brings either server to the average, rounded as utilizations are inexact
+		limit := int64(math.Round((src.utilization() - average) * float64(src.totalBytes)))
+		if deficit := int64(math.Round((average - dst.utilization()) * float64(dst.totalBytes))); deficit < limit {
+			limit = deficit
+		}
+		file := s.rebalanceCandidate(src, dst, sizes, zones, limit)
+		if file == nil {
+			// nothing on src fits on dst, leave src alone for this round
+			delete(servers, src.server)
+			if len(servers) < 2 {
+				break
+			}
+			continue
+		}
+		src.tried[file] = true
+		if !s.moveFile(file.getPath(), src.server, dst.server) {
+			continue
+		}
+		size := sizes[file]
+		src.usedBytes -= size
+		dst.usedBytes += size
+		copied += size
+		fmt.Printf("rebalancer moved file %s (%d bytes) from storage server %v to %v\n", file.getPath(), size, src.server, dst.server)
+	}
+	return copied
+}
+
+// rebalanceCandidate - returns the largest file held by src, not larger than limit, that
+// may be moved to dst, or nil if there is none
+// A file is not moved to a server already holding it, nor to a zone that holds another
+// of its replicas, so that moving never reduces the spread of its replicas.
+func (s *NamingServer) rebalanceCandidate(src *rebalanceServer, dst *rebalanceServer, sizes map[*FileInfo]int64, zones map[*StorageServerInfo]string, limit int64) *FileInfo {
+	for _, file := range src.files {
+		if src.tried[file] || sizes[file] <= 0 || sizes[file] > limit {
+			continue
+		}
+		movable := true
+		for _, replica := range file.replicaServers() {
+			if replica == dst.server || (replica != src.server && zones[replica] == dst.zone && dst.zone != src.zone) {
+				movable = false
+				break
+			}
+		}
+		if movable {
+			return file
+		}
+	}
+	return nil
+}
+
+// moveFile - copies a file from src to dst, then deletes it from src
+// The file is w-locked while it is moved, so no client can access it concurrently.
+// A file that is locked is skipped instead of waited for.
+// returns whether the file has been moved
+func (s *NamingServer) moveFile(pth string, src *StorageServerInfo, dst *StorageServerInfo) bool {
+	file := s.root.tryWLockFile(pth)
+	if file == nil {
+		// deleted or in use
+		return false
+	}
+	defer s.root.wUnlockFile(file)
+	file.rCountMtx.Lock()
+	defer file.rCountMtx.Unlock()
+
+	if file.involves(dst) || !file.hasReplica(src) {
+		// replicated or removed in the meantime
+		return false
+	}
+	// file.rCountMtx is released during the copy
+	if !s.copyReplica(file, dst, src) {
+		return false
+	}
+	idx := -1
+	for i, replica := range file.storageServers {
+		if replica == src {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		// removed during the copy, the copy is an orphan, which reconciliation deletes
+		return false
+	}
+	dstKey, srcKey := dst.key(), src.key()
+	if err := s.journal.Append(
+		journalRecord{Op: opAddReplica, Path: file.getPath(), Server: &dstKey},
+		journalRecord{Op: opRemoveReplica, Path: file.getPath(), Server: &srcKey},
+	); err != nil {
+		// the copy is an orphan, which reconciliation deletes
+		fmt.Printf("cannot move file %s: %s\n", file.getPath(), err.Error())
+		return false
+	}
+	file.storageServers[idx] = dst
+	s.deleteReplicas(file, []*StorageServerInfo{src})
+	return true
+}
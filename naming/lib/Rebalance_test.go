@@ -0,0 +1,85 @@
+package naming
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRebalance(t *testing.T) {
+	type holding struct {
+		total int64
+		files map[string]int64
+	}
+	tests := []struct {
+		name      string
+		a, b      holding
+		shared    string // a file of a that b holds a replica of as well
+		threshold float64
+		budget    int64
+		copied    int64
+		expected  string // files of a | files of b after the round
+		counted   bool   // expected holds the number of files only, as files of equal size are moved in any order
+	}{
+		{"balanced within the threshold",
+			holding{1000, map[string]int64{"/1": 100, "/2": 100}}, holding{1000, map[string]int64{"/3": 100}}, "",
+			0.1, -1, 0, "/1 /2 | /3", false},
+		{"largest file that fits is moved first",
+			holding{1000, map[string]int64{"/1": 300, "/2": 200, "/3": 100}}, holding{1000, nil}, "",
+			0.1, -1, 300, "/2 /3 | /1", false},
+		{"unlimited budget moves until balanced",
+			holding{1000, map[string]int64{"/1": 100, "/2": 100, "/3": 100, "/4": 100}}, holding{1000, nil}, "",
+			0, -1, 200, "2 | 2", true},
+		{"budget stops the round",
+			holding{1000, map[string]int64{"/1": 100, "/2": 100, "/3": 100, "/4": 100}}, holding{1000, nil}, "",
+			0, 100, 100, "3 | 1", true},
+		{"a file larger than the imbalance stays",
+			holding{1000, map[string]int64{"/1": 500}}, holding{1000, nil}, "",
+			0.1, -1, 0, "/1 | ", false},
+		{"a file already on the emptiest server stays",
+			holding{1000, map[string]int64{"/1": 200, "/2": 100}}, holding{4000, nil}, "/1",
+			0, -1, 100, "/1 | /1 /2", false},
+		{"servers without capacity are ignored",
+			holding{1000, map[string]int64{"/1": 300}}, holding{0, nil}, "",
+			0, -1, 0, "/1 | ", false},
+	}
+	ok := func(pth string, attempt int) int { return http.StatusOK }
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testNamingServer(t, t.TempDir())
+			s.config.RebalanceThreshold = test.threshold
+			servers := make([]*StorageServerInfo, 0, 2)
+			for _, held := range []holding{test.a, test.b} {
+				body := RegisterRequest{TotalBytes: held.total}
+				for pth, size := range held.files {
+					body.Files = append(body.Files, pth)
+					body.Sizes = append(body.Sizes, size)
+				}
+				servers = append(servers, registerFakeWith(t, s, newFakeStorage(t, ok), body))
+			}
+			if test.shared != "" {
+				file := s.root.findItem(test.shared).(*FileInfo)
+				file.rCountMtx.Lock()
+				file.storageServers = append(file.storageServers, servers[1])
+				file.rCountMtx.Unlock()
+			}
+
+			if copied := s.rebalance(test.budget); copied != test.copied {
+				t.Fatalf("copied %d bytes, expected %d", copied, test.copied)
+			}
+			held := make([]string, 0, 2)
+			for _, server := range servers {
+				paths := replicaPaths(s, server)
+				if test.counted {
+					held = append(held, fmt.Sprint(len(paths)))
+				} else {
+					held = append(held, strings.Join(paths, " "))
+				}
+			}
+			if files := strings.Join(held, " | "); files != test.expected {
+				t.Fatalf("files %q after rebalancing, expected %q", files, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package naming
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// reconcileEntry - a file found by reconciliation, and when it was first found
+type reconcileEntry struct {
+	since time.Time
+	size  int64
+	// version of the file when its size was found to differ, for resized files
+	version int64
+}
+
+// reconcileState - discrepancies between the files stored by a storage server and the namespace
+type reconcileState struct {
+	checkedAt time.Time
+	err       string
+	files     int // files listed by the storage server
+	// files stored by the server that the namespace does not place on it
+	orphans map[string]reconcileEntry
+	// files the namespace places on the server that it does not store
+	missing map[string]reconcileEntry
+	// files whose first replica is on the server, and whose size differs from the stored one
+	resized map[string]reconcileEntry
+	// totals since the server registered
+	deletedOrphans  int
+	removedReplicas int
+	correctedSizes  int
+}
+
+// reconcileLoop - periodically compares the files stored by every storage server with the namespace
+func (s *NamingServer) reconcileLoop() {
+	ticker := time.NewTicker(s.config.ReconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reconcile()
+	}
+}
+
+// reconcile - compares the files stored by every healthy storage server with the namespace
+// Files and replicas are only acted upon once they have been found for OrphanGracePeriod,
+// so that files being created, copied or renamed are left alone.
+func (s *NamingServer) reconcile() {
+	s.lock.RLock()
+	registered := make(map[storageKey]bool, len(s.storageServers))
+	servers := make([]*StorageServerInfo, 0, len(s.storageServers))
+	for _, server := range s.storageServers {
+		registered[server.key()] = true
+		if server.state.Load() == serverAlive {
+			servers = append(servers, server)
+		}
+	}
+	s.lock.RUnlock()
+	s.reconcileMtx.Lock()
+	for key := range s.reconciled {
+		if !registered[key] {
+			delete(s.reconciled, key)
+		}
+	}
+	s.reconcileMtx.Unlock()
+
+	for _, server := range servers {
+		s.reconcileServer(server)
+	}
+}
+
+// reconcileServer - deletes the orphans of a storage server, removes it from the
+// replicas of the files it has lost, and corrects the sizes of the files whose first
+// replica it holds
+// Sizes are only taken from the first replica, so replicas that differ do not make them flap.
+func (s *NamingServer) reconcileServer(server *StorageServerInfo) {
+	s.reconcileMtx.Lock()
+	state, exists := s.reconciled[server.key()]
+	if !exists {
+		state = &reconcileState{orphans: make(map[string]reconcileEntry), missing: make(map[string]reconcileEntry), resized: make(map[string]reconcileEntry)}
+		s.reconciled[server.key()] = state
+	}
+	s.reconcileMtx.Unlock()
+
+	listed, err := s.storageListCommand(server)
+	now := time.Now()
+	if err != nil {
+		fmt.Printf("cannot reconcile storage server %v: %s\n", server, err.Error())
+		s.reconcileMtx.Lock()
+		state.checkedAt = now
+		state.err = err.Error()
+		s.reconcileMtx.Unlock()
+		return
+	}
+	// the namespace is scanned after the listing, so a file created in between is not an orphan
+	held := make(map[string]int64)
+	// versions of the files whose first replica is on the server
+	versions := make(map[string]int64)
+	s.root.forEachFileLocked(func(file *FileInfo) {
+		for i, replica := range file.replicaServers() {
+			if replica == server {
+				file.metaMtx.Lock()
+				held[file.getPath()] = file.size
+				if i == 0 {
+					versions[file.getPath()] = file.version
+				}
+				file.metaMtx.Unlock()
+				break
+			}
+		}
+	})
+
+	// only this goroutine modifies the state, so it may be read without locking
+	orphans := make(map[string]reconcileEntry)
+	resized := make(map[string]reconcileEntry)
+	stored := make(map[string]bool, len(listed))
+	for _, listedFile := range listed {
+		stored[listedFile.Path] = true
+		if size, exists := held[listedFile.Path]; exists {
+			if version, first := versions[listedFile.Path]; first && size != listedFile.Size {
+				// a write in between restarts the grace period
+				entry := reconcileEntry{now, listedFile.Size, version}
+				if previous, exists := state.resized[listedFile.Path]; exists && previous.size == entry.size && previous.version == version {
+					entry.since = previous.since
+				}
+				resized[listedFile.Path] = entry
+			}
+			continue
+		}
+		since := now
+		if previous, exists := state.orphans[listedFile.Path]; exists {
+			since = previous.since
+		}
+		orphans[listedFile.Path] = reconcileEntry{since: since, size: listedFile.Size}
+	}
+	missing := make(map[string]reconcileEntry)
+	for pth, size := range held {
+		if stored[pth] {
+			continue
+		}
+		since := now
+		if previous, exists := state.missing[pth]; exists {
+			since = previous.since
+		}
+		missing[pth] = reconcileEntry{since: since, size: size}
+	}
+
+	deleted, removed, corrected := 0, 0, 0
+	for pth, entry := range orphans {
+		if now.Sub(entry.since) >= s.config.OrphanGracePeriod && s.deleteOrphan(pth, server) {
+			deleted++
+			delete(orphans, pth)
+		}
+	}
+	for pth, entry := range missing {
+		if now.Sub(entry.since) >= s.config.OrphanGracePeriod && s.removeMissingReplica(pth, server) {
+			removed++
+			delete(missing, pth)
+		}
+	}
+	for pth, entry := range resized {
+		if now.Sub(entry.since) >= s.config.OrphanGracePeriod && s.correctSize(pth, server, entry) {
+			corrected++
+			delete(resized, pth)
+		}
+	}
+	if removed > 0 {
+		s.triggerRepair()
+	}
+
+	s.reconcileMtx.Lock()
+	state.checkedAt = now
+	state.err = ""
+	state.files = len(listed)
+	state.orphans = orphans
+	state.missing = missing
+	state.resized = resized
+	state.deletedOrphans += deleted
+	state.removedReplicas += removed
+	state.correctedSizes += corrected
+	s.reconcileMtx.Unlock()
+}
+
+// deleteOrphan - deletes a file from a storage server, unless the server holds a replica of it
+// The file is r-locked if it exists, so it cannot be moved or deleted concurrently, and it
+// is not copied to the server while it is deleted.
+// returns whether the file has been deleted
+func (s *NamingServer) deleteOrphan(pth string, server *StorageServerInfo) bool {
+	if file := s.root.lockFile(pth); file != nil {
+		defer s.root.unlockFile(file)
+		file.rCountMtx.Lock()
+		if file.involves(server) {
+			// replicated, or being copied to the server, in the meantime
+			file.rCountMtx.Unlock()
+			return false
+		}
+		s.deleteReplicas(file, []*StorageServerInfo{server})
+		file.rCountMtx.Unlock()
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go s.storageDeleteCommand(pth, server, &wg)
+		wg.Wait()
+	}
+	fmt.Printf("deleted orphan %s from storage server %v\n", pth, server)
+	return true
+}
+
+// removeMissingReplica - removes a storage server that lost a file from the replicas of the file
+// The last replica of a file is kept, as there is nothing left to repair it from.
+// returns whether the server has been removed
+func (s *NamingServer) removeMissingReplica(pth string, server *StorageServerInfo) bool {
+	file := s.root.lockFile(pth)
+	if file == nil {
+		// deleted in the meantime
+		return false
+	}
+	defer s.root.unlockFile(file)
+	file.rCountMtx.Lock()
+	defer file.rCountMtx.Unlock()
+
+	kept := make([]*StorageServerInfo, 0, len(file.storageServers))
+	for _, replica := range file.storageServers {
+		if replica != server {
+			kept = append(kept, replica)
+		}
+	}
+	if len(kept) == len(file.storageServers) {
+		// removed in the meantime
+		return false
+	}
+	if len(kept) == 0 {
+		fmt.Printf("file %s is missing on storage server %v, which holds its only replica\n", file.getPath(), server)
+		return false
+	}
+	key := server.key()
+	if err := s.journal.Append(journalRecord{Op: opRemoveReplica, Path: file.getPath(), Server: &key}); err != nil {
+		fmt.Printf("cannot remove replica of %s: %s\n", file.getPath(), err.Error())
+		return false
+	}
+	file.storageServers = kept
+	fmt.Printf("file %s is missing on storage server %v, removed from its replicas\n", file.getPath(), server)
+	return true
+}
+
+// correctSize - sets the size of a file to the size stored by its first replica
+// The file is r-locked, so no client writes it concurrently, and it is left alone if it
+// has been written or its first replica has changed since the size was listed.
+// returns whether the size has been corrected
+func (s *NamingServer) correctSize(pth string, server *StorageServerInfo, entry reconcileEntry) bool {
+	file := s.root.lockFile(pth)
+	if file == nil {
+		// deleted in the meantime
+		return false
+	}
+	defer s.root.unlockFile(file)
+	if replicas := file.replicaServers(); len(replicas) == 0 || replicas[0] != server {
+		return false
+	}
+	previous, corrected, err := file.correctSize(entry.size, entry.version, func(mtime time.Time) *DFSException {
+		return s.journal.commit(journalRecord{Op: opUpdateFile, Path: file.getPath(), Size: entry.size, Version: entry.version, Time: mtime.UnixNano()})
+	})
+	if err != nil {
+		fmt.Printf("cannot correct size of %s: %s\n", file.getPath(), err.Msg)
+		return false
+	}
+	if corrected {
+		fmt.Printf("file %s is %d bytes on storage server %v, corrected from %d bytes\n", file.getPath(), entry.size, server, previous)
+	}
+	return corrected
+}
+
+// reconcileEntries - returns the entries sorted by path
+func reconcileEntries(entries map[string]reconcileEntry, now time.Time) []ReconcileEntryResponse {
+	sorted := make([]ReconcileEntryResponse, 0, len(entries))
+	for pth, entry := range entries {
+		sorted = append(sorted, ReconcileEntryResponse{pth, entry.size, now.Sub(entry.since).Milliseconds()})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	return sorted
+}
+
+// reconcileReport - the last reconciliation of every registered storage server
+func (s *NamingServer) reconcileReport() ReconcileResponse {
+	s.lock.RLock()
+	servers := make([]*StorageServerInfo, len(s.storageServers))
+	copy(servers, s.storageServers)
+	s.lock.RUnlock()
+
+	now := time.Now()
+	s.reconcileMtx.Lock()
+	defer s.reconcileMtx.Unlock()
+	responses := make([]ReconcileServerResponse, 0, len(servers))
+	for _, server := range servers {
+		response := ReconcileServerResponse{
+			StorageIP:   server.ip,
+			ClientPort:  server.clientPort,
+			CommandPort: server.commandPort,
+			Orphans:     make([]ReconcileEntryResponse, 0),
+			Missing:     make([]ReconcileEntryResponse, 0),
+			Resized:     make([]ReconcileEntryResponse, 0),
+		}
+		if state, exists := s.reconciled[server.key()]; exists && !state.checkedAt.IsZero() {
+			response.CheckedAt = state.checkedAt.UnixMilli()
+			response.Error = state.err
+			response.Files = state.files
+			response.Orphans = reconcileEntries(state.orphans, now)
+			response.Missing = reconcileEntries(state.missing, now)
+			response.Resized = reconcileEntries(state.resized, now)
+			response.DeletedOrphans = state.deletedOrphans
+			response.RemovedReplicas = state.removedReplicas
+			response.CorrectedSizes = state.correctedSizes
+		}
+		responses = append(responses, response)
+	}
+	return ReconcileResponse{s.config.OrphanGracePeriod.Milliseconds(), responses}
+}
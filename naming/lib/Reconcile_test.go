@@ -0,0 +1,125 @@
+package naming
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// formatReconcile - the discrepancies and totals of the last reconciliation of server
+func formatReconcile(s *NamingServer, server *StorageServerInfo) string {
+	s.reconcileMtx.Lock()
+	defer s.reconcileMtx.Unlock()
+	state := s.reconciled[server.key()]
+	paths := func(entries map[string]reconcileEntry) string {
+		sorted := make([]string, 0, len(entries))
+		for pth := range entries {
+			sorted = append(sorted, pth)
+		}
+		sort.Strings(sorted)
+		return strings.Join(sorted, " ")
+	}
+	return fmt.Sprintf("orphans [%s] missing [%s] resized [%s] deleted %d removed %d corrected %d",
+		paths(state.orphans), paths(state.missing), paths(state.resized),
+		state.deletedOrphans, state.removedReplicas, state.correctedSizes)
+}
+
+// TestReconcileGracePeriod - discrepancies are acted upon once they have been found for
+// the grace period, which restarts if they change in between
+// The namespace holds /f of 10 bytes on the reconciled server and another one, and /only
+// of 5 bytes on the reconciled server only.
+func TestReconcileGracePeriod(t *testing.T) {
+	const grace = 50 * time.Millisecond
+	stored := []ListedFile{{"/f", 10}, {"/only", 5}}
+	with := func(files ...ListedFile) []ListedFile {
+		return append(append([]ListedFile(nil), stored...), files...)
+	}
+	type pass struct {
+		before   func(t *testing.T, s *NamingServer)
+		listed   []ListedFile
+		expected string
+	}
+	tests := []struct {
+		name   string
+		grace  time.Duration
+		passes []pass
+	}{
+		{"no discrepancies", grace, []pass{
+			{nil, stored, "orphans [] missing [] resized [] deleted 0 removed 0 corrected 0"},
+		}},
+		{"orphan is deleted after the grace period", grace, []pass{
+			{nil, with(ListedFile{"/o", 1}), "orphans [/o] missing [] resized [] deleted 0 removed 0 corrected 0"},
+			{nil, with(ListedFile{"/o", 1}), "orphans [] missing [] resized [] deleted 1 removed 0 corrected 0"},
+		}},
+		{"orphan is deleted at once without a grace period", 0, []pass{
+			{nil, with(ListedFile{"/o", 1}), "orphans [] missing [] resized [] deleted 1 removed 0 corrected 0"},
+		}},
+		{"orphan found again restarts the grace period", grace, []pass{
+			{nil, with(ListedFile{"/o", 1}), "orphans [/o] missing [] resized [] deleted 0 removed 0 corrected 0"},
+			{nil, stored, "orphans [] missing [] resized [] deleted 0 removed 0 corrected 0"},
+			{nil, with(ListedFile{"/o", 1}), "orphans [/o] missing [] resized [] deleted 0 removed 0 corrected 0"},
+		}},
+		{"orphan created in the namespace meanwhile is kept", grace, []pass{
+			{nil, with(ListedFile{"/o", 1}), "orphans [/o] missing [] resized [] deleted 0 removed 0 corrected 0"},
+			{func(t *testing.T, s *NamingServer) {
+				file, err := s.root.CreateFile("/o", s.storageServers[0], nil)
+				if err != nil {
+					t.Fatal(err.Msg)
+				}
+				file.recordWrite(1, time.Now(), func(version int64) *DFSException { return nil })
+			}, with(ListedFile{"/o", 1}), "orphans [] missing [] resized [] deleted 0 removed 0 corrected 0"},
+		}},
+		{"missing replica is removed after the grace period", grace, []pass{
+			{nil, []ListedFile{{"/only", 5}}, "orphans [] missing [/f] resized [] deleted 0 removed 0 corrected 0"},
+			{nil, []ListedFile{{"/only", 5}}, "orphans [] missing [] resized [] deleted 0 removed 1 corrected 0"},
+		}},
+		{"missing only replica is kept", grace, []pass{
+			{nil, []ListedFile{{"/f", 10}}, "orphans [] missing [/only] resized [] deleted 0 removed 0 corrected 0"},
+			{nil, []ListedFile{{"/f", 10}}, "orphans [] missing [/only] resized [] deleted 0 removed 0 corrected 0"},
+		}},
+		{"size is corrected after the grace period", grace, []pass{
+			{nil, []ListedFile{{"/f", 12}, {"/only", 5}}, "orphans [] missing [] resized [/f] deleted 0 removed 0 corrected 0"},
+			{nil, []ListedFile{{"/f", 12}, {"/only", 5}}, "orphans [] missing [] resized [] deleted 0 removed 0 corrected 1"},
+		}},
+		{"write restarts the grace period of a size", grace, []pass{
+			{nil, []ListedFile{{"/f", 12}, {"/only", 5}}, "orphans [] missing [] resized [/f] deleted 0 removed 0 corrected 0"},
+			{func(t *testing.T, s *NamingServer) {
+				file := s.root.findItem("/f").(*FileInfo)
+				file.recordWrite(10, time.Now(), func(version int64) *DFSException { return nil })
+			}, []ListedFile{{"/f", 12}, {"/only", 5}}, "orphans [] missing [] resized [/f] deleted 0 removed 0 corrected 0"},
+		}},
+	}
+	ok := func(pth string, attempt int) int { return http.StatusOK }
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testNamingServer(t, t.TempDir())
+			s.config.OrphanGracePeriod = test.grace
+			storage := newFakeStorage(t, ok)
+			server := registerFakeWith(t, s, storage, RegisterRequest{Files: []string{"/f", "/only"}, Sizes: []int64{10, 5}})
+			other := registerFake(t, s, newFakeStorage(t, ok))
+			file := s.root.findItem("/f").(*FileInfo)
+			file.rCountMtx.Lock()
+			file.storageServers = append(file.storageServers, other)
+			file.rCountMtx.Unlock()
+
+			for i, pass := range test.passes {
+				if i > 0 {
+					time.Sleep(test.grace + 10*time.Millisecond)
+				}
+				if pass.before != nil {
+					pass.before(t, s)
+				}
+				storage.mtx.Lock()
+				storage.files = pass.listed
+				storage.mtx.Unlock()
+				s.reconcileServer(server)
+				if reconciled := formatReconcile(s, server); reconciled != pass.expected {
+					t.Fatalf("pass %d: %q, expected %q", i+1, reconciled, pass.expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package naming
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// triggerRepair - asks the repair loop to scan for under-replicated files as soon as possible
+func (s *NamingServer) triggerRepair() {
+	select {
+	case s.repairTrigger <- empty{}:
+	default:
+		// a scan is already pending
+	}
+}
+
+// repairLoop - restores the target replica count of under-replicated files
+// A scan runs whenever it is triggered (a storage server died, a target was raised),
+// and periodically once any file may need more than one replica.
+func (s *NamingServer) repairLoop() {
+	ticker := time.NewTicker(s.config.RepairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.config.DefaultReplicas <= 1 && !s.replicasTuned.Load() {
+				continue
+			}
+		case <-s.repairTrigger:
+		}
+		s.repairReplicas()
+	}
+}
+
+// repairReplicas - finds every under-replicated file and replicates it
+func (s *NamingServer) repairReplicas() {
+	underReplicated := make([]string, 0)
+	s.root.forEachFileLocked(func(file *FileInfo) {
+		if file.replicaCount() < file.targetReplicas(s.config.DefaultReplicas) {
+			underReplicated = append(underReplicated, file.getPath())
+		}
+	})
+	for _, pth := range underReplicated {
+		s.repairFile(pth)
+	}
+}
+
+// repairFile - copies a file to healthy storage servers until it reaches its target replica count
+// The file is r-locked during copying, so no client can modify it concurrently.
+func (s *NamingServer) repairFile(pth string) {
+	file := s.root.lockFile(pth)
+	if file == nil {
+		// deleted in the meantime
+		return
+	}
+	defer s.root.unlockFile(file)
+	file.rCountMtx.Lock()
+	defer file.rCountMtx.Unlock()
+
+	target := file.targetReplicas(s.config.DefaultReplicas)
+	if len(file.storageServers) == 0 || len(file.storageServers) >= target {
+		// nothing left to copy from, or repaired in the meantime
+		return
+	}
+	candidates := make([]*StorageServerInfo, 0)
+	for _, storageServer := range s.aliveStorageServers() {
+		if !file.involves(storageServer) {
+			candidates = append(candidates, storageServer)
+		}
+	}
+	// copy from replicas that are not suspected, if possible
+	sources := make([]*StorageServerInfo, 0, len(file.storageServers))
+	for _, storageServer := range file.storageServers {
+		if storageServer.state.Load() == serverAlive {
+			sources = append(sources, storageServer)
+		}
+	}
+	if len(sources) == 0 {
+		sources = file.storageServers
+	}
+
+	for len(file.storageServers) < target && len(candidates) > 0 {
+		dst := s.placeReplica(file.storageServers, candidates)
+		for idx, candidate := range candidates {
+			if candidate == dst {
+				candidates = append(candidates[:idx], candidates[idx+1:]...)
+				break
+			}
+		}
+		if file.involves(dst) {
+			// replicated while an earlier copy was sent
+			continue
+		}
+		src := sources[rand.Intn(len(sources))]
+		if s.copyReplica(file, dst, src) {
+			key := dst.key()
+			if err := s.journal.Append(journalRecord{Op: opAddReplica, Path: file.getPath(), Server: &key}); err != nil {
+				// the copy is an orphan, which reconciliation deletes
+				fmt.Printf("cannot add replica of %s: %s\n", file.getPath(), err.Error())
+				return
+			}
+			file.storageServers = append(file.storageServers, dst)
+		}
+	}
+	if len(file.storageServers) < target {
+		fmt.Printf("file %s has %d of %d replicas, not enough healthy storage servers\n", file.getPath(), len(file.storageServers), target)
+	}
+}
@@ -4,9 +4,82 @@ type PathRequest struct {
 	Path string `json:"path"`
 }
 
+type ListRequest struct {
+	Path       string `json:"path"`
+	Detailed   bool   `json:"detailed"`
+	Limit      int    `json:"limit"`
+	StartAfter string `json:"start_after"`
+	Sort       string `json:"sort"`
+}
+
+type WalkRequest struct {
+	Path            string `json:"path"`
+	MaxDepth        int    `json:"max_depth"`
+	MarkDirectories bool   `json:"mark_directories"`
+}
+
+type GlobRequest struct {
+	Pattern         string `json:"pattern"`
+	MarkDirectories bool   `json:"mark_directories"`
+}
+
 type LockRequest struct {
 	Path      string `json:"path"`
 	Exclusive bool   `json:"exclusive"`
+	SessionID string `json:"session_id"`
+	ClientID  string `json:"client_id"`
+	// only used by /lock
+	Try       bool  `json:"try"`
+	TimeoutMs int64 `json:"timeout_ms"`
+}
+
+// owner - the owner of the lock, the session takes precedence over the client id
+func (r *LockRequest) owner() string {
+	if r.SessionID != "" {
+		return r.SessionID
+	}
+	return r.ClientID
+}
+
+type ForceUnlockRequest struct {
+	Path      string `json:"path"`
+	Exclusive bool   `json:"exclusive"`
+	Holder    string `json:"holder"`
+}
+
+type SessionRequest struct {
+	SessionID string `json:"session_id"`
+	TimeoutMs int64  `json:"timeout_ms"`
+}
+
+type RenameRequest struct {
+	Path    string `json:"path"`
+	NewPath string `json:"new_path"`
+}
+
+// CopyRequest - asks a storage server to copy a file from the storage server at ServerIP
+type CopyRequest struct {
+	Path       string `json:"path"`
+	ServerIP   string `json:"server_ip"`
+	ServerPort int    `json:"server_port"`
+}
+
+type ReplicationRequest struct {
+	Path     string `json:"path"`
+	Replicas int    `json:"replicas"`
+}
+
+type QuotaRequest struct {
+	Path       string `json:"path"`
+	MaxBytes   int64  `json:"max_bytes"`
+	MaxEntries int64  `json:"max_entries"`
+}
+
+type DecommissionRequest struct {
+	StorageIP   string `json:"storage_ip"`
+	ClientPort  int    `json:"client_port"`
+	CommandPort int    `json:"command_port"`
+	Cancel      bool   `json:"cancel"`
 }
 
 type RegisterRequest struct {
@@ -14,4 +87,29 @@ type RegisterRequest struct {
 	ClientPort  int      `json:"client_port" binding:"required"`
 	CommandPort int      `json:"command_port" binding:"required"`
 	Files       []string `json:"files"`
+	// sizes of the files in bytes, in the order of Files, omitted by older storage servers
+	Sizes []int64 `json:"sizes"`
+	// failure domain of the storage server, empty if unknown
+	Zone string `json:"zone"`
+	// capacity of the disk of the storage server, 0 if unknown
+	TotalBytes int64 `json:"total_bytes"`
+	FreeBytes  int64 `json:"free_bytes"`
+}
+
+type HeartbeatRequest struct {
+	StorageIP   string `json:"storage_ip"`
+	ClientPort  int    `json:"client_port" binding:"required"`
+	CommandPort int    `json:"command_port" binding:"required"`
+	FileCount   int    `json:"file_count"`
+	UsedBytes   int64  `json:"used_bytes"`
+	TotalBytes  int64  `json:"total_bytes"`
+	FreeBytes   int64  `json:"free_bytes"`
+}
+
+type WriteNotification struct {
+	StorageIP   string `json:"storage_ip"`
+	ClientPort  int    `json:"client_port" binding:"required"`
+	CommandPort int    `json:"command_port" binding:"required"`
+	Path        string `json:"path" binding:"required"`
+	Size        int64  `json:"size"`
 }
@@ -1,11 +1,184 @@
 package naming
 
+import "encoding/json"
+
 type SuccessResponse struct {
 	Success bool `json:"success" binding:"required"`
 }
 
 type ListFilesResponse struct {
-	Files []string `json:"files" binding:"required"`
+	Files     []string `json:"files" binding:"required"`
+	NextToken string   `json:"next_token,omitempty"`
+}
+
+type DiskUsageResponse struct {
+	Path        string `json:"path"`
+	Bytes       int64  `json:"bytes"`
+	Files       int64  `json:"files"`
+	Directories int64  `json:"directories"`
+	// quotas of a directory, 0 means unlimited
+	MaxBytes   int64 `json:"max_bytes,omitempty"`
+	MaxEntries int64 `json:"max_entries,omitempty"`
+}
+
+type PathsResponse struct {
+	Paths []string `json:"paths" binding:"required"`
+}
+
+// StatResponse - metadata of a file or directory, times are in unix milliseconds
+type StatResponse struct {
+	Name        string                `json:"name"`
+	Path        string                `json:"path"`
+	IsDirectory bool                  `json:"is_directory"`
+	Size        int64                 `json:"size"`
+	Ctime       int64                 `json:"ctime"`
+	Mtime       int64                 `json:"mtime"`
+	Version     int64                 `json:"version"`
+	Replicas    []StorageInfoResponse `json:"replicas"`
+}
+
+type ListEntriesResponse struct {
+	Entries   []StatResponse `json:"entries" binding:"required"`
+	NextToken string         `json:"next_token,omitempty"`
+}
+
+type SessionResponse struct {
+	SessionID string `json:"session_id" binding:"required"`
+	TimeoutMs int64  `json:"timeout_ms" binding:"required"`
+}
+
+// HeldLockResponse - locks of one path held by one owner
+type HeldLockResponse struct {
+	Path      string `json:"path"`
+	Exclusive bool   `json:"exclusive"`
+	Holder    string `json:"holder"`
+	Count     int    `json:"count"`
+	HeldMs    int64  `json:"held_ms"`
+}
+
+// WaitingLockResponse - a lock request that has not been granted yet
+type WaitingLockResponse struct {
+	Path          string `json:"path"`
+	Exclusive     bool   `json:"exclusive"`
+	Owner         string `json:"owner"`
+	BlockedOn     string `json:"blocked_on"`
+	QueuePosition int    `json:"queue_position"`
+	QueueLength   int    `json:"queue_length"`
+	Readers       int    `json:"readers"`
+	Writing       bool   `json:"writing"`
+	WaitMs        int64  `json:"wait_ms"`
+}
+
+type LockTableResponse struct {
+	Held    []HeldLockResponse    `json:"held"`
+	Waiting []WaitingLockResponse `json:"waiting"`
+}
+
+// StorageServerResponse - a registered storage server and its last reported usage
+type StorageServerResponse struct {
+	StorageIP   string `json:"storage_ip"`
+	ClientPort  int    `json:"client_port"`
+	CommandPort int    `json:"command_port"`
+	Zone        string `json:"zone"`
+	State       string `json:"state"`
+	FileCount   int    `json:"file_count"`
+	UsedBytes   int64  `json:"used_bytes"`
+	TotalBytes  int64  `json:"total_bytes"`
+	FreeBytes   int64  `json:"free_bytes"`
+	// progress of decommissioning, if it was started
+	Drain *DrainResponse `json:"drain,omitempty"`
+}
+
+// DrainResponse - progress of the decommissioning of a storage server
+type DrainResponse struct {
+	StorageIP   string `json:"storage_ip"`
+	ClientPort  int    `json:"client_port"`
+	CommandPort int    `json:"command_port"`
+	State       string `json:"state"`
+	Files       int    `json:"files"`
+	Moved       int    `json:"moved"`
+	Failed      int    `json:"failed"`
+	ElapsedMs   int64  `json:"elapsed_ms"`
+}
+
+type StorageServersResponse struct {
+	Placement string                  `json:"placement"`
+	Servers   []StorageServerResponse `json:"servers"`
+}
+
+// ReplicaZoneResponse - a storage server holding a replica, and its zone
+type ReplicaZoneResponse struct {
+	ServiceIP   string `json:"server_ip"`
+	ServicePort int    `json:"server_port"`
+	Zone        string `json:"zone"`
+}
+
+// SpreadViolationResponse - a file whose replicas could be spread across more zones
+type SpreadViolationResponse struct {
+	Path     string                `json:"path"`
+	Replicas []ReplicaZoneResponse `json:"replicas"`
+}
+
+type SpreadResponse struct {
+	Zones int                       `json:"zones"`
+	Files []SpreadViolationResponse `json:"files"`
+}
+
+// ListedFile - a file stored by a storage server, as listed by /storage_list
+type ListedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type StorageListResponse struct {
+	Files []ListedFile `json:"files"`
+}
+
+// ReconcileEntryResponse - a file found by reconciliation, and how long it has been found
+type ReconcileEntryResponse struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	AgeMs int64  `json:"age_ms"`
+}
+
+// ReconcileServerResponse - the last reconciliation of a storage server, times are in unix milliseconds
+type ReconcileServerResponse struct {
+	StorageIP       string                   `json:"storage_ip"`
+	ClientPort      int                      `json:"client_port"`
+	CommandPort     int                      `json:"command_port"`
+	CheckedAt       int64                    `json:"checked_at"`
+	Error           string                   `json:"error,omitempty"`
+	Files           int                      `json:"files"`
+	Orphans         []ReconcileEntryResponse `json:"orphans"`
+	Missing         []ReconcileEntryResponse `json:"missing"`
+	Resized         []ReconcileEntryResponse `json:"resized"`
+	DeletedOrphans  int                      `json:"deleted_orphans"`
+	RemovedReplicas int                      `json:"removed_replicas"`
+	CorrectedSizes  int                      `json:"corrected_sizes"`
+}
+
+type ReconcileResponse struct {
+	GracePeriodMs int64                     `json:"grace_period_ms"`
+	Servers       []ReconcileServerResponse `json:"servers"`
+}
+
+// QueuedCommandResponse - a command to a storage server that has not been delivered
+type QueuedCommandResponse struct {
+	ID            string          `json:"id"`
+	StorageIP     string          `json:"storage_ip"`
+	ClientPort    int             `json:"client_port"`
+	CommandPort   int             `json:"command_port"`
+	Command       string          `json:"command"`
+	Body          json.RawMessage `json:"body"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	AgeMs         int64           `json:"age_ms"`
+	NextAttemptMs int64           `json:"next_attempt_ms"`
+}
+
+type CommandQueueResponse struct {
+	Pending     []QueuedCommandResponse `json:"pending"`
+	DeadLetters []QueuedCommandResponse `json:"dead_letters"`
 }
 
 type StorageInfoResponse struct {
@@ -0,0 +1,164 @@
+package naming
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// sessionLock - one lock acquired in a session
+type sessionLock struct {
+	path     string
+	readonly bool
+}
+
+// Session - a client session with a lease
+// Every lock acquired in a session is released when the lease expires.
+type Session struct {
+	id      string
+	timeout time.Duration
+	// fields guarded by NamingServer.sessionsMtx
+	expires time.Time
+	locks   []sessionLock
+	closed  bool
+}
+
+// sessionNotFound - error returned for requests in unknown or expired sessions
+func sessionNotFound(id string) *DFSException {
+	return &DFSException{IllegalStateException, fmt.Sprintf("session %s does not exist or has expired.", id)}
+}
+
+// newSessionID - generates a random session id
+func newSessionID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// openSession - creates a new session whose lease lasts for timeout
+// the default session timeout is used if timeout is not positive
+func (s *NamingServer) openSession(timeout time.Duration) *Session {
+	if timeout <= 0 {
+		timeout = s.config.SessionTimeout
+	}
+	session := &Session{
+		id:      newSessionID(),
+		timeout: timeout,
+		expires: time.Now().Add(timeout),
+		locks:   make([]sessionLock, 0),
+	}
+	s.sessionsMtx.Lock()
+	s.sessions[session.id] = session
+	s.sessionsMtx.Unlock()
+	return session
+}
+
+// renewSession - extends the lease of a session
+// returns nil if the session does not exist or has expired
+func (s *NamingServer) renewSession(id string) *Session {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	session, exists := s.sessions[id]
+	if !exists {
+		return nil
+	}
+	session.expires = time.Now().Add(session.timeout)
+	return session
+}
+
+// addSessionLock - records a lock acquired in a session
+// returns false if the session has been closed or has expired in the meantime,
+// then the caller has to release the lock itself
+func (s *NamingServer) addSessionLock(session *Session, pth string, readonly bool) bool {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	if session.closed {
+		return false
+	}
+	session.locks = append(session.locks, sessionLock{pth, readonly})
+	session.expires = time.Now().Add(session.timeout)
+	return true
+}
+
+// removeSessionLock - forgets one lock acquired in a session
+func (s *NamingServer) removeSessionLock(session *Session, pth string, readonly bool) {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	for i := len(session.locks) - 1; i >= 0; i-- {
+		if session.locks[i] == (sessionLock{pth, readonly}) {
+			session.locks = append(session.locks[:i], session.locks[i+1:]...)
+			return
+		}
+	}
+}
+
+// forgetSessionLock - forgets a lock of a session released by someone else, e.g. an operator
+// it does nothing if no session has this id
+func (s *NamingServer) forgetSessionLock(id string, pth string, readonly bool) {
+	s.sessionsMtx.Lock()
+	session, exists := s.sessions[id]
+	s.sessionsMtx.Unlock()
+	if exists {
+		s.removeSessionLock(session, pth, readonly)
+	}
+}
+
+// closeSession - removes a session and releases every lock still held in it
+// returns false if the session does not exist
+func (s *NamingServer) closeSession(id string) bool {
+	s.sessionsMtx.Lock()
+	session, exists := s.sessions[id]
+	if !exists {
+		s.sessionsMtx.Unlock()
+		return false
+	}
+	locks := s.detachSession(session)
+	s.sessionsMtx.Unlock()
+
+	s.releaseSessionLocks(session, locks)
+	return true
+}
+
+// detachSession - removes a session from the session table and returns the locks still held in it
+// Assumes the caller holds s.sessionsMtx
+func (s *NamingServer) detachSession(session *Session) []sessionLock {
+	delete(s.sessions, session.id)
+	session.closed = true
+	locks := session.locks
+	session.locks = nil
+	return locks
+}
+
+// releaseSessionLocks - releases locks of a closed session in reverse order of acquisition
+func (s *NamingServer) releaseSessionLocks(session *Session, locks []sessionLock) {
+	for i := len(locks) - 1; i >= 0; i-- {
+		if err := s.root.UnlockFileOrDirectory(locks[i].path, locks[i].readonly, session.id); err != nil {
+			fmt.Printf("cannot release lock on %s of session %s: %s\n", locks[i].path, session.id, err.Msg)
+		}
+	}
+}
+
+// expireSessions - periodically closes sessions whose lease has expired
+func (s *NamingServer) expireSessions() {
+	ticker := time.NewTicker(s.config.SessionTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		expired := make(map[*Session][]sessionLock)
+		s.sessionsMtx.Lock()
+		for _, session := range s.sessions {
+			if now.After(session.expires) {
+				expired[session] = s.detachSession(session)
+			}
+		}
+		s.sessionsMtx.Unlock()
+
+		for session, locks := range expired {
+			fmt.Printf("session %s expired, releasing %d locks\n", session.id, len(locks))
+			s.releaseSessionLocks(session, locks)
+		}
+	}
+}
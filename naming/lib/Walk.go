@@ -0,0 +1,196 @@
+package naming
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// treeEntry - a file or directory found by a walk or a glob
+type treeEntry struct {
+	path        string
+	isDirectory bool
+}
+
+// lockTree - r-locks every directory on the path to dir, and every directory
+// below it whose entries are within maxDepth levels of dir, parents before children
+// A maxDepth of 0 or less means no limit. While the locks are held, no file or
+// directory can be created, deleted or moved within these levels.
+// returns the directory and the directories locked below it, or nil if it does not exist
+func (d *Directory) lockTree(pth string, maxDepth int) (*Directory, []*Directory) {
+	dir := d.lockPath(pathToNames(pth))
+	if dir == nil {
+		return nil, nil
+	}
+	locked := make([]*Directory, 0)
+	level := []*Directory{dir}
+	for depth := 1; len(level) > 0 && (maxDepth <= 0 || depth < maxDepth); depth++ {
+		next := make([]*Directory, 0)
+		for _, parent := range level {
+			subdirs, _ := parent.children()
+			for _, subdir := range subdirs {
+				subdir.lock.RLock()
+				next = append(next, subdir)
+			}
+		}
+		locked = append(locked, next...)
+		level = next
+	}
+	return dir, locked
+}
+
+// unlockTree - releases the locks acquired by lockTree, children before parents
+func (d *Directory) unlockTree(dir *Directory, locked []*Directory) {
+	for i := len(locked) - 1; i >= 0; i-- {
+		locked[i].lock.RUnlock()
+	}
+	d.unlockPath(dir)
+}
+
+// walk - appends every file and directory below d within maxDepth levels to entries,
+// depth first and sorted by name
+func (d *Directory) walk(dirPath string, maxDepth int, entries []treeEntry) []treeEntry {
+	for _, name := range d.sortedEntries() {
+		pth := path.Join(dirPath, name)
+		subdir, isDirectory := d.subDirectory(name)
+		entries = append(entries, treeEntry{pth, isDirectory})
+		if isDirectory && maxDepth != 1 {
+			entries = subdir.walk(pth, maxDepth-1, entries)
+		}
+	}
+	return entries
+}
+
+// WalkTree - lists every file and directory below a directory, up to maxDepth
+// levels below it, depth first and sorted by name
+// A maxDepth of 0 means no limit. The subtree is r-locked during the walk,
+// so the result is a consistent snapshot.
+func (d *Directory) WalkTree(pth string, maxDepth int) ([]treeEntry, *DFSException) {
+	if maxDepth < 0 {
+		return nil, &DFSException{IllegalArgumentException, "the maximum depth cannot be negative."}
+	}
+	if len(pathToNames(pth)) == 0 {
+		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("path %s is illegal.", pth)}
+	}
+	dir, locked := d.lockTree(pth, maxDepth)
+	if dir == nil {
+		return nil, &DFSException{FileNotFoundException, fmt.Sprintf("Cannot find directory %s.", pth)}
+	}
+	defer d.unlockTree(dir, locked)
+	return dir.walk(path.Clean(pth), maxDepth, make([]treeEntry, 0)), nil
+}
+
+// globPattern - translates a glob component to the syntax of path.Match,
+// which negates character classes with '^' instead of '!'
+func globPattern(pattern string) string {
+	return strings.ReplaceAll(pattern, "[!", "[^")
+}
+
+// hasMeta - whether a glob component contains any special character
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// glob - adds the files and directories below d matching patterns, one per level, to matches
+// "**" matches zero or more directories, or every file and directory below if it comes last
+func (d *Directory) glob(dirPath string, patterns []string, matches map[string]bool) {
+	pattern, rest := patterns[0], patterns[1:]
+	if pattern == "**" {
+		if len(rest) > 0 {
+			d.glob(dirPath, rest, matches)
+		}
+		subdirs, files := d.children()
+		for _, subdir := range subdirs {
+			pth := path.Join(dirPath, subdir.getName())
+			if len(rest) == 0 {
+				matches[pth] = true
+			}
+			subdir.glob(pth, patterns, matches)
+		}
+		if len(rest) == 0 {
+			for _, file := range files {
+				matches[path.Join(dirPath, file.getName())] = false
+			}
+		}
+		return
+	}
+
+	visit := func(name string) {
+		pth := path.Join(dirPath, name)
+		subdir, isDirectory := d.subDirectory(name)
+		if len(rest) == 0 {
+			matches[pth] = isDirectory
+		} else if isDirectory {
+			subdir.glob(pth, rest, matches)
+		}
+	}
+	if !hasMeta(pattern) {
+		// a plain name, no need to scan the directory
+		if d.entry(pattern) != nil {
+			visit(pattern)
+		}
+		return
+	}
+	for _, name := range d.sortedEntries() {
+		if matched, _ := path.Match(pattern, name); matched {
+			visit(name)
+		}
+	}
+}
+
+// Glob - lists every file and directory matching a glob pattern, sorted by path
+// Every component of the pattern matches one level of the path, and supports
+// '*', '?' and character classes like [a-z] and [!a]. A component "**" matches
+// zero or more directories. The longest prefix of the pattern without special
+// characters is r-locked during the search, together with the directories below it.
+func (d *Directory) Glob(pattern string) ([]treeEntry, *DFSException) {
+	names := pathToNames(pattern)
+	if len(names) < 2 {
+		return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("pattern %s is illegal.", pattern)}
+	}
+	patterns := make([]string, 0, len(names)-1)
+	for _, name := range names[1:] {
+		if name == "**" {
+			patterns = append(patterns, name)
+			continue
+		}
+		name = globPattern(name)
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, &DFSException{IllegalArgumentException, fmt.Sprintf("pattern %s is illegal.", pattern)}
+		}
+		patterns = append(patterns, name)
+	}
+
+	// the root of the search, the last component is always searched for
+	literal := 0
+	for literal < len(patterns)-1 && !hasMeta(patterns[literal]) && patterns[literal] != "**" {
+		literal++
+	}
+	root := "/" + strings.Join(patterns[:literal], "/")
+	patterns = patterns[literal:]
+	maxDepth := len(patterns)
+	for _, name := range patterns {
+		if name == "**" {
+			maxDepth = 0
+		}
+	}
+
+	dir, locked := d.lockTree(root, maxDepth)
+	if dir == nil {
+		// nothing can match
+		return make([]treeEntry, 0), nil
+	}
+	matches := make(map[string]bool)
+	dir.glob(root, patterns, matches)
+	d.unlockTree(dir, locked)
+
+	entries := make([]treeEntry, 0, len(matches))
+	for pth, isDirectory := range matches {
+		entries = append(entries, treeEntry{pth, isDirectory})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+	return entries, nil
+}
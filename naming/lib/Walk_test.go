@@ -0,0 +1,129 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+)
+
+// newWalkRoot - a namespace with the files /top.txt, /a/x.txt, /a/y.go, /a/b/z.txt
+// and /a/b/c/w.txt
+func newWalkRoot(t *testing.T) *Directory {
+	t.Helper()
+	root := newTestRoot()
+	for _, pth := range []string{"/a", "/a/b", "/a/b/c"} {
+		if _, err := root.MakeDirectory(pth, nil); err != nil {
+			t.Fatal(err.Msg)
+		}
+	}
+	for _, pth := range []string{"/top.txt", "/a/x.txt", "/a/y.go", "/a/b/z.txt", "/a/b/c/w.txt"} {
+		if _, err := root.CreateFile(pth, nil, nil); err != nil {
+			t.Fatal(err.Msg)
+		}
+	}
+	return root
+}
+
+// formatEntries - joins the paths of entries, directories with a trailing '/'
+func formatEntries(entries []treeEntry) string {
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.isDirectory {
+			paths = append(paths, entry.path+"/")
+		} else {
+			paths = append(paths, entry.path)
+		}
+	}
+	return strings.Join(paths, " ")
+}
+
+func TestWalkTree(t *testing.T) {
+	tests := []struct {
+		pth      string
+		maxDepth int
+		expected string
+	}{
+		{"/", 0, "/a/ /a/b/ /a/b/c/ /a/b/c/w.txt /a/b/z.txt /a/x.txt /a/y.go /top.txt"},
+		{"/", 1, "/a/ /top.txt"},
+		{"/a", 1, "/a/b/ /a/x.txt /a/y.go"},
+		{"/a", 2, "/a/b/ /a/b/c/ /a/b/z.txt /a/x.txt /a/y.go"},
+		{"/a/b/", 0, "/a/b/c/ /a/b/c/w.txt /a/b/z.txt"},
+		{"/a/b/c", 5, "/a/b/c/w.txt"},
+	}
+	root := newWalkRoot(t)
+	for _, test := range tests {
+		entries, err := root.WalkTree(test.pth, test.maxDepth)
+		if err != nil {
+			t.Fatalf("walk %s, depth %d: %s", test.pth, test.maxDepth, err.Msg)
+		}
+		if walked := formatEntries(entries); walked != test.expected {
+			t.Errorf("walk %s, depth %d: %q, expected %q", test.pth, test.maxDepth, walked, test.expected)
+		}
+	}
+}
+
+func TestWalkTreeErrors(t *testing.T) {
+	tests := []struct {
+		pth      string
+		maxDepth int
+		err      string
+	}{
+		{"/a", -1, IllegalArgumentException},
+		{"a", 0, IllegalArgumentException},
+		{"/missing", 0, FileNotFoundException},
+		{"/a/x.txt", 0, FileNotFoundException},
+	}
+	root := newWalkRoot(t)
+	for _, test := range tests {
+		if _, err := root.WalkTree(test.pth, test.maxDepth); err == nil || err.Type != test.err {
+			t.Errorf("walk %s, depth %d: error %v, expected %s", test.pth, test.maxDepth, err, test.err)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"/a/*.txt", "/a/x.txt"},
+		{"/a/?.go", "/a/y.go"},
+		{"/a/[x-y].*", "/a/x.txt /a/y.go"},
+		{"/a/[!x]*", "/a/b/ /a/y.go"},
+		{"/*/*/z.txt", "/a/b/z.txt"},
+		// plain names, and a pattern without special characters at all
+		{"/a/b", "/a/b/"},
+		{"/a/b/z.txt", "/a/b/z.txt"},
+		// "**" matches zero or more directories
+		{"/**/*.txt", "/a/b/c/w.txt /a/b/z.txt /a/x.txt /top.txt"},
+		{"/a/**/z.txt", "/a/b/z.txt"},
+		{"/a/b/**/w.txt", "/a/b/c/w.txt"},
+		{"/a/**/c", "/a/b/c/"},
+		{"/a/**/**/w.txt", "/a/b/c/w.txt"},
+		// "**" last matches everything below
+		{"/a/b/**", "/a/b/c/ /a/b/c/w.txt /a/b/z.txt"},
+		// nothing matches
+		{"/missing/*", ""},
+		{"/a/x.txt/*", ""},
+		{"/a/*.md", ""},
+		{"/a/missing", ""},
+	}
+	root := newWalkRoot(t)
+	for _, test := range tests {
+		entries, err := root.Glob(test.pattern)
+		if err != nil {
+			t.Fatalf("glob %s: %s", test.pattern, err.Msg)
+		}
+		if matched := formatEntries(entries); matched != test.expected {
+			t.Errorf("glob %s: %q, expected %q", test.pattern, matched, test.expected)
+		}
+	}
+}
+
+func TestGlobErrors(t *testing.T) {
+	root := newWalkRoot(t)
+	for _, pattern := range []string{"/", "", "a/*", "/a/[", "/a/[x-"} {
+		if _, err := root.Glob(pattern); err == nil || err.Type != IllegalArgumentException {
+			t.Errorf("glob %q: error %v, expected %s", pattern, err, IllegalArgumentException)
+		}
+	}
+}
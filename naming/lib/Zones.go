@@ -0,0 +1,71 @@
+package naming
+
+import "sort"
+
+// placeReplica - chooses one of the candidates to store a new replica of a file held by replicas
+// Candidates in zones that hold no replica of the file yet are preferred, so that the replicas
+// are spread across as many zones as possible. Storage servers without a zone are all in the
+// same, unnamed zone.
+func (s *NamingServer) placeReplica(replicas []*StorageServerInfo, candidates []*StorageServerInfo) *StorageServerInfo {
+	s.lock.RLock()
+	used := make(map[string]bool)
+	for _, server := range replicas {
+		used[server.zone] = true
+	}
+	spread := make([]*StorageServerInfo, 0, len(candidates))
+	for _, server := range candidates {
+		if !used[server.zone] {
+			spread = append(spread, server)
+		}
+	}
+	s.lock.RUnlock()
+	if len(spread) > 0 {
+		return s.placeFile(spread)
+	}
+	return s.placeFile(candidates)
+}
+
+// spreadViolations - finds every file whose replicas are in fewer zones than they could be
+// A file with n replicas should be in min(n, number of zones) distinct zones, counting
+// the zones of the healthy storage servers.
+func (s *NamingServer) spreadViolations() SpreadResponse {
+	s.lock.RLock()
+	zones := make(map[*StorageServerInfo]string, len(s.storageServers))
+	healthyZones := make(map[string]bool)
+	for _, server := range s.storageServers {
+		zones[server] = server.zone
+		if server.state.Load() == serverAlive {
+			healthyZones[server.zone] = true
+		}
+	}
+	s.lock.RUnlock()
+
+	violations := make([]SpreadViolationResponse, 0)
+	s.root.forEachFileLocked(func(file *FileInfo) {
+		replicas := file.replicaServers()
+		distinct := make(map[string]bool)
+		for _, server := range replicas {
+			distinct[zones[server]] = true
+		}
+		expected := len(replicas)
+		if len(healthyZones) < expected {
+			expected = len(healthyZones)
+		}
+		if len(distinct) >= expected {
+			return
+		}
+		violation := SpreadViolationResponse{Path: file.getPath(), Replicas: make([]ReplicaZoneResponse, 0, len(replicas))}
+		for _, server := range replicas {
+			violation.Replicas = append(violation.Replicas, ReplicaZoneResponse{
+				ServiceIP:   server.ip,
+				ServicePort: server.clientPort,
+				Zone:        zones[server],
+			})
+		}
+		violations = append(violations, violation)
+	})
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].Path < violations[j].Path
+	})
+	return SpreadResponse{Zones: len(healthyZones), Files: violations}
+}
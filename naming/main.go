@@ -1,27 +1,54 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	naming "naming/lib"
 	"os"
 	"strconv"
+	"time"
 )
 
 func main() {
-	if len(os.Args) != 3 {
+	var config naming.Config
+	flag.StringVar(&config.BindAddress, "bind", "localhost", "address the service and registration interfaces listen on (empty for all addresses)")
+	flag.StringVar(&config.DataDir, "data-dir", "", "directory for the namespace journal and snapshots (in-memory only if empty)")
+	flag.IntVar(&config.SnapshotInterval, "snapshot-interval", 1000, "number of journal records between two snapshots")
+	flag.DurationVar(&config.SuspectTimeout, "suspect-timeout", 5*time.Second, "missing heartbeats for this long make a storage server suspected")
+	flag.DurationVar(&config.DeadTimeout, "dead-timeout", 15*time.Second, "missing heartbeats for this long make a storage server dead (0 disables failure detection)")
+	flag.IntVar(&config.DefaultReplicas, "replicas", 1, "target replica count of files without an explicit target")
+	flag.DurationVar(&config.RepairInterval, "repair-interval", 10*time.Second, "period of scans for under-replicated files (0 disables re-replication)")
+	flag.DurationVar(&config.SessionTimeout, "session-timeout", 30*time.Second, "default lease of client sessions (0 means sessions never expire)")
+	flag.DurationVar(&config.DeadlockInterval, "deadlock-interval", time.Second, "period of scans for deadlocks between client locks (0 disables deadlock detection)")
+	flag.StringVar(&config.Placement, "placement", "random", "policy choosing storage servers for new files: random, least-used, weighted or round-robin")
+	flag.DurationVar(&config.RebalanceInterval, "rebalance-interval", 0, "period of rounds moving files from the fullest to the emptiest storage servers (0 disables rebalancing)")
+	flag.Float64Var(&config.RebalanceThreshold, "rebalance-threshold", 0.1, "storage servers within this fraction of their capacity from the average utilization are not rebalanced")
+	flag.Int64Var(&config.RebalanceBandwidth, "rebalance-bandwidth", 10<<20, "bytes per second the rebalancer may copy on average (0 for unlimited)")
+	flag.DurationVar(&config.CommandBackoff, "command-backoff", 500*time.Millisecond, "delay before retrying a command a storage server did not receive, doubled after every failure")
+	flag.DurationVar(&config.CommandMaxBackoff, "command-max-backoff", time.Minute, "longest delay between two attempts of a command to a storage server")
+	flag.IntVar(&config.CommandAttempts, "command-attempts", 10, "attempts of a command to a storage server before it is abandoned (0 retries forever)")
+	flag.DurationVar(&config.ReconcileInterval, "reconcile-interval", time.Minute, "period of comparisons of the files on storage servers with the namespace (0 disables reconciliation)")
+	flag.DurationVar(&config.OrphanGracePeriod, "orphan-grace", 10*time.Minute, "orphaned files are deleted, lost replicas forgotten, and sizes corrected once found for this long")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
 		fmt.Println("Wrong number of arguments")
 		os.Exit(-1)
 	}
-	servicePort, err := strconv.Atoi(os.Args[1])
+	servicePort, err := strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("%s is not a valid port number\n", flag.Arg(0))
+		os.Exit(-1)
+	}
+	registrationPort, err := strconv.Atoi(flag.Arg(1))
 	if err != nil {
-		fmt.Printf("%s is not a valid port number\n", os.Args[1])
+		fmt.Printf("%s is not a valid port number\n", flag.Arg(1))
 		os.Exit(-1)
 	}
-	registrationPort, err := strconv.Atoi(os.Args[2])
+	server, err := naming.NewNamingServer(servicePort, registrationPort, config)
 	if err != nil {
-		fmt.Printf("%s is not a valid port number\n", os.Args[2])
+		fmt.Printf("Failed to start the naming server: %s\n", err.Error())
 		os.Exit(-1)
 	}
-	server := naming.NewNamingServer(servicePort, registrationPort)
 	server.Run()
 }
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package storage
+
+// diskCapacity returns the total and the available number of bytes of the disk holding the directory.
+// The capacity of the disk is unknown on this platform, so it always returns zeros.
+func (fs *FileSystem) diskCapacity() (int64, int64, error) {
+	return 0, 0, nil
+}
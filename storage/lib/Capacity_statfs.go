@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import "syscall"
+
+// diskCapacity returns the total and the available number of bytes of the disk holding the directory.
+func (fs *FileSystem) diskCapacity() (int64, int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(fs.directory, &stat); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
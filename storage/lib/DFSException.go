@@ -5,6 +5,7 @@ const FileNotFoundException = "FileNotFoundException"
 const IllegalStateException = "IllegalStateException"
 const IOException = "IOException"
 const IndexOutOfBoundsException = "IndexOutOfBoundsException"
+const QuotaExceededException = "QuotaExceededException"
 type DFSException struct {
 	Type string `json:"exception_type"`
 	Msg  string `json:"exception_info"`
@@ -191,6 +191,62 @@ func (fs *FileSystem) DeleteFile(path string) (bool, *DFSException) {
 	return true, nil
 }
 
+// RenamePath moves a file or a directory to a new path.
+// The files of a directory are moved one by one, so an existing destination directory is merged.
+func (fs *FileSystem) RenamePath(path string, newPath string) (bool, *DFSException) {
+	if path == "" || newPath == "" {
+		return false, &DFSException{IllegalArgumentException, "Path is invalid"}
+	}
+	if path == "/" || newPath == "/" {
+		return false, nil
+	}
+	srcPath := filepath.Join(fs.directory, path)
+	dstPath := filepath.Join(fs.directory, newPath)
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, &DFSException{FileNotFoundException, "Path not found"}
+		}
+		return false, &DFSException{IOException, fmt.Sprintf("Error accessing path: %s", err.Error())}
+	}
+
+	moveFile := func(from string, to string) error {
+		if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+			return err
+		}
+		return os.Rename(from, to)
+	}
+	if !info.IsDir() {
+		if err = moveFile(srcPath, dstPath); err != nil {
+			return false, &DFSException{IOException, fmt.Sprintf("Error moving file: %s", err.Error())}
+		}
+	} else {
+		err = filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			relPath, err := filepath.Rel(srcPath, path)
+			if err != nil {
+				return err
+			}
+			return moveFile(path, filepath.Join(dstPath, relPath))
+		})
+		if err != nil {
+			return false, &DFSException{IOException, fmt.Sprintf("Error moving directory: %s", err.Error())}
+		}
+		if err = os.RemoveAll(srcPath); err != nil {
+			return false, &DFSException{IOException, fmt.Sprintf("Error removing directory: %s", err.Error())}
+		}
+	}
+	if err = fs.Prune(); err != nil {
+		return false, &DFSException{IOException, fmt.Sprintf("Error pruning directories: %s", err.Error())}
+	}
+	return true, nil
+}
+
 // ListFiles lists all files in the directory.
 func (fs *FileSystem) ListFiles() ([]string, error) {
 	var files []string
@@ -214,6 +270,48 @@ func (fs *FileSystem) ListFiles() ([]string, error) {
 	return files, nil
 }
 
+// Inventory lists all files in the directory together with their sizes.
+func (fs *FileSystem) Inventory() ([]ListedFile, error) {
+	files := make([]ListedFile, 0)
+	err := filepath.Walk(fs.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			relPath, err := filepath.Rel(fs.directory, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, ListedFile{"/" + relPath, info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Usage returns the number of files and the total number of bytes stored in the directory.
+func (fs *FileSystem) Usage() (int, int64, error) {
+	fileCount := 0
+	var usedBytes int64 = 0
+	err := filepath.Walk(fs.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			fileCount++
+			usedBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return fileCount, usedBytes, nil
+}
+
 // DeleteFiles deletes a list of files or directories.
 func (fs *FileSystem) DeleteFiles(paths []string) error {
 	for _, path := range paths {
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"github.com/gin-gonic/gin"
+	"sync"
+)
+
+// idempotencyHeader is the header carrying the id of a command sent by the naming server.
+// The naming server sends every attempt of a command with the same id.
+const idempotencyHeader = "Idempotency-Key"
+
+// maxRememberedCommands is the number of recent command results kept for retries.
+const maxRememberedCommands = 10000
+
+// commandResult is the response to a command, replayed when the command is retried.
+type commandResult struct {
+	done       chan struct{}
+	statusCode int
+	response   any
+}
+
+// commandResults remembers the results of the most recent commands by id.
+type commandResults struct {
+	mutex   sync.Mutex
+	results map[string]*commandResult
+	order   []string
+}
+
+// idempotent runs handle once per command id. A retried command is not run again, it gets
+// the response of its first run instead, waiting for it if it is still running. Requests
+// without an id, e.g. from older naming servers, always run. Results are kept in memory
+// only, so a command retried after a restart of the storage server runs again.
+func (s *StorageServer) idempotent(ctx *gin.Context, handle func() (int, any)) (int, any) {
+	id := ctx.GetHeader(idempotencyHeader)
+	if id == "" {
+		return handle()
+	}
+	c := &s.commandResults
+	c.mutex.Lock()
+	if result, exists := c.results[id]; exists {
+		c.mutex.Unlock()
+		<-result.done
+		return result.statusCode, result.response
+	}
+	result := &commandResult{done: make(chan struct{})}
+	c.results[id] = result
+	c.order = append(c.order, id)
+	if len(c.order) > maxRememberedCommands {
+		delete(c.results, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.mutex.Unlock()
+
+	defer close(result.done)
+	result.statusCode, result.response = handle()
+	return result.statusCode, result.response
+}
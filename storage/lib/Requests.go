@@ -5,7 +5,28 @@ type RegisterRequest struct {
 	ClientPort  int      `json:"client_port"`
 	CommandPort int      `json:"command_port"`
 	Files       []string `json:"files"`
+	Sizes       []int64  `json:"sizes"`
+	Zone        string   `json:"zone"`
+	TotalBytes  int64    `json:"total_bytes"`
+	FreeBytes   int64    `json:"free_bytes"`
 }
+type HeartbeatRequest struct {
+	StorageIP   string `json:"storage_ip"`
+	ClientPort  int    `json:"client_port"`
+	CommandPort int    `json:"command_port"`
+	FileCount   int    `json:"file_count"`
+	UsedBytes   int64  `json:"used_bytes"`
+	TotalBytes  int64  `json:"total_bytes"`
+	FreeBytes   int64  `json:"free_bytes"`
+}
+type WriteNotification struct {
+	StorageIP   string `json:"storage_ip"`
+	ClientPort  int    `json:"client_port"`
+	CommandPort int    `json:"command_port"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+}
+
 type ReadRequest struct {
 	Path   string `json:"path"`
 	Offset int64  `json:"offset"`
@@ -26,6 +47,11 @@ type CreateRequest struct {
 	Path string `json:"path"`
 }
 
+type RenameRequest struct {
+	Path    string `json:"path"`
+	NewPath string `json:"new_path"`
+}
+
 type CopyRequest struct {
 	Path       string `json:"path"`
 	SourceAddr string `json:"server_ip"`
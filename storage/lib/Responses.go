@@ -15,3 +15,13 @@ type SizeResponse struct {
 type SuccessResponse struct {
 	Success bool `json:"success"`
 }
+
+// ListedFile is a file stored by the storage server and its size in bytes.
+type ListedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type ListResponse struct {
+	Files []ListedFile `json:"files"`
+}
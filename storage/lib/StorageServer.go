@@ -2,32 +2,88 @@ package storage
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// errDecommissioned is returned when the naming server refuses this storage server for good.
+var errDecommissioned = errors.New("this storage server has been decommissioned")
+
+// Config holds optional settings of a storage server.
+type Config struct {
+	// BindAddress is the address the client and command interfaces listen on.
+	// They listen on all addresses if it is empty.
+	BindAddress string
+	// AdvertiseAddress is the address the naming server and clients use to reach this storage server.
+	// It defaults to BindAddress if that is a specific IP address, and to 127.0.0.1 otherwise.
+	AdvertiseAddress string
+	// NamingAddress is the host of the naming server, localhost if it is empty.
+	NamingAddress string
+	// HeartbeatInterval is the period of heartbeats sent to the naming server.
+	// No heartbeats are sent if it is not positive.
+	HeartbeatInterval time.Duration
+	// Capacity is the number of bytes this storage server may store.
+	// The capacity of the disk holding the directory is reported if it is not positive.
+	Capacity int64
+	// Zone is the failure domain of this storage server, e.g. its rack.
+	// The naming server spreads the replicas of a file across zones.
+	Zone string
+}
+
 type StorageServer struct {
 	clientPort       int
 	commandPort      int
 	registrationPort int
+	config           Config
+	advertiseAddress string
 	service          *gin.Engine
 	command          *gin.Engine
 	mutex            sync.RWMutex
 	fileSystem       *FileSystem
+	commandResults   commandResults
 }
 
-func NewStorageServer(directory string, clientPort int, commandPort int, registrationPort int) *StorageServer {
+// advertiseAddress returns the address a storage server with the given config advertises.
+func advertiseAddress(config Config) string {
+	if config.AdvertiseAddress != "" {
+		return config.AdvertiseAddress
+	}
+	if ip := net.ParseIP(config.BindAddress); ip != nil && !ip.IsUnspecified() {
+		return ip.String()
+	}
+	return "127.0.0.1"
+}
+
+// namingURL returns the URL of a command on the registration interface of the naming server.
+func (s *StorageServer) namingURL(command string) string {
+	host := s.config.NamingAddress
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, strconv.Itoa(s.registrationPort)), command)
+}
+
+func NewStorageServer(directory string, clientPort int, commandPort int, registrationPort int, config Config) *StorageServer {
 	storageServer := &StorageServer{
 		clientPort:       clientPort,
 		commandPort:      commandPort,
 		registrationPort: registrationPort,
+		config:           config,
+		advertiseAddress: advertiseAddress(config),
 		service:          gin.Default(),
 		command:          gin.Default(),
 		fileSystem:       &FileSystem{directory},
+		commandResults:   commandResults{results: make(map[string]*commandResult)},
 	}
 
 	// Register client APIs
@@ -66,7 +122,9 @@ func NewStorageServer(directory string, clientPort int, commandPort int, registr
 			ctx.JSON(http.StatusBadRequest, nil)
 			return
 		}
-		statusCode, response := storageServer.handleCreate(request)
+		statusCode, response := storageServer.idempotent(ctx, func() (int, any) {
+			return storageServer.handleCreate(request)
+		})
 		ctx.JSON(statusCode, response)
 	})
 	storageServer.command.POST("/storage_delete", func(ctx *gin.Context) {
@@ -75,7 +133,9 @@ func NewStorageServer(directory string, clientPort int, commandPort int, registr
 			ctx.JSON(http.StatusBadRequest, nil)
 			return
 		}
-		statusCode, response := storageServer.handleDelete(request)
+		statusCode, response := storageServer.idempotent(ctx, func() (int, any) {
+			return storageServer.handleDelete(request)
+		})
 		ctx.JSON(statusCode, response)
 	})
 	storageServer.command.POST("/storage_copy", func(ctx *gin.Context) {
@@ -84,7 +144,24 @@ func NewStorageServer(directory string, clientPort int, commandPort int, registr
 			ctx.JSON(http.StatusBadRequest, nil)
 			return
 		}
-		statusCode, response := storageServer.handleCopy(request)
+		statusCode, response := storageServer.idempotent(ctx, func() (int, any) {
+			return storageServer.handleCopy(request)
+		})
+		ctx.JSON(statusCode, response)
+	})
+	storageServer.command.POST("/storage_rename", func(ctx *gin.Context) {
+		var request RenameRequest
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := storageServer.idempotent(ctx, func() (int, any) {
+			return storageServer.handleRename(request)
+		})
+		ctx.JSON(statusCode, response)
+	})
+	storageServer.command.POST("/storage_list", func(ctx *gin.Context) {
+		statusCode, response := storageServer.handleList()
 		ctx.JSON(statusCode, response)
 	})
 	return storageServer
@@ -92,26 +169,20 @@ func NewStorageServer(directory string, clientPort int, commandPort int, registr
 
 func (s *StorageServer) Start() {
 	log.Printf("Trying to register at port %d\n", s.registrationPort)
-	for {
-		err := s.register()
-		if err != nil {
-			// log.Printf("Failed to register: %s\n", err.Error())
-			continue
-		} else {
-			log.Println("Registered successfully")
-			break
-		}
+	s.registerUntilSuccess()
+	if s.config.HeartbeatInterval > 0 {
+		go s.sendHeartbeats()
 	}
 
 	chanErr := make(chan error)
 	go func() {
 		log.Printf("Storage server client interface listening on port %d\n", s.clientPort)
-		err := s.service.Run(fmt.Sprintf("localhost:%d", s.clientPort))
+		err := s.service.Run(net.JoinHostPort(s.config.BindAddress, strconv.Itoa(s.clientPort)))
 		chanErr <- err
 	}()
 	go func() {
 		log.Printf("Storage server command interface listening on port %d\n", s.commandPort)
-		err := s.command.Run(fmt.Sprintf("localhost:%d", s.commandPort))
+		err := s.command.Run(net.JoinHostPort(s.config.BindAddress, strconv.Itoa(s.commandPort)))
 		chanErr <- err
 	}()
 
@@ -130,10 +201,19 @@ func (s *StorageServer) handleRead(request ReadRequest) (int, any) {
 
 // handleWrite handles the HTTP request for writing data to a file.
 func (s *StorageServer) handleWrite(request WriteRequest) (int, any) {
+	if ex := s.checkQuota(request); ex != nil {
+		return http.StatusConflict, ex
+	}
 	err := s.fileSystem.WriteFile(request.Path, request.Data, request.Offset)
 	if err != nil {
 		return http.StatusNotFound, err
 	}
+	// the write already succeeded, a failed notification is only logged
+	if size, err := s.fileSystem.GetFileSize(request.Path); err == nil {
+		if err := s.notifyWrite(request.Path, size); err != nil {
+			log.Printf("Failed to notify the naming server of a write: %v", err)
+		}
+	}
 	return http.StatusOK, SuccessResponse{true}
 }
 
@@ -164,6 +244,24 @@ func (s *StorageServer) handleDelete(request DeleteRequest) (int, any) {
 	return http.StatusOK, SuccessResponse{success}
 }
 
+// handleRename handles the HTTP request for moving a file or directory.
+func (s *StorageServer) handleRename(request RenameRequest) (int, any) {
+	success, err := s.fileSystem.RenamePath(request.Path, request.NewPath)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, SuccessResponse{success}
+}
+
+// handleList handles the HTTP request for listing every file stored by the storage server.
+func (s *StorageServer) handleList() (int, any) {
+	files, err := s.fileSystem.Inventory()
+	if err != nil {
+		return http.StatusNotFound, DFSException{Type: IOException, Msg: err.Error()}
+	}
+	return http.StatusOK, ListResponse{files}
+}
+
 // handleCopy handles the HTTP request for copying a file from another storage server.
 func (s *StorageServer) handleCopy(request CopyRequest) (int, any) {
 	// first get the size of the file
@@ -171,7 +269,7 @@ func (s *StorageServer) handleCopy(request CopyRequest) (int, any) {
 		return http.StatusNotFound, DFSException{IllegalArgumentException, "Path cannot be empty"}
 	}
 	log.Printf("Sending size request...")
-	url := fmt.Sprintf("http://%s:%d/storage_size", request.SourceAddr, request.SourcePort)
+	url := fmt.Sprintf("http://%s/storage_size", net.JoinHostPort(request.SourceAddr, strconv.Itoa(request.SourcePort)))
 	log.Println(url)
 	sizeReq := SizeRequest{request.Path}
 	payload, err := json.Marshal(sizeReq)
@@ -194,7 +292,7 @@ func (s *StorageServer) handleCopy(request CopyRequest) (int, any) {
 
 	// Now request the entire file
 	log.Printf("Sending read request...")
-	url = fmt.Sprintf("http://%s:%d/storage_read", request.SourceAddr, request.SourcePort)
+	url = fmt.Sprintf("http://%s/storage_read", net.JoinHostPort(request.SourceAddr, strconv.Itoa(request.SourcePort)))
 	readReq := ReadRequest{
 		Path:   request.Path,
 		Offset: 0,
@@ -224,17 +322,217 @@ func (s *StorageServer) handleCopy(request CopyRequest) (int, any) {
 	return http.StatusOK, SuccessResponse{true}
 }
 
+// registerRetryInterval is the delay between registration attempts when heartbeats are disabled.
+const registerRetryInterval = time.Second
+
+// registerUntilSuccess keeps registering with the naming server until it succeeds,
+// waiting one heartbeat interval between attempts.
+// The storage server shuts down if it has been decommissioned.
+func (s *StorageServer) registerUntilSuccess() {
+	retryInterval := s.config.HeartbeatInterval
+	if retryInterval <= 0 {
+		retryInterval = registerRetryInterval
+	}
+	for {
+		err := s.register()
+		if errors.Is(err, errDecommissioned) {
+			log.Fatalf("Registration refused: %v", err)
+		}
+		if err != nil {
+			// log.Printf("Failed to register: %s\n", err.Error())
+			time.Sleep(retryInterval)
+			continue
+		} else {
+			log.Println("Registered successfully")
+			break
+		}
+	}
+}
+
+// sendHeartbeats periodically reports liveness and usage statistics to the naming server.
+// If the naming server no longer knows this storage server (e.g. it was declared dead),
+// the storage server registers again. It shuts down if it has been decommissioned.
+func (s *StorageServer) sendHeartbeats() {
+	ticker := time.NewTicker(s.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		unknown, err := s.heartbeat()
+		if errors.Is(err, errDecommissioned) {
+			log.Fatalf("Heartbeat refused: %v", err)
+		}
+		if err != nil {
+			log.Printf("Failed to send heartbeat: %v", err)
+			continue
+		}
+		if unknown {
+			log.Println("Naming server does not know this storage server, registering again")
+			s.registerUntilSuccess()
+		}
+	}
+}
+
+// capacity returns the total and the free number of bytes of this storage server,
+// given that usedBytes are used by its files.
+// Both are 0 if the capacity of the disk is unknown and no capacity is configured.
+func (s *StorageServer) capacity(usedBytes int64) (int64, int64) {
+	totalBytes, freeBytes, err := s.fileSystem.diskCapacity()
+	if err != nil {
+		log.Printf("Failed to get the capacity of the disk: %v", err)
+		totalBytes, freeBytes = 0, 0
+	}
+	if s.config.Capacity <= 0 {
+		return totalBytes, freeBytes
+	}
+	// the free space is limited by both the configured capacity and the disk
+	free := s.config.Capacity - usedBytes
+	if totalBytes > 0 && freeBytes < free {
+		free = freeBytes
+	}
+	if free < 0 {
+		free = 0
+	}
+	return s.config.Capacity, free
+}
+
+// heartbeat sends one heartbeat to the naming server.
+// It returns true if the naming server rejected the heartbeat because this storage server is not registered.
+func (s *StorageServer) heartbeat() (bool, error) {
+	fileCount, usedBytes, err := s.fileSystem.Usage()
+	if err != nil {
+		return false, err
+	}
+	totalBytes, freeBytes := s.capacity(usedBytes)
+	reqBody := HeartbeatRequest{
+		StorageIP:   s.advertiseAddress,
+		ClientPort:  s.clientPort,
+		CommandPort: s.commandPort,
+		FileCount:   fileCount,
+		UsedBytes:   usedBytes,
+		TotalBytes:  totalBytes,
+		FreeBytes:   freeBytes,
+	}
+	reqBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return false, err
+	}
+	url := s.namingURL("/heartbeat")
+	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	if resp.StatusCode == http.StatusGone {
+		return false, errDecommissioned
+	}
+	// naming servers without heartbeat support answer with something other than a DFSException
+	var exception DFSException
+	if err := json.NewDecoder(resp.Body).Decode(&exception); err != nil {
+		return false, fmt.Errorf("heartbeat failed with status code %d", resp.StatusCode)
+	}
+	return exception.Type == IllegalStateException, nil
+}
+
+// checkQuota asks the naming server whether a write that grows a file fits in the
+// quotas of its directories. Only an explicit QuotaExceededException refuses the
+// write: if the naming server cannot be asked, the write is allowed.
+func (s *StorageServer) checkQuota(request WriteRequest) *DFSException {
+	size, ex := s.fileSystem.GetFileSize(request.Path)
+	if ex != nil {
+		// reported by the write itself
+		return nil
+	}
+	padding := len(request.Data) - len(strings.TrimRight(request.Data, "="))
+	end := request.Offset + int64(base64.StdEncoding.DecodedLen(len(request.Data))-padding)
+	if end <= size {
+		return nil
+	}
+
+	reqBody := WriteNotification{
+		StorageIP:   s.advertiseAddress,
+		ClientPort:  s.clientPort,
+		CommandPort: s.commandPort,
+		Path:        request.Path,
+		Size:        end,
+	}
+	reqBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil
+	}
+	url := s.namingURL("/check_quota")
+	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
+	if err != nil {
+		log.Printf("Failed to check the quota of %s: %v", request.Path, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		return nil
+	}
+	var exception DFSException
+	if err := json.NewDecoder(resp.Body).Decode(&exception); err != nil || exception.Type != QuotaExceededException {
+		return nil
+	}
+	return &exception
+}
+
+// notifyWrite reports the new size of a written file to the naming server.
+func (s *StorageServer) notifyWrite(path string, size int64) error {
+	reqBody := WriteNotification{
+		StorageIP:   s.advertiseAddress,
+		ClientPort:  s.clientPort,
+		CommandPort: s.commandPort,
+		Path:        path,
+		Size:        size,
+	}
+	reqBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	url := s.namingURL("/notify_write")
+	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("write notification failed with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (s *StorageServer) register() error {
-	files, err := s.fileSystem.ListFiles()
+	inventory, err := s.fileSystem.Inventory()
+	if err != nil {
+		return err
+	}
+	files := make([]string, len(inventory))
+	sizes := make([]int64, len(inventory))
+	for i, file := range inventory {
+		files[i] = file.Path
+		sizes[i] = file.Size
+	}
+
+	_, usedBytes, err := s.fileSystem.Usage()
 	if err != nil {
 		return err
 	}
+	totalBytes, freeBytes := s.capacity(usedBytes)
 
 	reqBody := RegisterRequest{
-		StorageIP:   "127.0.0.1",
+		StorageIP:   s.advertiseAddress,
 		ClientPort:  s.clientPort,
 		CommandPort: s.commandPort,
 		Files:       files,
+		Sizes:       sizes,
+		Zone:        s.config.Zone,
+		TotalBytes:  totalBytes,
+		FreeBytes:   freeBytes,
 	}
 
 	reqBytes, err := json.Marshal(reqBody)
@@ -242,7 +540,7 @@ func (s *StorageServer) register() error {
 		return err
 	}
 
-	url := fmt.Sprintf("http://localhost:%d/register", s.registrationPort)
+	url := s.namingURL("/register")
 	log.Printf("Sending registration request to %s\n", url)
 	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
 	if err != nil {
@@ -251,6 +549,10 @@ func (s *StorageServer) register() error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusGone {
+		return errDecommissioned
+	}
+
 	if resp.StatusCode == http.StatusConflict {
 		var exception DFSException
 		if err := json.NewDecoder(resp.Body).Decode(&exception); err != nil {
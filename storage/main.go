@@ -1,36 +1,47 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	storage "storage/lib"
 	"strconv"
+	"time"
 )
 
 func main() {
-	if len(os.Args) != 5 {
+	var config storage.Config
+	flag.StringVar(&config.BindAddress, "bind", "localhost", "address the client and command interfaces listen on (empty for all addresses)")
+	flag.StringVar(&config.AdvertiseAddress, "advertise", "", "address the naming server and clients use to reach this storage server (defaults to the bind address if it is an IP address, or 127.0.0.1)")
+	flag.StringVar(&config.NamingAddress, "naming", "localhost", "host of the naming server")
+	flag.DurationVar(&config.HeartbeatInterval, "heartbeat-interval", 2*time.Second, "period of heartbeats sent to the naming server (0 disables heartbeats)")
+	flag.Int64Var(&config.Capacity, "capacity", 0, "number of bytes this storage server may store (0 reports the capacity of the disk)")
+	flag.StringVar(&config.Zone, "zone", "", "failure domain of this storage server, e.g. its rack, replicas of a file are spread across zones")
+	flag.Parse()
+
+	if flag.NArg() != 4 {
 		fmt.Println("Wrong number of arguments")
 		os.Exit(-1)
 	}
-	clientPort, err := strconv.Atoi(os.Args[1])
+	clientPort, err := strconv.Atoi(flag.Arg(0))
 	if err != nil {
-		fmt.Printf("%s is not a valid port number\n", os.Args[1])
+		fmt.Printf("%s is not a valid port number\n", flag.Arg(0))
 		os.Exit(-1)
 	}
 
-	commandPort, err := strconv.Atoi(os.Args[2])
+	commandPort, err := strconv.Atoi(flag.Arg(1))
 	if err != nil {
-		fmt.Printf("%s is not a valid port number\n", os.Args[2])
+		fmt.Printf("%s is not a valid port number\n", flag.Arg(1))
 		os.Exit(-1)
 	}
 
-	registrationPort, err := strconv.Atoi(os.Args[3])
+	registrationPort, err := strconv.Atoi(flag.Arg(2))
 	if err != nil {
-		fmt.Printf("%s is not a valid port number\n", os.Args[3])
+		fmt.Printf("%s is not a valid port number\n", flag.Arg(2))
 		os.Exit(-1)
 	}
 
-	directory := os.Args[4]
+	directory := flag.Arg(3)
 	// Ensure the storage directory exists
 	/*
 		err = os.MkdirAll(directory, os.ModePerm)
@@ -39,6 +50,6 @@ func main() {
 		}
 	*/
 
-	server := storage.NewStorageServer(directory, clientPort, commandPort, registrationPort)
+	server := storage.NewStorageServer(directory, clientPort, commandPort, registrationPort, config)
 	server.Start()
 }